@@ -0,0 +1,209 @@
+// Package app wires the site together: it owns the configuration, database,
+// session store, templates and loggers, and serves every route from one
+// http.Handler. main.go runs an App; integration tests start one against a
+// test database with httptest.NewServer.
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+	"webapp/config"
+	"webapp/database"
+	"webapp/handlers"
+	"webapp/mailer"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+// App is a running site. It owns the sessions its handlers log users in
+// with. The database and loggers are also installed as the database and
+// utils package defaults, which the rest of the code still reads, so only
+// one App should be open at a time.
+type App struct {
+	Config    *config.Config
+	DB        *sql.DB
+	Sessions  *middleware.Sessions
+	Templates *handlers.Templates
+	Loggers   *utils.Loggers
+	Mailer    mailer.Mailer
+	Handlers  *handlers.Handlers
+
+	stop chan struct{}
+}
+
+// New opens the database, applies pending migrations and loads the
+// templates. cfg should already be validated, as config.Load does. Call
+// Close when done.
+func New(cfg *config.Config) (*App, error) {
+	app := &App{Config: cfg, stop: make(chan struct{})}
+
+	var err error
+	if cfg.LogDir == "" {
+		app.Loggers = utils.DiscardLoggers()
+	} else if app.Loggers, err = utils.NewLoggers(cfg.LogDir); err != nil {
+		return nil, err
+	}
+	utils.SetLoggers(app.Loggers)
+	for _, field := range cfg.RedactFields {
+		utils.AddRedactedField(field)
+	}
+
+	// New password hashes use PASSWORD_HASH / BCRYPT_COST; older hashes are
+	// upgraded when their owners next log in
+	if err := middleware.SetPasswordConfig(cfg.Password); err != nil {
+		app.Loggers.Close()
+		return nil, fmt.Errorf("password hashing config: %w", err)
+	}
+
+	if app.DB, err = database.Open(cfg.DB.Driver, cfg.DB.Source()); err != nil {
+		app.Loggers.Close()
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	if err := database.Setup(); err != nil {
+		app.Close()
+		return nil, err
+	}
+	// Posts written before permalinks existed get their slugs
+	if assigned, err := repository.NewSQLPostRepository(app.DB).AssignMissingSlugs(context.Background()); err != nil {
+		app.Close()
+		return nil, fmt.Errorf("assigning post slugs: %w", err)
+	} else if assigned > 0 {
+		utils.LogInfo(fmt.Sprintf("Assigned slugs to %d posts", assigned))
+	}
+
+	if app.Templates, err = handlers.LoadTemplates(cfg.TemplateDir); err != nil {
+		app.Close()
+		return nil, fmt.Errorf("loading templates: %w", err)
+	}
+	if err := os.MkdirAll(handlers.ProfileImageDir(cfg.UploadDir), 0755); err != nil {
+		app.Close()
+		return nil, fmt.Errorf("creating upload directory: %w", err)
+	}
+
+	// Keep sessions in the database so restarts and multiple instances share
+	// them. Session cookies are signed with SESSION_SECRET, which only
+	// development may leave unset.
+	if cfg.SessionSecret == "" {
+		utils.LogError("SESSION_SECRET not set, using a random key for this process")
+	}
+	app.Sessions = middleware.NewSessions(middleware.NewMySQLStore(app.DB), []byte(cfg.SessionSecret), cfg.SessionLifetime)
+
+	// Emails go through SMTP, or to files in MAIL_DIR without it
+	if cfg.SMTP.Host != "" {
+		app.Mailer = mailer.NewSMTPMailer(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.User, cfg.SMTP.Password, cfg.SMTP.From)
+	} else {
+		app.Mailer = mailer.NewFileMailer(cfg.MailDir)
+	}
+
+	app.Handlers = handlers.New(app.DB, cfg, app.Templates, app.Mailer, app.Sessions)
+	return app, nil
+}
+
+// Handler serves every route, with CSRF protection and session renewal.
+func (a *App) Handler() http.Handler {
+	h := a.Handlers
+	mux := http.NewServeMux()
+
+	// Static files handler for ghost.gif and uploaded files
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(a.Config.StaticDir))))
+	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(a.Config.UploadDir))))
+
+	mux.HandleFunc("/", h.HomeHandler)
+	mux.HandleFunc("/signup", h.SignupHandler)
+	mux.HandleFunc("/login", h.LoginHandler)
+	mux.HandleFunc("/login/2fa", h.TwoFactorLoginHandler)
+	mux.HandleFunc("/logout", h.LogoutHandler)
+	mux.HandleFunc("/forgot-password", h.ForgotPasswordHandler)
+	mux.HandleFunc("/reset-password", h.ResetPasswordHandler)
+	mux.HandleFunc("/post/create", h.CreatePostHandler)
+	mux.HandleFunc("/post/edit", h.EditPostHandler)
+	mux.HandleFunc("/post/delete", h.DeletePostHandler)
+	mux.HandleFunc("/post/preview", h.PreviewPostHandler)
+	mux.HandleFunc("/post/{slug}", h.ViewPostHandler)
+	mux.HandleFunc("/tag/{name}", h.TagHandler)
+	mux.HandleFunc("/comment/create", h.CreateCommentHandler)
+	mux.HandleFunc("/comment/edit", h.EditCommentHandler)
+	mux.HandleFunc("/comment/delete", h.DeleteCommentHandler)
+
+	// Profile routes
+	mux.HandleFunc("/profile", h.ProfileHandler)
+	mux.HandleFunc("/edit-profile", h.EditProfileHandler)
+	mux.HandleFunc("/profile/delete-image", h.DeleteProfileImageHandler)
+	mux.HandleFunc("/user", h.PublicProfileHandler)
+	mux.HandleFunc("/profile/password", h.ChangePasswordHandler)
+	mux.HandleFunc("/profile/email", h.ChangeEmailHandler)
+	mux.HandleFunc("/profile/verify-email", h.VerifyEmailHandler)
+	mux.HandleFunc("/profile/2fa", h.TwoFactorSettingsHandler)
+	mux.HandleFunc("/profile/2fa/enable", h.EnableTwoFactorHandler)
+	mux.HandleFunc("/profile/2fa/disable", h.DisableTwoFactorHandler)
+
+	// Admin routes, each gated on a permission granted by the user's roles
+	mux.HandleFunc("/admin", h.RequirePermission(database.PermViewDashboard)(h.AdminDashboardHandler))
+	mux.HandleFunc("/admin/generate-code", h.RequirePermission(database.PermCreateInvites)(h.GenerateInviteCodeHandler))
+	mux.HandleFunc("/admin/users", h.RequirePermission(database.PermViewUsers)(h.AdminUsersHandler))
+	mux.HandleFunc("/admin/users/role", h.RequirePermission(database.PermManageRoles)(h.UpdateUserRoleHandler))
+	mux.HandleFunc("/admin/users/suspend", h.RequirePermission(database.PermManageUsers)(h.SuspendUserHandler))
+	mux.HandleFunc("/admin/users/force-reset", h.RequirePermission(database.PermManageUsers)(h.ForcePasswordResetHandler))
+	mux.HandleFunc("/admin/users/delete", h.RequirePermission(database.PermManageUsers)(h.DeleteUserHandler))
+	mux.HandleFunc("/admin/clean-users", h.RequirePermission(database.PermManageUsers)(h.CleanAllUsersHandler))
+	mux.HandleFunc("/admin/trash", h.RequirePermission(database.PermManageTrash)(h.AdminTrashHandler))
+	mux.HandleFunc("/admin/trash/restore", h.RequirePermission(database.PermManageTrash)(h.RestoreTrashHandler))
+	mux.HandleFunc("/admin/trash/purge", h.RequirePermission(database.PermManageTrash)(h.PurgeTrashHandler))
+	mux.HandleFunc("/admin/comments", h.RequirePermission(database.PermModerateComments)(h.AdminCommentsHandler))
+	mux.HandleFunc("/admin/comments/hide", h.RequirePermission(database.PermModerateComments)(h.HideCommentHandler))
+	mux.HandleFunc("/admin/tags", h.RequirePermission(database.PermManageTags)(h.AdminTagsHandler))
+	mux.HandleFunc("/admin/tags/rename", h.RequirePermission(database.PermManageTags)(h.RenameTagHandler))
+	mux.HandleFunc("/admin/tags/merge", h.RequirePermission(database.PermManageTags)(h.MergeTagHandler))
+	mux.HandleFunc("/admin/audit", h.RequirePermission(database.PermViewAudit)(h.AdminAuditHandler))
+	mux.HandleFunc("/admin/lockouts", h.RequirePermission(database.PermManageSecurity)(h.AdminLockoutsHandler))
+	mux.HandleFunc("/admin/unlock", h.RequirePermission(database.PermManageSecurity)(h.UnlockAccountHandler))
+	mux.HandleFunc("/admin/settings/2fa", h.RequirePermission(database.PermManageSecurity)(h.AdminTwoFactorPolicyHandler))
+
+	return a.Sessions.Renew(a.Sessions.CSRFProtect(a.Config.MaxUploadSize)(mux))
+}
+
+// Start runs the background jobs: expired session cleanup and the trash
+// purge. They stop when the App is closed.
+func (a *App) Start() {
+	a.Sessions.StartGC(time.Hour, a.stop, func(err error) {
+		utils.LogError(fmt.Sprintf("Session cleanup failed: %v", err))
+	})
+
+	database.StartTrashPurger(a.Config.TrashRetention, time.Hour, a.stop, func(users, posts int64, err error) {
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Trash purge failed: %v", err))
+			return
+		}
+		if users+posts == 0 {
+			return
+		}
+		utils.LogInfo(fmt.Sprintf("Purged %d users and %d posts from the trash", users, posts))
+		metadata := map[string]interface{}{"users": users, "posts": posts}
+		if err := a.Handlers.Audit.Record(context.Background(), models.AuditEvent{ActorName: "system", Action: database.AuditTrashPurge, TargetType: "trash"}, metadata); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to record audit event %s: %v", database.AuditTrashPurge, err))
+		}
+	})
+}
+
+// Close stops the background jobs and closes the database and log files.
+func (a *App) Close() error {
+	select {
+	case <-a.stop:
+	default:
+		close(a.stop)
+	}
+	var err error
+	if a.DB != nil {
+		err = a.DB.Close()
+	}
+	if closeErr := a.Loggers.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
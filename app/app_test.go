@@ -0,0 +1,427 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"webapp/config"
+	"webapp/database"
+	"webapp/mailer"
+	"webapp/middleware"
+	"webapp/models"
+)
+
+func TestMain(m *testing.M) {
+	// Quiet the migration progress the database package logs
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testConfig uses a fresh SQLite database and the repo's templates
+func testConfig(t *testing.T) *config.Config {
+	cfg := config.Defaults()
+	cfg.DB = config.DBConfig{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "test.db")}
+	cfg.SessionSecret = "test-secret-that-is-long-enough-1234"
+	cfg.TemplateDir = "../templates"
+	cfg.StaticDir = "../static"
+	cfg.UploadDir = t.TempDir()
+	cfg.LogDir = ""
+	return cfg
+}
+
+// newTestApp opens an App for cfg, closed when the test ends
+func newTestApp(t *testing.T, cfg *config.Config) *App {
+	t.Helper()
+	site, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { site.Close() })
+	// Keep outgoing mail where tests can read it
+	site.Handlers.Mailer = mailer.NewMemoryMailer()
+	return site
+}
+
+// newTestServer starts the whole site on a fresh SQLite database
+func newTestServer(t *testing.T) (*App, *httptest.Server) {
+	t.Helper()
+	site := newTestApp(t, testConfig(t))
+	server := httptest.NewServer(site.Handler())
+	t.Cleanup(server.Close)
+	return site, server
+}
+
+// createUser adds a user with password "secret123", granted role if set
+func createUser(t *testing.T, site *App, username, role string) {
+	t.Helper()
+	hash, err := middleware.HashPassword("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := site.Handlers.Users.Create(context.Background(), models.User{Username: username, Email: username + "@example.com", Password: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role != "" {
+		if err := site.Handlers.Permissions.GrantRole(context.Background(), id, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// browser is a client with a cookie jar that doesn't follow redirects
+type browser struct {
+	t      *testing.T
+	base   string
+	client *http.Client
+}
+
+func newBrowser(t *testing.T, server *httptest.Server) *browser {
+	jar, _ := cookiejar.New(nil)
+	return &browser{t: t, base: server.URL, client: &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+func (b *browser) get(path string) (*http.Response, string) {
+	b.t.Helper()
+	resp, err := b.client.Get(b.base + path)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp, readBody(b.t, resp)
+}
+
+var csrfInput = regexp.MustCompile(`name="csrf_token" value="([^"]+)"`)
+
+// submit loads page for its CSRF token, then posts form to path
+func (b *browser) submit(page, path string, form url.Values) (*http.Response, string) {
+	b.t.Helper()
+	_, body := b.get(page)
+	match := csrfInput.FindStringSubmatch(body)
+	if match == nil {
+		b.t.Fatalf("no CSRF token on %s", page)
+	}
+	form.Set("csrf_token", match[1])
+
+	resp, err := b.client.PostForm(b.base+path, form)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return resp, readBody(b.t, resp)
+}
+
+func (b *browser) logIn(username string) {
+	b.t.Helper()
+	resp, body := b.submit("/login", "/login", url.Values{"username": {username}, "password": {"secret123"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		b.t.Fatalf("login as %s: status %d\n%s", username, resp.StatusCode, body)
+	}
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHomePage(t *testing.T) {
+	_, server := newTestServer(t)
+
+	resp, _ := newBrowser(t, server).get("/")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestPostWithoutCSRFTokenRejected(t *testing.T) {
+	_, server := newTestServer(t)
+
+	resp, err := http.PostForm(server.URL+"/login", url.Values{"username": {"admin"}, "password": {"secret123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestAdminRequiresPermission(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "casper", "")
+
+	b := newBrowser(t, server)
+	if resp, _ := b.get("/admin"); resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login" {
+		t.Errorf("anonymous /admin: %d to %q, want a redirect to /login", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	b.logIn("casper")
+	if resp, _ := b.get("/admin"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member /admin: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestInvitedSignupAndPost(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "admin", database.RoleAdmin)
+
+	admin := newBrowser(t, server)
+	admin.logIn("admin")
+	resp, _ := admin.submit("/admin", "/admin/generate-code", url.Values{})
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("generate code: status %d, no redirect", resp.StatusCode)
+	}
+	code := location.Query().Get("code")
+
+	guest := newBrowser(t, server)
+	resp, body := guest.submit("/signup", "/signup", url.Values{
+		"username":        {"casper"},
+		"email":           {"casper@example.com"},
+		"password":        {"secret123"},
+		"invitation_code": {code},
+	})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("signup: status %d\n%s", resp.StatusCode, body)
+	}
+
+	guest.logIn("casper")
+	resp, body = guest.submit("/post/create", "/post/create", url.Values{"title": {"A haunting"}, "content": {"**Boo**"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("create post: status %d\n%s", resp.StatusCode, body)
+	}
+	if _, body := newBrowser(t, server).get("/"); !strings.Contains(body, "A haunting") || !strings.Contains(body, "<strong>Boo</strong>") {
+		t.Errorf("new post missing from the home page:\n%s", body)
+	}
+}
+
+func TestForgotPasswordSendsMail(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "casper", "")
+
+	newBrowser(t, server).submit("/forgot-password", "/forgot-password", url.Values{"email": {"casper@example.com"}})
+
+	messages := site.Handlers.Mailer.(*mailer.MemoryMailer).Messages()
+	if len(messages) != 1 || messages[0].To != "casper@example.com" || !strings.Contains(messages[0].Body, "/reset-password?token=") {
+		t.Errorf("sent %+v", messages)
+	}
+}
+
+func TestCommentModeration(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "admin", database.RoleAdmin)
+	createUser(t, site, "casper", "")
+	createUser(t, site, "spooky", "")
+
+	author := newBrowser(t, server)
+	author.logIn("casper")
+	author.submit("/post/create", "/post/create", url.Values{"title": {"A haunting"}, "content": {"Boo"}})
+
+	commenter := newBrowser(t, server)
+	commenter.logIn("spooky")
+	resp, body := commenter.submit("/post/a-haunting", "/comment/create", url.Values{"post_id": {"1"}, "content": {"Buy cheap sheets"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("comment: status %d\n%s", resp.StatusCode, body)
+	}
+	if _, body := newBrowser(t, server).get("/"); !strings.Contains(body, "1 comment") {
+		t.Errorf("comment count missing from the home page:\n%s", body)
+	}
+
+	// Only moderators can hide comments
+	hide := url.Values{"id": {"1"}, "hidden": {"true"}}
+	if resp, _ := author.submit("/post/a-haunting", "/admin/comments/hide", hide); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member hiding a comment: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	admin := newBrowser(t, server)
+	admin.logIn("admin")
+	if resp, body := admin.submit("/admin/comments", "/admin/comments/hide", hide); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("hide comment: status %d\n%s", resp.StatusCode, body)
+	}
+
+	_, body = newBrowser(t, server).get("/post/a-haunting")
+	if strings.Contains(body, "Buy cheap sheets") || !strings.Contains(body, "No comments yet") {
+		t.Errorf("hidden comment still shown:\n%s", body)
+	}
+	if _, body := admin.get("/admin/comments?filter=hidden"); !strings.Contains(body, "Buy cheap sheets") {
+		t.Errorf("hidden comment missing from moderation:\n%s", body)
+	}
+}
+
+func TestTagPages(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "admin", database.RoleAdmin)
+	createUser(t, site, "casper", "")
+
+	author := newBrowser(t, server)
+	author.logIn("casper")
+	resp, body := author.submit("/post/create", "/post/create", url.Values{"title": {"A haunting"}, "content": {"Boo"}, "tags": {"Ghost Stories, Halloween"}})
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("create post: status %d\n%s", resp.StatusCode, body)
+	}
+
+	reader := newBrowser(t, server)
+	if _, body := reader.get("/"); !strings.Contains(body, `class="tag-cloud"`) || !strings.Contains(body, `href="/tag/ghost-stories"`) {
+		t.Errorf("tag cloud missing from the home page:\n%s", body)
+	}
+	if resp, body := reader.get("/tag/ghost-stories"); resp.StatusCode != http.StatusOK || !strings.Contains(body, "A haunting") {
+		t.Errorf("tag page: status %d\n%s", resp.StatusCode, body)
+	}
+	if resp, _ := reader.get("/tag/Ghost%20Stories"); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/tag/ghost-stories" {
+		t.Errorf("unnormalized tag: %d to %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp, _ := reader.get("/tag/werewolves"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown tag: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// Members can't tidy up tags
+	if resp, _ := author.submit("/", "/admin/tags/merge", url.Values{"id": {"2"}, "into": {"ghost-stories"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("member merging tags: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	admin := newBrowser(t, server)
+	admin.logIn("admin")
+	resp, _ = admin.submit("/admin/tags", "/admin/tags/merge", url.Values{"id": {"2"}, "into": {"ghost-stories"}})
+	if location := resp.Header.Get("Location"); location != "/admin/tags?success=merged" {
+		t.Fatalf("merge: status %d to %q", resp.StatusCode, location)
+	}
+	resp, _ = admin.submit("/admin/tags", "/admin/tags/rename", url.Values{"id": {"1"}, "name": {"Spooky Tales"}})
+	if location := resp.Header.Get("Location"); location != "/admin/tags?success=renamed" {
+		t.Fatalf("rename: status %d to %q", resp.StatusCode, location)
+	}
+	if _, body := reader.get("/post/a-haunting"); !strings.Contains(body, "#spooky-tales") || strings.Contains(body, "#halloween") {
+		t.Errorf("post tags after merge and rename:\n%s", body)
+	}
+}
+
+func TestFailedLoginsOnlyForRealAccounts(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "casper", "")
+
+	b := newBrowser(t, server)
+	b.submit("/login", "/login", url.Values{"username": {"nobody"}, "password": {"guess"}})
+	b.submit("/login", "/login", url.Values{"username": {"casper"}, "password": {"guess"}})
+
+	var usernames []string
+	rows, err := site.DB.Query("SELECT username FROM failed_logins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		rows.Scan(&username)
+		usernames = append(usernames, username)
+	}
+	if len(usernames) != 1 || usernames[0] != "casper" {
+		t.Errorf("failed_logins has %q, want only casper", usernames)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "spooky", "")
+
+	b := newBrowser(t, server)
+	b.logIn("spooky")
+	for range middleware.MaxLoginFailures {
+		resp, _ := b.submit("/edit-profile", "/profile/password", url.Values{
+			"current_password": {"guess"}, "new_password": {"hunter22"}, "confirm_password": {"hunter22"},
+		})
+		if location := resp.Header.Get("Location"); !strings.Contains(location, "error=wrong_password") {
+			t.Fatalf("wrong password redirected to %q", location)
+		}
+	}
+
+	// Locked now, so even the right password is refused
+	resp, _ := b.submit("/edit-profile", "/profile/email", url.Values{
+		"current_password": {"secret123"}, "new_email": {"new@example.com"},
+	})
+	if location := resp.Header.Get("Location"); !strings.Contains(location, "error=too_many_attempts") {
+		t.Errorf("locked account redirected to %q", location)
+	}
+	resp, _ = b.submit("/login", "/login", url.Values{"username": {"spooky"}, "password": {"secret123"}})
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("login while locked: status %d", resp.StatusCode)
+	}
+}
+
+func TestStaffTwoFactorPolicy(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "admin", database.RoleAdmin)
+	createUser(t, site, "casper", "")
+
+	author := newBrowser(t, server)
+	author.logIn("casper")
+	author.submit("/post/create", "/post/create", url.Values{"title": {"A haunting"}, "content": {"Boo"}})
+
+	if err := site.Handlers.Permissions.SetStaffTwoFactorRequired(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	admin := newBrowser(t, server)
+	admin.logIn("admin")
+	if resp, _ := admin.get("/admin"); resp.Header.Get("Location") != "/profile/2fa" {
+		t.Errorf("admin without 2FA: %d to %q, want a redirect to /profile/2fa", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	// Moderating someone else's post needs 2FA too
+	if resp, _ := admin.submit("/post/a-haunting", "/post/delete", url.Values{"id": {"1"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("admin without 2FA deleting a post: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	// Authors don't need it for their own posts
+	if resp, body := author.submit("/post/a-haunting", "/post/delete", url.Values{"id": {"1"}}); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("author deleting their post: status %d\n%s", resp.StatusCode, body)
+	}
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	site, server := newTestServer(t)
+	createUser(t, site, "admin", database.RoleAdmin)
+	createUser(t, site, "casper", "")
+
+	author := newBrowser(t, server)
+	author.logIn("casper")
+	author.submit("/post/create", "/post/create", url.Values{"title": {"A haunting"}, "content": {"Boo"}})
+	author.submit("/post/a-haunting", "/post/delete", url.Values{"id": {"1"}})
+	if resp, _ := author.get("/post/a-haunting"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("trashed post: status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	admin := newBrowser(t, server)
+	admin.logIn("admin")
+	if _, body := admin.get("/admin/trash"); !strings.Contains(body, "A haunting") {
+		t.Errorf("trashed post missing from the trash page:\n%s", body)
+	}
+	post := url.Values{"type": {"post"}, "id": {"1"}}
+	if resp, _ := admin.submit("/admin/trash", "/admin/trash/restore", post); resp.Header.Get("Location") != "/admin/trash?success=restored" {
+		t.Errorf("restore redirected to %q", resp.Header.Get("Location"))
+	}
+	if resp, _ := author.get("/post/a-haunting"); resp.StatusCode != http.StatusOK {
+		t.Errorf("restored post: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// Posts outside the trash can't be purged
+	if resp, _ := admin.submit("/post/create", "/admin/trash/purge", post); resp.Header.Get("Location") != "/admin/trash?error=missing" {
+		t.Errorf("purging an active post redirected to %q", resp.Header.Get("Location"))
+	}
+	author.submit("/post/a-haunting", "/post/delete", url.Values{"id": {"1"}})
+	if resp, _ := admin.submit("/admin/trash", "/admin/trash/purge", post); resp.Header.Get("Location") != "/admin/trash?success=purged" {
+		t.Errorf("purge redirected to %q", resp.Header.Get("Location"))
+	}
+	var posts int
+	site.DB.QueryRow("SELECT COUNT(*) FROM posts").Scan(&posts)
+	if posts != 0 {
+		t.Errorf("%d posts left after purging", posts)
+	}
+}
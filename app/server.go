@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"webapp/utils"
+)
+
+// Server returns an http.Server for Handler with the configured timeouts.
+func (a *App) Server() *http.Server {
+	return &http.Server{
+		Addr:              a.Config.Addr,
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: a.Config.Server.ReadHeaderTimeout,
+		ReadTimeout:       a.Config.Server.ReadTimeout,
+		WriteTimeout:      a.Config.Server.WriteTimeout,
+		IdleTimeout:       a.Config.Server.IdleTimeout,
+	}
+}
+
+// ListenAndServe listens on Config.Addr and calls Serve.
+func (a *App) ListenAndServe(ctx context.Context) error {
+	listener, err := net.Listen("tcp", a.Config.Addr)
+	if err != nil {
+		return err
+	}
+	return a.Serve(ctx, listener)
+}
+
+// Serve answers requests on listener until ctx is cancelled, then stops
+// accepting connections and gives in-flight requests up to ShutdownTimeout
+// to finish. With TLS configured it serves HTTPS, reloading the
+// certificate when its files change or the process receives SIGHUP.
+func (a *App) Serve(ctx context.Context, listener net.Listener) error {
+	server := a.Server()
+
+	if a.Config.Server.TLS() {
+		certs, err := newCertReloader(a.Config.Server.TLSCertFile, a.Config.Server.TLSKeyFile)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		listener = tls.NewListener(listener, server.TLSConfig)
+
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		defer signal.Stop(hangup)
+		go reloadOnHangup(ctx, hangup, certs)
+	}
+
+	return serve(ctx, server, listener, a.Config.Server.ShutdownTimeout)
+}
+
+// serve runs server on listener until ctx is done, then shuts it down
+func serve(ctx context.Context, server *http.Server, listener net.Listener, drain time.Duration) error {
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	utils.LogInfo(fmt.Sprintf("Shutting down, waiting up to %s for open requests", drain))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		server.Close()
+		return fmt.Errorf("draining connections: %w", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func reloadOnHangup(ctx context.Context, hangup <-chan os.Signal, certs *certReloader) {
+	for {
+		select {
+		case <-hangup:
+			if err := certs.Reload(); err != nil {
+				utils.LogError(fmt.Sprintf("Keeping the current TLS certificate: %v", err))
+			} else {
+				utils.LogInfo("Reloaded TLS certificate on SIGHUP")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
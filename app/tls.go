@@ -0,0 +1,97 @@
+package app
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"webapp/utils"
+)
+
+// certCheckInterval is how often handshakes look for a renewed certificate
+const certCheckInterval = time.Minute
+
+// certReloader serves a certificate pair from disk and picks up renewals,
+// such as certbot replacing the files, without a restart. A pair that
+// fails to load is logged and the previous one stays in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// newCertReloader loads the pair once so a bad path fails at startup.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the pair from disk now.
+func (c *certReloader) Reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+	c.mu.Unlock()
+	return nil
+}
+
+// latestModTime is when either file last changed
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate. At most once per
+// certCheckInterval it checks whether the files changed and reloads them.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	due := time.Since(c.checkedAt) >= certCheckInterval
+	if due {
+		c.checkedAt = time.Now()
+	}
+	cert, loadedModTime := c.cert, c.modTime
+	c.mu.Unlock()
+
+	if due {
+		if modTime, err := c.latestModTime(); err != nil {
+			utils.LogError(fmt.Sprintf("Checking TLS certificate: %v", err))
+		} else if modTime.After(loadedModTime) {
+			if err := c.Reload(); err != nil {
+				utils.LogError(fmt.Sprintf("Keeping the current TLS certificate: %v", err))
+			} else {
+				utils.LogInfo("Reloaded TLS certificate from " + c.certFile)
+				c.mu.Lock()
+				cert = c.cert
+				c.mu.Unlock()
+			}
+		}
+	}
+	return cert, nil
+}
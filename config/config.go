@@ -0,0 +1,445 @@
+// Package config loads the site's settings. Each value comes from the first
+// of these that sets it: a command-line flag, the environment, the config
+// file (KEY=VALUE lines, as in config.production.env), or the built-in
+// default. Load validates the result, and in production refuses to start
+// with missing secrets or the sample values shipped with the repo.
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"webapp/middleware"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+)
+
+// MaxPageSize caps POSTS_PER_PAGE so one request can't render the whole blog
+const MaxPageSize = 100
+
+// Config is everything the site needs to start.
+type Config struct {
+	// Env is development or production (APP_ENV)
+	Env string
+	// Addr is the listen address, ":" + APP_PORT unless APP_ADDR is set
+	Addr string
+	// BaseURL is the public URL used in emailed links (APP_URL). Without it
+	// links are built from the request's Host header.
+	BaseURL string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and
+	// X-Real-IP headers are believed (TRUSTED_PROXIES). Requests from
+	// anywhere else are identified by their connection address.
+	TrustedProxies []netip.Prefix
+
+	Server ServerConfig
+	DB     DBConfig
+
+	SessionSecret   string
+	SessionLifetime time.Duration
+	Password        middleware.PasswordConfig
+
+	InviteExpiry   time.Duration
+	MaxUploadSize  int64
+	TrashRetention time.Duration
+	// PageSize is how many posts the home page and profiles show at once
+	PageSize int
+
+	TemplateDir string
+	StaticDir   string
+	UploadDir   string
+	LogDir      string
+	// RedactFields are scrubbed from logs on top of the built-in list
+	RedactFields []string
+
+	SMTP SMTPConfig
+	// MailDir receives .eml files when SMTP is not configured
+	MailDir string
+}
+
+// ServerConfig tunes the HTTP server. With CertFile and KeyFile set it
+// serves HTTPS itself instead of relying on a proxy.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGTERM or SIGINT
+	ShutdownTimeout time.Duration
+
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// TLS reports whether the server should serve HTTPS itself.
+func (c ServerConfig) TLS() bool {
+	return c.TLSCertFile != ""
+}
+
+// DBConfig says which database to use. Path is for sqlite, the rest for mysql.
+type DBConfig struct {
+	Driver   string
+	Path     string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+}
+
+// Source returns what database.Open expects for the driver: a file path for
+// sqlite and a DSN for mysql. The mysql connection works in UTC both ways:
+// the driver sends and reads times as UTC, and the session time zone makes
+// NOW() UTC too, so expiry times written from Go compare correctly with it
+// whatever zone the server runs in.
+func (c DBConfig) Source() string {
+	if c.Driver == "sqlite" {
+		return c.Path
+	}
+	return c.User + ":" + c.Password + "@tcp(" + c.Host + ":" + c.Port + ")/" + c.Name +
+		"?parseTime=true&loc=UTC&time_zone=" + url.QueryEscape("'+00:00'")
+}
+
+// SMTPConfig is the outgoing mail server. Host is empty when mail should go
+// to MailDir instead.
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	From     string
+}
+
+// Defaults returns the settings used when nothing else is configured,
+// suitable for local development.
+func Defaults() *Config {
+	return &Config{
+		Env:  EnvDevelopment,
+		Addr: ":8080",
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			// Generous enough for a full-size upload on a slow connection
+			ReadTimeout:     60 * time.Second,
+			WriteTimeout:    90 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		DB: DBConfig{
+			Driver: "mysql",
+			Path:   "webapp.db",
+			Host:   "127.0.0.1",
+			Port:   "3306",
+			User:   "root",
+			Name:   "blogdb",
+		},
+		SessionLifetime: 24 * time.Hour,
+		Password: middleware.PasswordConfig{
+			Scheme:     middleware.SchemeBcrypt,
+			BcryptCost: middleware.DefaultBcryptCost,
+			Argon2:     middleware.DefaultArgon2Params,
+		},
+		InviteExpiry:   30 * 24 * time.Hour,
+		MaxUploadSize:  5 << 20, // 5 MB
+		TrashRetention: 30 * 24 * time.Hour,
+		PageSize:       10,
+		TemplateDir:    "templates",
+		StaticDir:      "static",
+		UploadDir:      "uploads",
+		LogDir:         "logs",
+		SMTP:           SMTPConfig{Port: "587"},
+		MailDir:        "mail",
+	}
+}
+
+// Load reads the configuration from args, the environment and the file
+// named by -config or CONFIG_FILE, then validates it. manage.go passes nil
+// args since its commands parse their own flags.
+func Load(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("webapp", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "read settings from this KEY=VALUE file")
+	env := flags.String("env", "", "development or production (APP_ENV)")
+	addr := flags.String("addr", "", "listen address, e.g. :8080 (APP_ADDR)")
+	dbDriver := flags.String("db-driver", "", "mysql or sqlite (DB_DRIVER)")
+	dbPath := flags.String("db-path", "", "SQLite database file (DB_PATH)")
+	tlsCert := flags.String("tls-cert", "", "serve HTTPS with this certificate (TLS_CERT_FILE)")
+	tlsKey := flags.String("tls-key", "", "private key for -tls-cert (TLS_KEY_FILE)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	values := source{}
+	if *configFile != "" {
+		file, err := readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		values.file = file
+	}
+
+	cfg, err := values.apply(Defaults())
+	if err != nil {
+		return nil, err
+	}
+
+	// Flags win over everything else
+	for target, value := range map[*string]string{
+		&cfg.Env: *env, &cfg.Addr: *addr, &cfg.DB.Driver: *dbDriver, &cfg.DB.Path: *dbPath,
+		&cfg.Server.TLSCertFile: *tlsCert, &cfg.Server.TLSKeyFile: *tlsKey,
+	} {
+		if value != "" {
+			*target = value
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// source looks a key up in the environment, then the config file.
+type source struct {
+	file map[string]string
+	errs []error
+}
+
+func (s *source) lookup(key string) (string, bool) {
+	if value := os.Getenv(key); value != "" {
+		return value, true
+	}
+	value, ok := s.file[key]
+	return value, ok && value != ""
+}
+
+func (s *source) str(target *string, key string) {
+	if value, ok := s.lookup(key); ok {
+		*target = value
+	}
+}
+
+// number parses key as an unsigned integer of the given bit size
+func (s *source) number(key string, bits int) (uint64, bool) {
+	raw, ok := s.lookup(key)
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(raw, 10, bits)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: %v", key, err))
+		return 0, false
+	}
+	return value, true
+}
+
+// days reads a whole number of days into a duration
+func (s *source) days(target *time.Duration, key string) {
+	if days, ok := s.number(key, 16); ok {
+		*target = time.Duration(days) * 24 * time.Hour
+	}
+}
+
+func (s *source) duration(target *time.Duration, key string) {
+	if raw, ok := s.lookup(key); ok {
+		value, err := time.ParseDuration(raw)
+		if err != nil {
+			s.errs = append(s.errs, fmt.Errorf("%s: %v", key, err))
+			return
+		}
+		*target = value
+	}
+}
+
+// prefix parses an address or CIDR range like 10.0.0.0/8 onto target
+func (s *source) prefix(target *[]netip.Prefix, key, value string) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		*target = append(*target, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+		return
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: %q is not an IP address or CIDR range", key, value))
+		return
+	}
+	*target = append(*target, prefix.Masked())
+}
+
+func (s *source) apply(cfg *Config) (*Config, error) {
+	s.str(&cfg.Env, "APP_ENV")
+	if port, ok := s.lookup("APP_PORT"); ok {
+		cfg.Addr = ":" + port
+	}
+	s.str(&cfg.Addr, "APP_ADDR")
+	s.str(&cfg.BaseURL, "APP_URL")
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if proxies, ok := s.lookup("TRUSTED_PROXIES"); ok {
+		for _, proxy := range strings.Split(proxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				s.prefix(&cfg.TrustedProxies, "TRUSTED_PROXIES", proxy)
+			}
+		}
+	}
+
+	s.duration(&cfg.Server.ReadHeaderTimeout, "READ_HEADER_TIMEOUT")
+	s.duration(&cfg.Server.ReadTimeout, "READ_TIMEOUT")
+	s.duration(&cfg.Server.WriteTimeout, "WRITE_TIMEOUT")
+	s.duration(&cfg.Server.IdleTimeout, "IDLE_TIMEOUT")
+	s.duration(&cfg.Server.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+	s.str(&cfg.Server.TLSCertFile, "TLS_CERT_FILE")
+	s.str(&cfg.Server.TLSKeyFile, "TLS_KEY_FILE")
+
+	s.str(&cfg.DB.Driver, "DB_DRIVER")
+	s.str(&cfg.DB.Path, "DB_PATH")
+	s.str(&cfg.DB.Host, "DB_HOST")
+	s.str(&cfg.DB.Port, "DB_PORT")
+	s.str(&cfg.DB.User, "DB_USER")
+	s.str(&cfg.DB.Password, "DB_PASSWORD")
+	s.str(&cfg.DB.Name, "DB_NAME")
+
+	s.str(&cfg.SessionSecret, "SESSION_SECRET")
+	s.duration(&cfg.SessionLifetime, "SESSION_LIFETIME")
+
+	s.str(&cfg.Password.Scheme, "PASSWORD_HASH")
+	cfg.Password.Scheme = strings.ToLower(cfg.Password.Scheme)
+	if cost, ok := s.number("BCRYPT_COST", 8); ok {
+		cfg.Password.BcryptCost = int(cost)
+	}
+	if value, ok := s.number("ARGON2_TIME", 32); ok {
+		cfg.Password.Argon2.Time = uint32(value)
+	}
+	if value, ok := s.number("ARGON2_MEMORY", 32); ok {
+		cfg.Password.Argon2.Memory = uint32(value)
+	}
+	if value, ok := s.number("ARGON2_THREADS", 8); ok {
+		cfg.Password.Argon2.Threads = uint8(value)
+	}
+
+	s.days(&cfg.InviteExpiry, "INVITE_EXPIRY_DAYS")
+	if megabytes, ok := s.number("MAX_UPLOAD_MB", 16); ok {
+		cfg.MaxUploadSize = int64(megabytes) << 20
+	}
+	s.days(&cfg.TrashRetention, "TRASH_RETENTION_DAYS")
+	if size, ok := s.number("POSTS_PER_PAGE", 16); ok {
+		cfg.PageSize = int(size)
+	}
+
+	s.str(&cfg.TemplateDir, "TEMPLATE_DIR")
+	s.str(&cfg.StaticDir, "STATIC_DIR")
+	s.str(&cfg.UploadDir, "UPLOAD_DIR")
+	s.str(&cfg.LogDir, "LOG_DIR")
+	if fields, ok := s.lookup("LOG_REDACT_FIELDS"); ok {
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				cfg.RedactFields = append(cfg.RedactFields, field)
+			}
+		}
+	}
+
+	s.str(&cfg.SMTP.Host, "SMTP_HOST")
+	s.str(&cfg.SMTP.Port, "SMTP_PORT")
+	s.str(&cfg.SMTP.User, "SMTP_USER")
+	s.str(&cfg.SMTP.Password, "SMTP_PASSWORD")
+	s.str(&cfg.SMTP.From, "SMTP_FROM")
+	if cfg.SMTP.From == "" && cfg.SMTP.Host != "" {
+		cfg.SMTP.From = "noreply@" + cfg.SMTP.Host
+	}
+	s.str(&cfg.MailDir, "MAIL_DIR")
+
+	return cfg, errors.Join(s.errs...)
+}
+
+// readFile parses KEY=VALUE lines. Blank lines and # comments are skipped
+// and values may be quoted.
+func readFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, number)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, scanner.Err()
+}
+
+// insecureValues are secrets that must never reach production: the sample
+// values in config.production.env and docker-compose.yml, and the password
+// this app used to fall back to.
+var insecureValues = map[string]bool{
+	"your_secure_password_here":                 true,
+	"your_very_long_random_session_secret_here": true,
+	"dandan1234": true,
+	"webapp123":  true,
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Env == EnvDevelopment || c.Env == EnvProduction, "APP_ENV must be %s or %s, not %q", EnvDevelopment, EnvProduction, c.Env)
+	check(c.Addr != "", "listen address is empty")
+	check(c.Server.ReadHeaderTimeout > 0 && c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0,
+		"READ_HEADER_TIMEOUT, READ_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT must be positive")
+	check(c.Server.ShutdownTimeout >= 0, "SHUTDOWN_TIMEOUT must not be negative")
+	check((c.Server.TLSCertFile == "") == (c.Server.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	switch c.DB.Driver {
+	case "sqlite":
+		check(c.DB.Path != "", "DB_PATH is required with DB_DRIVER=sqlite")
+	case "mysql":
+		check(c.DB.Host != "" && c.DB.Port != "" && c.DB.User != "" && c.DB.Name != "", "DB_HOST, DB_PORT, DB_USER and DB_NAME are required with DB_DRIVER=mysql")
+	default:
+		errs = append(errs, fmt.Errorf("DB_DRIVER must be mysql or sqlite, not %q", c.DB.Driver))
+	}
+	check(c.SessionSecret == "" || len(c.SessionSecret) >= middleware.MinSecretLength, "SESSION_SECRET must be at least %d characters", middleware.MinSecretLength)
+	check(c.SessionLifetime > 0, "SESSION_LIFETIME must be positive")
+	if err := c.Password.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("password hashing: %w", err))
+	}
+	check(c.InviteExpiry > 0, "INVITE_EXPIRY_DAYS must be at least 1")
+	check(c.MaxUploadSize > 0, "MAX_UPLOAD_MB must be at least 1")
+	check(c.TrashRetention > 0, "TRASH_RETENTION_DAYS must be at least 1")
+	check(c.PageSize >= 1 && c.PageSize <= MaxPageSize, "POSTS_PER_PAGE must be between 1 and %d", MaxPageSize)
+	check(c.TemplateDir != "" && c.StaticDir != "" && c.UploadDir != "", "TEMPLATE_DIR, STATIC_DIR and UPLOAD_DIR must not be empty")
+
+	if c.Env == EnvProduction {
+		check(c.SessionSecret != "", "SESSION_SECRET is required in production")
+		check(!insecureValues[c.SessionSecret], "SESSION_SECRET is still the sample value")
+		if c.DB.Driver == "mysql" {
+			check(c.DB.Password != "" && !insecureValues[c.DB.Password], "DB_PASSWORD must be set to a real password in production")
+			check(c.DB.User != "root", "DB_USER must not be root in production")
+		}
+		// Otherwise a forged Host header can point reset links elsewhere
+		check(strings.HasPrefix(c.BaseURL, "https://"), "APP_URL must be an https:// URL in production")
+		check(c.LogDir != "", "LOG_DIR must not be empty in production")
+	}
+	return errors.Join(errs...)
+}
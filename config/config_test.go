@@ -0,0 +1,123 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes a config file in the test's temp dir
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "webapp.env")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `
+# Comments and blank lines are skipped
+APP_PORT=9000
+DB_DRIVER=sqlite
+DB_PATH="from-file.db"
+INVITE_EXPIRY_DAYS=7
+TRUSTED_PROXIES=127.0.0.1, 10.1.2.3/8
+`)
+	t.Setenv("DB_PATH", "from-env.db")
+	t.Setenv("MAX_UPLOAD_MB", "2")
+
+	cfg, err := Load([]string{"-config", path, "-addr", ":7000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":7000" {
+		t.Errorf("Addr = %q, want the flag to win", cfg.Addr)
+	}
+	if cfg.DB.Driver != "sqlite" || cfg.DB.Path != "from-env.db" {
+		t.Errorf("DB = %+v, want the environment to win over the file", cfg.DB)
+	}
+	if cfg.InviteExpiry != 7*24*time.Hour || cfg.MaxUploadSize != 2<<20 {
+		t.Errorf("InviteExpiry = %v, MaxUploadSize = %d", cfg.InviteExpiry, cfg.MaxUploadSize)
+	}
+	if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[0].String() != "127.0.0.1/32" || cfg.TrustedProxies[1].String() != "10.0.0.0/8" {
+		t.Errorf("TrustedProxies = %v", cfg.TrustedProxies)
+	}
+	if cfg.SessionLifetime != 24*time.Hour || cfg.Env != EnvDevelopment {
+		t.Errorf("defaults not kept: %+v", cfg)
+	}
+}
+
+func TestLoadRejectsBadValues(t *testing.T) {
+	t.Setenv("BCRYPT_COST", "nope")
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "BCRYPT_COST") {
+		t.Errorf("non-numeric BCRYPT_COST: err = %v", err)
+	}
+
+	t.Setenv("BCRYPT_COST", "")
+	t.Setenv("POSTS_PER_PAGE", "5000")
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "POSTS_PER_PAGE") {
+		t.Errorf("oversized POSTS_PER_PAGE: err = %v", err)
+	}
+
+	t.Setenv("POSTS_PER_PAGE", "")
+	t.Setenv("DB_DRIVER", "postgres")
+	if _, err := Load(nil); err == nil {
+		t.Error("unknown DB_DRIVER was accepted")
+	}
+
+	t.Setenv("DB_DRIVER", "")
+	t.Setenv("TRUSTED_PROXIES", "127.0.0.1, localhost")
+	if _, err := Load(nil); err == nil || !strings.Contains(err.Error(), "TRUSTED_PROXIES") {
+		t.Errorf("hostname in TRUSTED_PROXIES: err = %v", err)
+	}
+
+	if _, err := Load([]string{"-config", writeFile(t, "APP_PORT 8080\n")}); err == nil {
+		t.Error("malformed config file was accepted")
+	}
+}
+
+func TestProductionGuards(t *testing.T) {
+	cfg := Defaults()
+	cfg.Env = EnvProduction
+	cfg.SessionSecret = "your_very_long_random_session_secret_here"
+	cfg.DB.Password = "dandan1234"
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("production accepted the sample secrets")
+	}
+	for _, want := range []string{"SESSION_SECRET", "DB_PASSWORD", "DB_USER", "APP_URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %s: %v", want, err)
+		}
+	}
+
+	cfg.SessionSecret = strings.Repeat("s", 40)
+	cfg.DB.User = "webapp"
+	cfg.DB.Password = "a-real-password"
+	cfg.BaseURL = "https://blog.example.com"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("valid production config rejected: %v", err)
+	}
+
+	// Development keeps working with the defaults
+	if err := Defaults().Validate(); err != nil {
+		t.Errorf("defaults rejected: %v", err)
+	}
+}
+
+func TestSourceUsesUTC(t *testing.T) {
+	db := DBConfig{Driver: "mysql", User: "blog", Password: "secret", Host: "localhost", Port: "3306", Name: "blog"}
+	want := "blog:secret@tcp(localhost:3306)/blog?parseTime=true&loc=UTC&time_zone=%27%2B00%3A00%27"
+	if got := db.Source(); got != want {
+		t.Errorf("Source() = %q, want %q", got, want)
+	}
+
+	db = DBConfig{Driver: "sqlite", Path: "blog.db"}
+	if got := db.Source(); got != "blog.db" {
+		t.Errorf("sqlite Source() = %q, want the path", got)
+	}
+}
@@ -0,0 +1,45 @@
+package database
+
+// Audit actions, grouped by the kind of thing they act on
+const (
+	AuditLoginSuccess = "login.success"
+	AuditLoginFailure = "login.failure"
+	AuditLogout       = "logout"
+	AuditSignup       = "signup"
+
+	AuditPasswordChange = "account.password_change"
+	AuditPasswordReset  = "account.password_reset"
+	AuditEmailChange    = "account.email_change"
+	AuditTwoFactorOn    = "account.2fa_enable"
+	AuditTwoFactorOff   = "account.2fa_disable"
+	AuditProfileUpdate  = "profile.update"
+	AuditProfileImage   = "profile.image_delete"
+
+	AuditPostUpdate  = "post.update"
+	AuditPostDelete  = "post.delete"
+	AuditPostRestore = "post.restore"
+	AuditPostPurge   = "post.purge"
+	AuditTrashPurge  = "trash.purge"
+
+	AuditCommentDelete = "comment.delete"
+	AuditCommentHide   = "comment.hide"
+	AuditCommentShow   = "comment.show"
+
+	AuditTagRename = "tag.rename"
+	AuditTagMerge  = "tag.merge"
+
+	AuditInviteCreate   = "invite.create"
+	AuditUsersClean     = "users.clean"
+	AuditUserSuspend    = "user.suspend"
+	AuditUserReactivate = "user.reactivate"
+	AuditUserForceReset = "user.force_password_reset"
+	AuditUserDelete     = "user.delete"
+	AuditUserRestore    = "user.restore"
+	AuditUserPurge      = "user.purge"
+	AuditUserCreate     = "user.create"
+	AuditRoleGrant      = "role.grant"
+	AuditRoleRevoke     = "role.revoke"
+	AuditAccountUnlock  = "account.unlock"
+	AuditSettingUpdate  = "setting.update"
+	AuditSchemaMigrate  = "schema.migrate"
+)
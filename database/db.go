@@ -2,172 +2,47 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
-	"os"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 var DB *sql.DB
 
-func InitDB() {
-	// Get database configuration from environment variables
-	dbHost := getEnv("DB_HOST", "127.0.0.1")
-	dbPort := getEnv("DB_PORT", "3306")
-	dbUser := getEnv("DB_USER", "root")
-	dbPassword := getEnv("DB_PASSWORD", "dandan1234")
-	dbName := getEnv("DB_NAME", "blogdb")
-
-	// For Docker, we don't need to create database as it's already created
-	// Just connect directly to the database
-	dsn := dbUser + ":" + dbPassword + "@tcp(" + dbHost + ":" + dbPort + ")/" + dbName + "?parseTime=true"
-
-	var err error
-	DB, err = sql.Open("mysql", dsn)
+// Setup applies pending migrations and makes sure the built-in roles exist.
+func Setup() error {
+	applied, err := MigrateUp(0)
 	if err != nil {
-		log.Fatal("Error connecting to database", err)
-	}
-
-	if err = DB.Ping(); err != nil {
-		log.Fatal("Error pinging database", err)
+		return fmt.Errorf("applying migrations: %w", err)
 	}
-
-	log.Println("Database connected successfully")
-	createTables()
-}
-
-// Helper function to get environment variables with default values
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+	if len(applied) > 0 {
+		log.Printf("Applied %d migrations", len(applied))
 	}
-	return defaultValue
+	return seedRoles()
 }
 
-func createTables() {
-	usersTable := `CREATE TABLE IF NOT EXISTS users (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		username VARCHAR(50) UNIQUE NOT NULL,
-		email VARCHAR(100) UNIQUE NOT NULL,
-		password VARCHAR(255) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`
-
-	postsTable := `CREATE TABLE IF NOT EXISTS posts (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		title VARCHAR(200) NOT NULL,
-		content TEXT NOT NULL,
-		author_id INT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-		FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE)`
-
-	_, err := DB.Exec(usersTable)
-	if err != nil {
-		log.Fatal("Error creating users table", err)
+// Open connects to a database and makes it the one this package uses.
+// source is a file path for sqlite and a DSN for mysql.
+func Open(driver, source string) (*sql.DB, error) {
+	dialect, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unknown database driver %q: use mysql or sqlite", driver)
 	}
-	log.Println("Users table created")
-
-	_, err = DB.Exec(postsTable)
-	if err != nil {
-		log.Fatal("Error creating posts table", err)
-	}
-	log.Println("Posts table created")
-	createProfileTables()
-	createIndexes()
-}
-
-func createProfileTables() {
-	// Add profile fields to existing users table
-	// Check if columns exist before adding them
-	columns := []string{"bio", "profile_image", "location", "website", "updated_at"}
-
-	for _, column := range columns {
-		var exists int
-		err := DB.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = ?", column).Scan(&exists)
-
-		if err != nil {
-			log.Printf("Warning: Could not check column %s: %v", column, err)
-			continue
-		}
-
-		if exists == 0 {
-			var query string
-			switch column {
-			case "bio":
-				query = "ALTER TABLE users ADD COLUMN bio TEXT"
-			case "profile_image":
-				query = "ALTER TABLE users ADD COLUMN profile_image VARCHAR(255)"
-			case "location":
-				query = "ALTER TABLE users ADD COLUMN location VARCHAR(100)"
-			case "website":
-				query = "ALTER TABLE users ADD COLUMN website VARCHAR(255)"
-			case "updated_at":
-				query = "ALTER TABLE users ADD COLUMN updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP"
-			}
-
-			_, err = DB.Exec(query)
-			if err != nil {
-				log.Printf("Warning: Could not add column %s: %v", column, err)
-			} else {
-				log.Printf("Column %s added successfully!", column)
-			}
-		}
+	if driver == "sqlite" {
+		source = sqliteDSN(source)
 	}
 
-	// Create profile_images table
-	profileImagesTable := `CREATE TABLE IF NOT EXISTS profile_images (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		user_id INT NOT NULL,
-		filename VARCHAR(255) NOT NULL,
-		original_name VARCHAR(255) NOT NULL,
-		file_path VARCHAR(500) NOT NULL,
-		file_size INT NOT NULL,
-		mime_type VARCHAR(100) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-	)`
-
-	_, err := DB.Exec(profileImagesTable)
+	db, err := sql.Open(dialect.DriverName(), source)
 	if err != nil {
-		log.Fatal("Error creating profile_images table:", err)
+		return nil, err
 	}
-
-	log.Println("Profile tables created successfully!")
-}
-
-func createIndexes() {
-	// Check and create indexes - MySQL doesn't support IF NOT EXISTS for indexes
-	// So we try to create and ignore if it already exists
-	indexes := map[string]string{
-		"idx_posts_author":  "CREATE INDEX idx_posts_author ON posts(author_id)",
-		"idx_posts_created": "CREATE INDEX idx_posts_created ON posts(created_at)",
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	for indexName, indexQuery := range indexes {
-		// Check if index exists
-		var exists int
-		err := DB.QueryRow("SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = 'blogdb' AND table_name = 'posts' AND index_name = ?", indexName).Scan(&exists)
-
-		if err != nil {
-			log.Printf("Warning: Could not check index %s: %v", indexName, err)
-			continue
-		}
-
-		// Create index only if it doesn't exist
-		if exists == 0 {
-			_, err = DB.Exec(indexQuery)
-			if err != nil {
-				log.Printf("Warning: Could not create index %s: %v", indexName, err)
-			} else {
-				log.Printf("Index %s created successfully!", indexName)
-
-				// note for myself: Using log.Printf instead of log.Fatal for index creation
-				// if index fails to create, app can still work (just slower queries)
-				// log.Fatal would crash the entire app, but we want graceful degradation
-
-			}
-		}
-	}
-	log.Println("Indexes created")
+	DB = db
+	DBDialect = dialect
+	return db, nil
 }
@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect covers the SQL that differs between the supported databases.
+// Queries elsewhere stick to SQL both understand and ask the dialect for the
+// rest. NOW() works on both: SQLite gets it as an application function.
+type Dialect interface {
+	// Name is the DB_DRIVER value and the migrations subdirectory
+	Name() string
+	// DriverName is the database/sql driver to open
+	DriverName() string
+	// InsertIgnore starts an INSERT that skips rows violating a unique key
+	InsertIgnore() string
+	// OnConflictUpdate ends an INSERT so that a row clashing on key is
+	// updated with assignments instead
+	OnConflictUpdate(key, assignments string) string
+	// Excluded refers to the value an upsert tried to insert into column
+	Excluded(column string) string
+	// ForUpdate ends a SELECT that locks the rows it reads
+	ForUpdate() string
+	// IsDuplicateKey reports whether err is a unique key violation
+	IsDuplicateKey(err error) bool
+	// TableExists and ColumnExists inspect the current schema
+	TableExists(table string) (bool, error)
+	ColumnExists(table, column string) (bool, error)
+	// lock holds a named lock on conn until release is called
+	lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (release func(), err error)
+}
+
+// DBDialect is the dialect of DB, set by Open.
+var DBDialect Dialect = mysqlDialect{}
+
+var dialects = map[string]Dialect{
+	"mysql":  mysqlDialect{},
+	"sqlite": sqliteDialect{},
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string         { return "mysql" }
+func (mysqlDialect) DriverName() string   { return "mysql" }
+func (mysqlDialect) InsertIgnore() string { return "INSERT IGNORE" }
+func (mysqlDialect) ForUpdate() string    { return "FOR UPDATE" }
+
+func (mysqlDialect) OnConflictUpdate(key, assignments string) string {
+	return "ON DUPLICATE KEY UPDATE " + assignments
+}
+
+func (mysqlDialect) Excluded(column string) string {
+	return "VALUES(" + column + ")"
+}
+
+// erDupEntry is MySQL's ER_DUP_ENTRY
+const erDupEntry = 1062
+
+func (mysqlDialect) IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == erDupEntry
+}
+
+func (mysqlDialect) TableExists(table string) (bool, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+func (mysqlDialect) ColumnExists(table, column string) (bool, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+// MySQL named locks belong to a connection, so conn must stay open until
+// release is called.
+func (mysqlDialect) lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+	var acquired sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout.Seconds())).Scan(&acquired)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		return nil, ErrMigrationLocked
+	}
+	return func() {
+		conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", name).Scan(&acquired)
+	}, nil
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string         { return "sqlite" }
+func (sqliteDialect) DriverName() string   { return "sqlite" }
+func (sqliteDialect) InsertIgnore() string { return "INSERT OR IGNORE" }
+
+// SQLite locks the whole database for a write transaction, and connections
+// begin transactions with _txlock=immediate, so there is nothing to add.
+func (sqliteDialect) ForUpdate() string { return "" }
+
+func (sqliteDialect) OnConflictUpdate(key, assignments string) string {
+	return "ON CONFLICT(" + key + ") DO UPDATE SET " + assignments
+}
+
+func (sqliteDialect) Excluded(column string) string {
+	return "excluded." + column
+}
+
+func (sqliteDialect) IsDuplicateKey(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func (sqliteDialect) TableExists(table string) (bool, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+func (sqliteDialect) ColumnExists(table, column string) (bool, error) {
+	var count int
+	err := DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+// An SQLite database is a local file used by one server, and each migration
+// runs in an immediate transaction, so no separate lock is needed.
+func (sqliteDialect) lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) (func(), error) {
+	return func() {}, nil
+}
+
+// sqliteDSN opens path with foreign keys on, times stored as Unix
+// milliseconds so they compare correctly, and write transactions that take
+// their lock up front instead of failing halfway with SQLITE_BUSY.
+func sqliteDSN(path string) string {
+	return fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"+
+		"&_time_integer_format=unix_milli&_inttotime=true&_txlock=immediate", path)
+}
+
+func init() {
+	// NOW() returns the time in the same format times are stored in
+	sqlite.MustRegisterScalarFunction("now", 0, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		return time.Now().UnixMilli(), nil
+	})
+}
@@ -0,0 +1,411 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema changes live in migrations/<dialect>/ as numbered pairs of files:
+// 0001_initial_schema.up.sql and 0001_initial_schema.down.sql. Every dialect
+// has the same versions. Applied versions are recorded in schema_migrations
+// with a checksum of the up script, so an edited migration is caught
+// instead of silently skipped.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// legacyMigrations are the migrations the release before migrations
+// already made, each with a table it creates. Its createTables code made
+// the users, posts and profile tables and init.sql the invitation codes;
+// everything else is new to such a database and runs as usual.
+var legacyMigrations = map[int]string{
+	1: "users",
+	3: "profile_images",
+}
+
+// migrationLockName is the named lock held while migrations run, so two
+// servers starting together don't both apply the same migration.
+const migrationLockName = "webapp_schema_migrations"
+
+// MigrationLockTimeout is how long to wait for another runner to finish.
+var MigrationLockTimeout = 60 * time.Second
+
+var (
+	// ErrMigrationLocked is returned when another process holds the
+	// migration lock for longer than MigrationLockTimeout.
+	ErrMigrationLocked = errors.New("another process is running migrations")
+
+	// ErrChecksumMismatch is returned when an applied migration's file has
+	// been changed since it was applied.
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+)
+
+// Migration is one numbered schema change.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// MigrationStatus describes one migration known to the files, the database,
+// or both.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	// Modified means the file changed after the migration was applied
+	Modified bool
+	// Missing means the database has a version with no matching file
+	Missing bool
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// LoadMigrations reads the embedded migration files for the current
+// dialect, sorted by version.
+func LoadMigrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations/"+DBDialect.Name())
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		number, label, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !found || err != nil || version < 1 {
+			return nil, fmt.Errorf("migration file %s: name must look like 0001_description.%s.sql", name, direction)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: label}
+			byVersion[version] = migration
+		} else if migration.Name != label {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, label)
+		}
+		if direction == "up" {
+			migration.Up = string(content)
+			sum := sha256.Sum256(content)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up script", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements breaks a migration script into statements. Statements end
+// with a semicolon at the end of a line, except triggers, which end at a line
+// reading END; lines starting with -- are comments.
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		inTrigger := strings.HasPrefix(strings.ToUpper(strings.TrimSpace(current.String())), "CREATE TRIGGER")
+		if inTrigger && strings.EqualFold(trimmed, "END;") || !inTrigger && strings.HasSuffix(trimmed, ";") {
+			statement := strings.TrimSuffix(strings.TrimSpace(current.String()), ";")
+			statements = append(statements, statement)
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+func createMigrationsTable() error {
+	_, err := DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INT PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	return err
+}
+
+func appliedMigrations() (map[int]appliedMigration, error) {
+	rows, err := DB.Query("SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]appliedMigration)
+	for rows.Next() {
+		var row appliedMigration
+		if err := rows.Scan(&row.Version, &row.Name, &row.Checksum, &row.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[row.Version] = row
+	}
+	return applied, rows.Err()
+}
+
+// withMigrationLock runs fn while holding the migration lock on a
+// connection pinned until fn returns.
+func withMigrationLock(fn func() error) error {
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	release, err := DBDialect.lock(ctx, conn, migrationLockName, MigrationLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := createMigrationsTable(); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	return fn()
+}
+
+// verifyChecksums fails if an applied migration's file has changed.
+func verifyChecksums(migrations []Migration, applied map[int]appliedMigration) error {
+	for _, migration := range migrations {
+		row, ok := applied[migration.Version]
+		if ok && row.Checksum != migration.Checksum {
+			return fmt.Errorf("%w: %04d_%s", ErrChecksumMismatch, migration.Version, migration.Name)
+		}
+	}
+	return nil
+}
+
+// adoptLegacySchema marks the migrations a database set up before
+// migrations existed already has as applied, so they aren't run twice.
+func adoptLegacySchema(migrations []Migration, applied map[int]appliedMigration) error {
+	if len(applied) > 0 {
+		return nil
+	}
+
+	exists, err := DBDialect.TableExists("users")
+	if err != nil || !exists {
+		return err
+	}
+
+	for _, migration := range migrations {
+		table, ok := legacyMigrations[migration.Version]
+		if !ok {
+			continue
+		}
+		exists, err := DBDialect.TableExists(table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		now := time.Now()
+		if _, err := DB.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+			migration.Version, migration.Name, migration.Checksum, now); err != nil {
+			return err
+		}
+		applied[migration.Version] = appliedMigration{Version: migration.Version, Name: migration.Name, Checksum: migration.Checksum, AppliedAt: now}
+		log.Printf("Existing database already has migration %04d_%s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// runMigration executes one script and records the result in the same
+// transaction. MySQL commits schema changes immediately, so a migration that
+// fails halfway may leave changes behind that need fixing by hand.
+func runMigration(migration Migration, up bool) error {
+	script := migration.Up
+	if !up {
+		script = migration.Down
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("%04d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)",
+			migration.Version, migration.Name, migration.Checksum, time.Now())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MigrateUp applies up to limit pending migrations in order, or all of them
+// if limit is 0, and returns the ones it applied.
+func MigrateUp(limit int) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(func() error {
+		applied, err := appliedMigrations()
+		if err != nil {
+			return err
+		}
+		if err := adoptLegacySchema(migrations, applied); err != nil {
+			return err
+		}
+		if err := verifyChecksums(migrations, applied); err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if limit > 0 && len(done) >= limit {
+				break
+			}
+			if err := runMigration(migration, true); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns the ones it reverted.
+func MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	err = withMigrationLock(func() error {
+		applied, err := appliedMigrations()
+		if err != nil {
+			return err
+		}
+		if err := verifyChecksums(migrations, applied); err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if strings.TrimSpace(migration.Down) == "" {
+				return fmt.Errorf("migration %04d_%s has no down script", migration.Version, migration.Name)
+			}
+			if err := runMigration(migration, false); err != nil {
+				return err
+			}
+			log.Printf("Reverted migration %04d_%s", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrationStatuses lists every migration with whether it has been applied.
+func MigrationStatuses() ([]MigrationStatus, error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := createMigrationsTable(); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = row.AppliedAt
+			status.Modified = row.Checksum != migration.Checksum
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Version: row.Version, Name: row.Name, Applied: true, AppliedAt: row.AppliedAt, Missing: true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
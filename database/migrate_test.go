@@ -0,0 +1,248 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// useTempSQLite points the package at a fresh SQLite file for one test
+func useTempSQLite(t *testing.T) {
+	t.Helper()
+	if _, err := Open("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		DB.Close()
+		DBDialect = mysqlDialect{}
+	})
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- comment
+CREATE TABLE a (
+    id INTEGER
+);
+CREATE TRIGGER t AFTER UPDATE ON a
+BEGIN
+    UPDATE a SET id = 1;
+END;
+DROP TABLE b`
+
+	statements := splitStatements(script)
+	if len(statements) != 3 {
+		t.Fatalf("got %d statements, want 3: %q", len(statements), statements)
+	}
+	if statements[2] != "DROP TABLE b" {
+		t.Errorf("last statement = %q", statements[2])
+	}
+}
+
+func TestLoadMigrationsRejectsBadNames(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_ok.up.sql":  {Data: []byte("SELECT 1;")},
+		"m/oops.up.sql":     {Data: []byte("SELECT 1;")},
+		"m/0002_x.down.sql": {Data: []byte("SELECT 1;")},
+	}
+	if _, err := loadMigrations(fsys, "m"); err == nil {
+		t.Fatal("expected an error for a badly named file")
+	}
+}
+
+func TestMigrationsHaveTheSameVersionsInEveryDialect(t *testing.T) {
+	var want []Migration
+	for name := range dialects {
+		migrations, err := loadMigrations(migrationFiles, "migrations/"+name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, migration := range migrations {
+			if migration.Down == "" {
+				t.Errorf("%s: %04d_%s has no down script", name, migration.Version, migration.Name)
+			}
+		}
+		if want == nil {
+			want = migrations
+			continue
+		}
+		if len(migrations) != len(want) {
+			t.Fatalf("%s has %d migrations, want %d", name, len(migrations), len(want))
+		}
+		for i := range migrations {
+			if migrations[i].Version != want[i].Version || migrations[i].Name != want[i].Name {
+				t.Errorf("%s: migration %d is %04d_%s, want %04d_%s", name, i,
+					migrations[i].Version, migrations[i].Name, want[i].Version, want[i].Name)
+			}
+		}
+	}
+}
+
+func TestMigrateUpDownStatus(t *testing.T) {
+	useTempSQLite(t)
+
+	all, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := MigrateUp(0)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if len(applied) != len(all) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(all))
+	}
+
+	// Running again is a no-op
+	applied, err = MigrateUp(0)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("second MigrateUp applied %d, err %v", len(applied), err)
+	}
+
+	reverted, err := MigrateDown(2)
+	if err != nil {
+		t.Fatalf("MigrateDown: %v", err)
+	}
+	if len(reverted) != 2 || reverted[0].Version != all[len(all)-1].Version {
+		t.Fatalf("reverted %+v, want the last two migrations newest first", reverted)
+	}
+
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		}
+	}
+	if pending != 2 {
+		t.Errorf("%d pending migrations, want 2", pending)
+	}
+
+	// Everything can be reverted and applied again from scratch
+	if _, err := MigrateDown(len(all)); err != nil {
+		t.Fatalf("MigrateDown all: %v", err)
+	}
+	if applied, err := MigrateUp(0); err != nil || len(applied) != len(all) {
+		t.Fatalf("MigrateUp after full revert applied %d, err %v", len(applied), err)
+	}
+}
+
+func TestMigrateUpRejectsModifiedMigration(t *testing.T) {
+	useTempSQLite(t)
+
+	if _, err := MigrateUp(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := MigrateUp(0)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("MigrateUp error = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+// legacySchema is what the release before migrations left behind: the
+// tables from createTables, createProfileTables and init.sql, in SQLite
+// syntax
+const legacySchema = `
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username VARCHAR(50) UNIQUE NOT NULL,
+    email VARCHAR(100) UNIQUE NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    invitation_code VARCHAR(50) NULL,
+    invited_by INT NULL REFERENCES users(id) ON DELETE SET NULL,
+    is_admin BOOLEAN DEFAULT FALSE,
+    bio TEXT,
+    profile_image VARCHAR(255),
+    location VARCHAR(100),
+    website VARCHAR(255),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE posts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    title VARCHAR(200) NOT NULL,
+    content TEXT NOT NULL,
+    author_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_posts_author ON posts(author_id);
+CREATE INDEX idx_posts_created ON posts(created_at);
+CREATE TABLE profile_images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    original_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(500) NOT NULL,
+    file_size INT NOT NULL,
+    mime_type VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE invitation_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code VARCHAR(50) UNIQUE NOT NULL,
+    created_by INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    used_by INT NULL REFERENCES users(id) ON DELETE SET NULL,
+    is_used BOOLEAN DEFAULT FALSE,
+    expires_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    used_at TIMESTAMP NULL
+);
+INSERT INTO users (username, email, password, is_admin) VALUES ('admin', 'admin@example.com', 'hash', TRUE);
+INSERT INTO posts (title, content, author_id) VALUES ('Boo', 'Boo', 1);
+`
+
+func TestMigrateUpAdoptsLegacySchema(t *testing.T) {
+	useTempSQLite(t)
+	for _, statement := range splitStatements(legacySchema) {
+		if _, err := DB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := MigrateUp(0)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	// Everything but the initial schema and the profiles ran
+	if len(applied) != len(all)-2 {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(all)-2)
+	}
+	for _, migration := range applied {
+		if migration.Version == 1 || migration.Version == 3 {
+			t.Errorf("migration %04d_%s ran on a database that already had it", migration.Version, migration.Name)
+		}
+	}
+
+	statuses, err := MigrationStatuses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.Modified || status.Missing {
+			t.Errorf("migration %04d_%s: %+v", status.Version, status.Name, status)
+		}
+	}
+
+	// The old is_admin flag became the admin role and the data survived
+	var role string
+	if err := DB.QueryRow("SELECT r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id WHERE ur.user_id = 1").Scan(&role); err != nil || role != RoleAdmin {
+		t.Errorf("role of the old admin = %q, %v", role, err)
+	}
+	var posts int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM posts WHERE deleted_at IS NULL").Scan(&posts); err != nil || posts != 1 {
+		t.Errorf("%d posts after migrating, err %v", posts, err)
+	}
+}
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS profile_images;
+
+ALTER TABLE users
+    DROP COLUMN bio,
+    DROP COLUMN profile_image,
+    DROP COLUMN location,
+    DROP COLUMN website,
+    DROP COLUMN updated_at;
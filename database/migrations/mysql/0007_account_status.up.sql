@@ -0,0 +1,4 @@
+-- Admins can suspend accounts or force a password reset
+ALTER TABLE users
+    ADD COLUMN suspended_at DATETIME NULL,
+    ADD COLUMN password_reset_required BOOLEAN DEFAULT FALSE;
@@ -0,0 +1,11 @@
+-- Rows still in the trash are deleted for good
+DELETE FROM posts WHERE deleted_at IS NOT NULL;
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE posts
+    DROP INDEX idx_posts_deleted,
+    DROP COLUMN deleted_at;
+
+ALTER TABLE users
+    DROP INDEX idx_users_deleted,
+    DROP COLUMN deleted_at;
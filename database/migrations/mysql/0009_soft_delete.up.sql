@@ -0,0 +1,8 @@
+-- Deleting a user or post sets deleted_at instead of removing the row
+ALTER TABLE users
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD INDEX idx_users_deleted (deleted_at);
+
+ALTER TABLE posts
+    ADD COLUMN deleted_at DATETIME NULL,
+    ADD INDEX idx_posts_deleted (deleted_at);
@@ -0,0 +1,14 @@
+-- Posts are addressed by a slug made from the title. Slugs a post had
+-- before its title was edited are kept in post_slug_redirects so old links
+-- still work. Existing posts are given a slug when the server starts.
+ALTER TABLE posts
+    ADD COLUMN slug VARCHAR(100) NULL,
+    ADD UNIQUE INDEX idx_posts_slug (slug);
+
+CREATE TABLE IF NOT EXISTS post_slug_redirects (
+    slug VARCHAR(100) PRIMARY KEY,
+    post_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_post_slug_redirects_post (post_id),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
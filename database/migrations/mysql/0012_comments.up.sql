@@ -0,0 +1,21 @@
+-- Comments on posts. A reply points at its parent comment. Deleted and
+-- hidden comments keep their row, so the replies under them stay in place.
+CREATE TABLE IF NOT EXISTS comments (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    post_id INT NOT NULL,
+    parent_id INT NULL,
+    author_id INT NOT NULL,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    edited_at DATETIME NULL,
+    deleted_at DATETIME NULL,
+    -- Set by a moderator; hidden comments are shown as removed
+    hidden_at DATETIME NULL,
+    hidden_by INT NULL,
+    INDEX idx_comments_post (post_id, created_at),
+    INDEX idx_comments_created (created_at),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (parent_id) REFERENCES comments(id) ON DELETE SET NULL,
+    FOREIGN KEY (author_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (hidden_by) REFERENCES users(id) ON DELETE SET NULL
+);
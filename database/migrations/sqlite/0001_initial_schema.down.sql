@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS invitation_codes;
+DROP TRIGGER IF EXISTS posts_updated_at;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,18 @@
+-- Sessions live in the database so restarts don't log everyone out
+CREATE TABLE IF NOT EXISTS sessions (
+    token VARCHAR(255) PRIMARY KEY,
+    user_id VARCHAR(20) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+
+CREATE INDEX idx_sessions_expires ON sessions(expires_at);
+
+-- Consecutive failed logins per username, used for progressive lockout
+CREATE TABLE IF NOT EXISTS failed_logins (
+    username VARCHAR(50) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_ip VARCHAR(45),
+    last_failed_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    locked_until DATETIME NULL
+);
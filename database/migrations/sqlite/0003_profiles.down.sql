@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS profile_images;
+DROP TRIGGER IF EXISTS users_updated_at;
+DROP TRIGGER IF EXISTS users_created_at;
+
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN profile_image;
+ALTER TABLE users DROP COLUMN location;
+ALTER TABLE users DROP COLUMN website;
+ALTER TABLE users DROP COLUMN updated_at;
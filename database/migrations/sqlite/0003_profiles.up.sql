@@ -0,0 +1,31 @@
+ALTER TABLE users ADD COLUMN bio TEXT;
+ALTER TABLE users ADD COLUMN profile_image VARCHAR(255);
+ALTER TABLE users ADD COLUMN location VARCHAR(100);
+ALTER TABLE users ADD COLUMN website VARCHAR(255);
+-- SQLite can't add a column with a non-constant default, so triggers fill
+-- it in on insert and on every change instead
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMP NULL;
+UPDATE users SET updated_at = created_at;
+
+CREATE TRIGGER users_created_at AFTER INSERT ON users
+WHEN NEW.updated_at IS NULL
+BEGIN
+    UPDATE users SET updated_at = NEW.created_at WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER users_updated_at AFTER UPDATE ON users
+WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE users SET updated_at = CAST(unixepoch('subsec') * 1000 AS INTEGER) WHERE id = NEW.id;
+END;
+
+CREATE TABLE IF NOT EXISTS profile_images (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    filename VARCHAR(255) NOT NULL,
+    original_name VARCHAR(255) NOT NULL,
+    file_path VARCHAR(500) NOT NULL,
+    file_size INTEGER NOT NULL,
+    mime_type VARCHAR(100) NOT NULL,
+    created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
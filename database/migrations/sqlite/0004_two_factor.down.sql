@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS settings_updated_at;
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS recovery_codes;
+
+ALTER TABLE users DROP COLUMN totp_secret;
+ALTER TABLE users DROP COLUMN totp_enabled;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS email_change_tokens;
+DROP TABLE IF EXISTS password_reset_tokens;
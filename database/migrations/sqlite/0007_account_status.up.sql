@@ -0,0 +1,3 @@
+-- Admins can suspend accounts or force a password reset
+ALTER TABLE users ADD COLUMN suspended_at DATETIME NULL;
+ALTER TABLE users ADD COLUMN password_reset_required BOOLEAN DEFAULT FALSE;
@@ -0,0 +1,18 @@
+-- Actors aren't foreign keys, so history survives deleted accounts
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    actor_id INTEGER NULL,
+    actor_name VARCHAR(50) NOT NULL DEFAULT '',
+    action VARCHAR(50) NOT NULL,
+    target_type VARCHAR(30) NOT NULL DEFAULT '',
+    target_id VARCHAR(50) NOT NULL DEFAULT '',
+    ip VARCHAR(45) NOT NULL DEFAULT '',
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    metadata TEXT NULL,
+    created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+
+CREATE INDEX idx_audit_created ON audit_events(created_at);
+CREATE INDEX idx_audit_action ON audit_events(action);
+CREATE INDEX idx_audit_actor ON audit_events(actor_name);
+CREATE INDEX idx_audit_target ON audit_events(target_type, target_id);
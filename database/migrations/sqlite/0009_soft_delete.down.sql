@@ -0,0 +1,9 @@
+-- Rows still in the trash are deleted for good
+DELETE FROM posts WHERE deleted_at IS NOT NULL;
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_posts_deleted;
+ALTER TABLE posts DROP COLUMN deleted_at;
+
+DROP INDEX IF EXISTS idx_users_deleted;
+ALTER TABLE users DROP COLUMN deleted_at;
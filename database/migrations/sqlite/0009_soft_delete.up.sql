@@ -0,0 +1,6 @@
+-- Deleting a user or post sets deleted_at instead of removing the row
+ALTER TABLE users ADD COLUMN deleted_at DATETIME NULL;
+CREATE INDEX idx_users_deleted ON users(deleted_at);
+
+ALTER TABLE posts ADD COLUMN deleted_at DATETIME NULL;
+CREATE INDEX idx_posts_deleted ON posts(deleted_at);
@@ -0,0 +1,2 @@
+-- Each edit bumps revision so rendered Markdown can be cached per revision
+ALTER TABLE posts ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;
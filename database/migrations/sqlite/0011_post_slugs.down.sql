@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS post_slug_redirects;
+DROP INDEX IF EXISTS idx_posts_slug;
+ALTER TABLE posts DROP COLUMN slug;
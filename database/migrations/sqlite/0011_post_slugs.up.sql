@@ -0,0 +1,12 @@
+-- Posts are addressed by a slug made from the title. Slugs a post had
+-- before its title was edited are kept in post_slug_redirects so old links
+-- still work. Existing posts are given a slug when the server starts.
+ALTER TABLE posts ADD COLUMN slug VARCHAR(100) NULL;
+CREATE UNIQUE INDEX idx_posts_slug ON posts(slug);
+
+CREATE TABLE IF NOT EXISTS post_slug_redirects (
+    slug VARCHAR(100) PRIMARY KEY,
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+);
+CREATE INDEX idx_post_slug_redirects_post ON post_slug_redirects(post_id);
@@ -0,0 +1,17 @@
+-- Comments on posts. A reply points at its parent comment. Deleted and
+-- hidden comments keep their row, so the replies under them stay in place.
+CREATE TABLE IF NOT EXISTS comments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    post_id INTEGER NOT NULL REFERENCES posts(id) ON DELETE CASCADE,
+    parent_id INTEGER NULL REFERENCES comments(id) ON DELETE SET NULL,
+    author_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER)),
+    edited_at DATETIME NULL,
+    deleted_at DATETIME NULL,
+    -- Set by a moderator; hidden comments are shown as removed
+    hidden_at DATETIME NULL,
+    hidden_by INTEGER NULL REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX idx_comments_post ON comments(post_id, created_at);
+CREATE INDEX idx_comments_created ON comments(created_at);
@@ -0,0 +1,4 @@
+-- The time step of the last TOTP code accepted for the user. Codes from
+-- that step or earlier are refused, so an accepted code can't be replayed
+-- while it is still inside the clock drift window.
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT NULL;
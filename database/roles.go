@@ -0,0 +1,65 @@
+package database
+
+import (
+	"fmt"
+	"webapp/models"
+)
+
+// Permissions checked by Handlers.RequirePermission and the handlers
+const (
+	PermViewDashboard    = "dashboard.view"
+	PermCreateInvites    = "invites.create"
+	PermViewUsers        = "users.view"
+	PermManageUsers      = "users.manage"
+	PermManageRoles      = "roles.manage"
+	PermManageSecurity   = "security.manage"
+	PermViewAudit        = "audit.view"
+	PermManageTrash      = "trash.manage"
+	PermEditAnyPost      = "posts.edit_any"
+	PermDeleteAnyPost    = "posts.delete_any"
+	PermModerateComments = "comments.moderate"
+	PermManageTags       = "tags.manage"
+)
+
+// Built-in role names
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleInviter   = "inviter"
+)
+
+// defaultRoles are created on startup. Permissions added here in later
+// versions are granted to the existing role on the next start.
+var defaultRoles = []models.Role{
+	{Name: RoleAdmin, Description: "Full access to the admin area", Permissions: []string{
+		PermViewDashboard, PermCreateInvites, PermViewUsers, PermManageUsers,
+		PermManageRoles, PermManageSecurity, PermViewAudit, PermManageTrash, PermEditAnyPost, PermDeleteAnyPost,
+		PermModerateComments, PermManageTags,
+	}},
+	{Name: RoleModerator, Description: "Can edit and delete any post, moderate comments and tidy up tags", Permissions: []string{
+		PermEditAnyPost, PermDeleteAnyPost, PermModerateComments, PermManageTags,
+	}},
+	{Name: RoleInviter, Description: "Can generate invitation codes", Permissions: []string{
+		PermViewDashboard, PermCreateInvites,
+	}},
+}
+
+// seedRoles creates the built-in roles and grants them any permissions
+// they are missing.
+func seedRoles() error {
+	for _, role := range defaultRoles {
+		if _, err := DB.Exec(DBDialect.InsertIgnore()+" INTO roles (name, description) VALUES (?, ?)", role.Name, role.Description); err != nil {
+			return fmt.Errorf("creating role %s: %w", role.Name, err)
+		}
+		for _, permission := range role.Permissions {
+			_, err := DB.Exec(DBDialect.InsertIgnore()+`
+				INTO role_permissions (role_id, permission)
+				SELECT id, ? FROM roles WHERE name = ?
+			`, permission, role.Name)
+			if err != nil {
+				return fmt.Errorf("granting %s to role %s: %w", permission, role.Name, err)
+			}
+		}
+	}
+	return nil
+}
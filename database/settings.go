@@ -0,0 +1,6 @@
+package database
+
+// Names of site-wide settings stored in the settings table
+const (
+	SettingRequireAdmin2FA = "require_admin_2fa"
+)
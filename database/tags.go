@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// PostTagIDs returns the IDs of the tags on the posts matching where, a
+// condition on posts p and their authors u. Deleting posts can leave those
+// tags unused; see DeleteUnusedTags.
+func PostTagIDs(ctx context.Context, tx *sql.Tx, where string, args ...interface{}) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT pt.tag_id FROM post_tags pt
+		JOIN posts p ON pt.post_id = p.id
+		JOIN users u ON p.author_id = u.id
+		WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteUnusedTags deletes those of tagIDs that no post uses any more,
+// trashed posts still counting so restoring one brings its tags back. Only
+// looking at tagIDs keeps MySQL from locking every row of tags.
+func DeleteUnusedTags(ctx context.Context, tx *sql.Tx, tagIDs []int) error {
+	if len(tagIDs) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(tagIDs))
+	for i, id := range tagIDs {
+		args[i] = id
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM tags
+		WHERE id IN (?`+strings.Repeat(", ?", len(tagIDs)-1)+`)
+		AND NOT EXISTS (SELECT 1 FROM post_tags pt WHERE pt.tag_id = tags.id)`, args...)
+	return err
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// PurgeTrash permanently deletes users and posts that were moved to the
+// trash before cutoff. A purged user's posts go with them, and so do tags
+// no remaining post uses.
+func PurgeTrash(cutoff time.Time) (users, posts int64, err error) {
+	ctx := context.Background()
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	tagIDs, err := PostTagIDs(ctx, tx, `(p.deleted_at IS NOT NULL AND p.deleted_at < ?)
+		OR (u.deleted_at IS NOT NULL AND u.deleted_at < ?)`, cutoff, cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result, err := tx.Exec("DELETE FROM posts WHERE deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+	posts, _ = result.RowsAffected()
+
+	result, err = tx.Exec("DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+	if err != nil {
+		return 0, 0, err
+	}
+	users, _ = result.RowsAffected()
+
+	if err := DeleteUnusedTags(ctx, tx, tagIDs); err != nil {
+		return 0, 0, err
+	}
+	return users, posts, tx.Commit()
+}
+
+// StartTrashPurger purges trash older than retention every interval until
+// stop is closed. onPurge is called after each run.
+func StartTrashPurger(retention, interval time.Duration, stop <-chan struct{}, onPurge func(users, posts int64, err error)) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				users, posts, err := PurgeTrash(time.Now().Add(-retention))
+				if onPurge != nil {
+					onPurge(users, posts, err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+// insertUser adds a user for the trash tests and returns its ID
+func insertUser(t *testing.T, username string) int {
+	t.Helper()
+	result, err := DB.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, 'hash')", username, username+"@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+func trashUser(t *testing.T, id int, at time.Time) {
+	t.Helper()
+	if _, err := DB.Exec("UPDATE users SET deleted_at = ? WHERE id = ?", at, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func count(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := DB.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurgeTrash(t *testing.T) {
+	useTempSQLite(t)
+	if _, err := MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := insertUser(t, "old")
+	recent := insertUser(t, "recent")
+	active := insertUser(t, "active")
+	trashUser(t, old, now.Add(-48*time.Hour))
+	trashUser(t, recent, now.Add(-time.Hour))
+
+	// A post of the old user, a trashed post of an active user that has
+	// expired and one that hasn't
+	for _, post := range []struct {
+		author    int
+		deletedAt interface{}
+		tag       string
+	}{{old, nil, "haunted"}, {active, now.Add(-48 * time.Hour), "spooky"}, {active, now.Add(-time.Hour), "spooky"}, {active, nil, "boo"}} {
+		result, err := DB.Exec("INSERT INTO posts (title, content, author_id, deleted_at) VALUES ('Boo', 'Boo', ?, ?)", post.author, post.deletedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		postID, _ := result.LastInsertId()
+		if _, err := DB.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", post.tag); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DB.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT ?, id FROM tags WHERE name = ?", postID, post.tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A tag no post uses, which isn't the purge's business
+	if _, err := DB.Exec("INSERT INTO tags (name) VALUES ('stray')"); err != nil {
+		t.Fatal(err)
+	}
+
+	users, posts, err := PurgeTrash(now.Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users != 1 || posts != 1 {
+		t.Errorf("purged %d users and %d posts, want 1 and 1", users, posts)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM users WHERE id = ?", old); n != 0 {
+		t.Error("expired user survived the purge")
+	}
+	// The old user's post went with them
+	if n := count(t, "SELECT COUNT(*) FROM posts"); n != 2 {
+		t.Errorf("%d posts left, want 2", n)
+	}
+	// Only the tag no remaining post uses went
+	if n := count(t, "SELECT COUNT(*) FROM tags WHERE name IN ('spooky', 'boo', 'stray')"); n != 3 {
+		t.Errorf("%d of the tags still in use or unrelated left, want 3", n)
+	}
+	if n := count(t, "SELECT COUNT(*) FROM tags WHERE name = 'haunted'"); n != 0 {
+		t.Error("tag of the purged posts survived")
+	}
+}
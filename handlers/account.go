@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"webapp/database"
+	"webapp/mailer"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+const emailChangeLifetime = 24 * time.Hour
+
+// Messages shown on the edit profile page, keyed by the code in the
+// ?success= or ?error= query parameter
+var accountMessages = map[string]string{
+	"wrong_password":    "Current password is incorrect",
+	"password_mismatch": "New passwords must match and be at least 6 characters",
+	"password_changed":  "Password changed. Other devices have been logged out.",
+	"invalid_email":     "Please enter a valid email address",
+	"same_email":        "That is already your email address",
+	"email_taken":       "That email address is already in use",
+	"email_not_sent":    "Could not send the verification email. Please try again later.",
+	"email_sent":        "Check your new inbox for a link to confirm the change.",
+	"email_verified":    "Your email address has been updated.",
+	"too_many_attempts": "Too many wrong passwords. Please wait and try again.",
+}
+
+// redirectAccountSettings sends the user back to the edit profile page with
+// a success or error message code
+func redirectAccountSettings(w http.ResponseWriter, r *http.Request, key, code string) {
+	http.Redirect(w, r, "/edit-profile?"+key+"="+code+"#account", http.StatusSeeOther)
+}
+
+// checkCurrentPassword confirms the password a logged-in user typed to
+// change their account. Wrong guesses count towards the same limits and
+// lockout as /login, so a hijacked session can't be used to brute force the
+// password. It redirects with an error itself when the check fails.
+func (h *Handlers) checkCurrentPassword(w http.ResponseWriter, r *http.Request, user models.User, event string) bool {
+	clientIP := h.clientIP(r)
+	if !loginUsernameLimiter.Allow(user.Username) {
+		utils.LogAuth(event, user.Username, clientIP, false)
+		utils.LogError(fmt.Sprintf("%s rate limit hit for user %s from IP %s", event, user.Username, clientIP))
+		redirectAccountSettings(w, r, "error", "too_many_attempts")
+		return false
+	}
+	if _, locked := h.accountLockedUntil(r.Context(), user.Username); locked {
+		utils.LogAuth(event, user.Username, clientIP, false)
+		redirectAccountSettings(w, r, "error", "too_many_attempts")
+		return false
+	}
+
+	if !middleware.CheckPassword(r.PostFormValue("current_password"), user.Password) {
+		utils.LogAuth(event, user.Username, clientIP, false)
+		h.recordLoginFailure(r, user.Username, clientIP)
+		redirectAccountSettings(w, r, "error", "wrong_password")
+		return false
+	}
+	if _, err := h.Logins.Clear(r.Context(), user.Username); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to clear failed logins for user %s: %v", user.Username, err))
+	}
+	return true
+}
+
+// ChangePasswordHandler updates the password after checking the current one
+func (h *Handlers) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var userID int
+	fmt.Sscanf(session.UserID, "%d", &userID)
+	clientIP := h.clientIP(r)
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		utils.LogError("User not found for password change: " + err.Error())
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.checkCurrentPassword(w, r, user, "PASSWORD_CHANGE") {
+		return
+	}
+
+	newPassword := r.PostFormValue("new_password")
+	if len(newPassword) < 6 || newPassword != r.PostFormValue("confirm_password") {
+		redirectAccountSettings(w, r, "error", "password_mismatch")
+		return
+	}
+
+	hashPassword, err := middleware.HashPassword(newPassword)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Password hashing failed for user %s: %v", user.Username, err))
+		http.Error(w, "Error Creating Password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.Users.SetPassword(r.Context(), user.ID, hashPassword); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to change password for user %s: %v", user.Username, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log out every other device, then give this browser a fresh session
+	if _, err := h.Sessions.Store.RevokeAllForUser(session.UserID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %s: %v", user.Username, err))
+	}
+	if err := h.startSession(w, r, user.ID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to save session for user %s: %v", user.Username, err))
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	utils.LogAuth("PASSWORD_CHANGE", user.Username, clientIP, true)
+	h.audit(r, database.AuditPasswordChange, "user", user.ID, nil)
+	redirectAccountSettings(w, r, "success", "password_changed")
+}
+
+// ChangeEmailHandler emails a verification link to the new address. The
+// change only takes effect once that link is opened.
+func (h *Handlers) ChangeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var userID int
+	fmt.Sscanf(session.UserID, "%d", &userID)
+	clientIP := h.clientIP(r)
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		utils.LogError("User not found for email change: " + err.Error())
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if !h.checkCurrentPassword(w, r, user, "EMAIL_CHANGE") {
+		return
+	}
+
+	newEmail := strings.TrimSpace(r.PostFormValue("new_email"))
+	if newEmail == "" || !strings.Contains(newEmail, "@") || strings.ContainsAny(newEmail, "\r\n") {
+		redirectAccountSettings(w, r, "error", "invalid_email")
+		return
+	}
+	if strings.EqualFold(newEmail, user.Email) {
+		redirectAccountSettings(w, r, "error", "same_email")
+		return
+	}
+
+	// Trashed accounts still hold their address until they are purged
+	if taken, _ := h.Users.EmailTaken(r.Context(), newEmail); taken {
+		redirectAccountSettings(w, r, "error", "email_taken")
+		return
+	}
+
+	token := middleware.GenerateToken()
+	err = h.Users.CreateEmailChange(r.Context(), user.ID, newEmail, middleware.HashToken(token), time.Now().Add(emailChangeLifetime))
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to store email change for user %s: %v", user.Username, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	link := h.baseURL(r) + "/profile/verify-email?token=" + url.QueryEscape(token)
+	err = h.Mailer.Send(mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nOpen this link within 24 hours to start using this address for your account:\n\n%s\n\n"+
+			"If you didn't ask for this, ignore this email.\n", user.Username, link),
+	})
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to send email verification for user %s: %v", user.Username, err))
+		redirectAccountSettings(w, r, "error", "email_not_sent")
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %s requested email change from IP %s", user.Username, clientIP))
+	redirectAccountSettings(w, r, "success", "email_sent")
+}
+
+// VerifyEmailHandler applies a pending email change from the emailed link
+func (h *Handlers) VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	clientIP := h.clientIP(r)
+
+	userID, err := h.Users.ApplyEmailChange(r.Context(), middleware.HashToken(token))
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "This verification link is invalid, expired, or has already been used.", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, repository.ErrEmailTaken) {
+		utils.LogError(fmt.Sprintf("Failed to apply email change: %v", err))
+		http.Error(w, "That email address is already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to apply email change: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %d verified new email from IP %s", userID, clientIP))
+	h.auditAs(r, userID, "", database.AuditEmailChange, "user", userID, nil)
+
+	if _, loggedIn := h.Sessions.Get(r); loggedIn {
+		redirectAccountSettings(w, r, "success", "email_verified")
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
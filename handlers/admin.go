@@ -1,24 +1,26 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 	"strconv"
 	"time"
 	"webapp/database"
 	"webapp/middleware"
 	"webapp/models"
+	"webapp/repository"
 	"webapp/utils"
 )
 
-func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	// Get current user info
-	session, _ := middleware.GetSession(r)
+	session, _ := h.Sessions.Get(r)
 	userID, _ := strconv.Atoi(session.UserID)
 
 	// Get invitation codes created by this admin
-	codes, err := ListInvitationCodes(userID)
+	codes, err := h.Invitations.ListByCreator(r.Context(), userID)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to get invitation codes: %v", err))
 		http.Error(w, "Database error", http.StatusInternalServerError)
@@ -26,18 +28,22 @@ func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get all users count
-	var userCount int
-	database.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
+	userCount, _ := h.Users.Count(r.Context())
 
 	// Get all posts count
-	var postCount int
-	database.DB.QueryRow("SELECT COUNT(*) FROM posts").Scan(&postCount)
+	postCount, _ := h.Posts.Count(r.Context())
 
 	// Check for success message
 	success := r.URL.Query().Get("success")
 	code := r.URL.Query().Get("code")
 	count := r.URL.Query().Get("count")
 
+	// Sections of the dashboard are shown according to the viewer's roles
+	permissions, err := h.Permissions.Permissions(r.Context(), userID)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get permissions for user %d: %v", userID, err))
+	}
+
 	data := struct {
 		UserCount   int
 		PostCount   int
@@ -45,6 +51,8 @@ func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		Success     string
 		Code        string
 		Count       string
+		Require2FA  bool
+		Can         map[string]bool
 	}{
 		UserCount:   userCount,
 		PostCount:   postCount,
@@ -52,25 +60,26 @@ func AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
 		Success:     success,
 		Code:        code,
 		Count:       count,
+		Require2FA:  h.adminTwoFactorRequired(r.Context()),
+		Can:         permissions,
 	}
 
-	tmpl := template.Must(template.ParseFiles("templates/admin_dashboard.html"))
-	tmpl.Execute(w, data)
+	h.renderTemplate(w, r, "admin_dashboard.html", data)
 }
 
-func GenerateInviteCodeHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) GenerateInviteCodeHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	session, _ := middleware.GetSession(r)
+	session, _ := h.Sessions.Get(r)
 	userID, _ := strconv.Atoi(session.UserID)
 
-	// Set expiration to 30 days from now
-	expiresAt := time.Now().AddDate(0, 0, 30)
+	// Invitations expire after INVITE_EXPIRY_DAYS
+	expiresAt := time.Now().Add(h.Config.InviteExpiry)
 
-	code, err := GenerateInvitationCode(userID, &expiresAt)
+	code, err := h.generateInvitationCode(r.Context(), userID, &expiresAt)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to generate invitation code: %v", err))
 		http.Error(w, "Failed to generate invitation code", http.StatusInternalServerError)
@@ -78,47 +87,112 @@ func GenerateInviteCodeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.LogInfo(fmt.Sprintf("Admin %s generated invitation code: %s", session.UserID, code))
+	h.audit(r, database.AuditInviteCreate, "invitation_code", nil, map[string]interface{}{"expires_at": expiresAt})
 
 	// Redirect back to admin dashboard with success message
 	http.Redirect(w, r, "/admin?success=code_generated&code="+code, http.StatusSeeOther)
 }
 
-func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
-	// Get all users
-	rows, err := database.DB.Query(`
-		SELECT id, username, email, is_admin, created_at, invited_by
-		FROM users 
-		ORDER BY created_at DESC
-	`)
+func (h *Handlers) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	// Get all users with their roles
+	users, err := h.Users.ListWithRoles(r.Context())
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to get users: %v", err))
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	for i := range users {
+		users[i].IsAdmin = users[i].HasRole(database.RoleAdmin)
+	}
+
+	roles, err := h.Permissions.Roles(r.Context())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get roles: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	userID, _ := strconv.Atoi(session.UserID)
+
+	data := map[string]interface{}{
+		"Users":          users,
+		"Roles":          roles,
+		"CurrentUserID":  userID,
+		"CanManageRoles": h.hasPermission(r.Context(), userID, database.PermManageRoles),
+		"CanManageUsers": h.hasPermission(r.Context(), userID, database.PermManageUsers),
+		"Success":        adminUserMessages[r.URL.Query().Get("success")],
+		"Error":          adminUserMessages[r.URL.Query().Get("error")],
+	}
+	h.renderTemplate(w, r, "admin_users.html", data)
+}
+
+// Messages shown on the admin users page, keyed by the ?success= or
+// ?error= code
+var adminUserMessages = map[string]string{
+	"role_granted":      "Role granted.",
+	"role_revoked":      "Role removed.",
+	"role_failed":       "Could not change that role.",
+	"last_admin":        "The last admin can't be demoted, suspended or deleted.",
+	"self_action":       "You can't do that to your own account.",
+	"suspended":         "User suspended and logged out everywhere.",
+	"reactivated":       "User reactivated.",
+	"reset_forced":      "Password reset required. The user has been emailed a reset link.",
+	"reset_mail_failed": "Password reset required, but the reset email could not be sent.",
+	"deleted":           "User moved to the trash.",
+	"confirm_mismatch":  "The username you typed doesn't match.",
+}
 
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.IsAdmin, &user.CreatedAt, &user.InvitedBy)
+// UpdateUserRoleHandler grants or revokes one role for one user
+func (h *Handlers) UpdateUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targetID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	role := r.FormValue("role")
+
+	switch r.FormValue("action") {
+	case "grant":
+		if err := h.Permissions.GrantRole(r.Context(), targetID, role); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to grant role %s to user %d: %v", role, targetID, err))
+			http.Redirect(w, r, "/admin/users?error=role_failed", http.StatusSeeOther)
+			return
+		}
+		h.audit(r, database.AuditRoleGrant, "user", targetID, map[string]interface{}{"role": role})
+		http.Redirect(w, r, "/admin/users?success=role_granted", http.StatusSeeOther)
+	case "revoke":
+		err := h.Permissions.RevokeRole(r.Context(), targetID, role)
+		if errors.Is(err, repository.ErrLastAdmin) {
+			http.Redirect(w, r, "/admin/users?error=last_admin", http.StatusSeeOther)
+			return
+		}
 		if err != nil {
-			utils.LogError(fmt.Sprintf("Failed to scan user: %v", err))
-			continue
+			utils.LogError(fmt.Sprintf("Failed to revoke role %s from user %d: %v", role, targetID, err))
+			http.Redirect(w, r, "/admin/users?error=role_failed", http.StatusSeeOther)
+			return
 		}
-		users = append(users, user)
+		h.audit(r, database.AuditRoleRevoke, "user", targetID, map[string]interface{}{"role": role})
+		http.Redirect(w, r, "/admin/users?success=role_revoked", http.StatusSeeOther)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
 	}
-
-	tmpl := template.Must(template.ParseFiles("templates/admin_users.html"))
-	tmpl.Execute(w, users)
 }
 
 // CreateFirstAdmin creates the first admin user if none exists
-func CreateFirstAdmin() {
-	// Check if any admin exists
-	var count int
-	database.DB.QueryRow("SELECT COUNT(*) FROM users WHERE is_admin = TRUE").Scan(&count)
-
-	if count == 0 {
+func (h *Handlers) CreateFirstAdmin() {
+	ctx := context.Background()
+	admins, err := h.Permissions.CountRoleMembers(ctx, database.RoleAdmin)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to count admins: %v", err))
+		return
+	}
+	if admins == 0 {
 		// No admin exists, create one
 		password := "password" // Default password
 		hashPassword, err := middleware.HashPassword(password)
@@ -127,37 +201,87 @@ func CreateFirstAdmin() {
 			return
 		}
 
-		_, err = database.DB.Exec(`
-			INSERT INTO users (username, email, password, invitation_code, invited_by, is_admin) 
-			VALUES (?, ?, ?, ?, ?, ?)
-		`, "admin", "admin@example.com", hashPassword, "ADMIN-CREATED", nil, true)
-
+		adminID, err := h.Users.Create(ctx, models.User{
+			Username:       "admin",
+			Email:          "admin@example.com",
+			Password:       hashPassword,
+			InvitationCode: "ADMIN-CREATED",
+		})
 		if err != nil {
 			utils.LogError(fmt.Sprintf("Failed to create admin user: %v", err))
-		} else {
-			utils.LogInfo("First admin user created: admin / password")
+			return
 		}
+
+		if err := h.Permissions.GrantRole(ctx, adminID, database.RoleAdmin); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to grant admin role: %v", err))
+			return
+		}
+		utils.LogInfo("First admin user created: admin / password")
 	}
 }
 
-// CleanAllUsersHandler removes all users except admins
-func CleanAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+// CleanAllUsersHandler moves all users that don't hold any role to the trash
+func (h *Handlers) CleanAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Delete all non-admin users
-	result, err := database.DB.Exec("DELETE FROM users WHERE is_admin = FALSE")
+	// Trash all users without a role, so staff accounts are kept and
+	// everything else can still be restored
+	ids, err := h.Users.TrashWithoutRole(r.Context())
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Failed to clean users: %v", err))
 		http.Error(w, "Failed to clean users", http.StatusInternalServerError)
 		return
 	}
+	for _, id := range ids {
+		if _, err := h.Sessions.Store.RevokeAllForUser(strconv.Itoa(id)); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %d: %v", id, err))
+		}
+	}
 
-	rowsAffected, _ := result.RowsAffected()
-	utils.LogInfo(fmt.Sprintf("Cleaned %d users from database", rowsAffected))
+	rowsAffected := len(ids)
+	utils.LogInfo(fmt.Sprintf("Moved %d users to the trash", rowsAffected))
+	h.audit(r, database.AuditUsersClean, "user", nil, map[string]interface{}{"trashed": ids})
 
 	// Redirect back to admin dashboard
 	http.Redirect(w, r, "/admin?success=users_cleaned&count="+fmt.Sprintf("%d", rowsAffected), http.StatusSeeOther)
 }
+
+// AdminLockoutsHandler lists accounts with failed logins and active lockouts
+func (h *Handlers) AdminLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	logins, err := h.Logins.List(r.Context())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get failed logins: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Logins":  logins,
+		"Success": r.URL.Query().Get("success"),
+	}
+	h.renderTemplate(w, r, "admin_lockouts.html", data)
+}
+
+// UnlockAccountHandler clears the lockout for a single username
+func (h *Handlers) UnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	username := r.FormValue("username")
+
+	if _, err := h.Logins.Clear(r.Context(), username); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to unlock account %s: %v", username, err))
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("Admin %s unlocked account %s", session.UserID, username))
+	h.audit(r, database.AuditAccountUnlock, "username", username, nil)
+	http.Redirect(w, r, "/admin/lockouts?success=unlocked", http.StatusSeeOther)
+}
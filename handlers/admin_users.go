@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"webapp/database"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+// loadManagedUser fetches the user an admin action targets, with roles
+func (h *Handlers) loadManagedUser(ctx context.Context, id int) (models.User, error) {
+	user, err := h.Users.GetByID(ctx, id)
+	if err != nil {
+		return user, err
+	}
+	user.Roles, err = h.Permissions.UserRoles(ctx, id)
+	user.IsAdmin = user.HasRole(database.RoleAdmin)
+	return user, err
+}
+
+// managedUserFromForm loads the target of a POSTed admin action. Admins
+// can't use these actions on themselves. The last admin is protected by
+// the repository, which refuses the change with repository.ErrLastAdmin;
+// see lockoutFailed.
+func (h *Handlers) managedUserFromForm(w http.ResponseWriter, r *http.Request, session middleware.Session) (models.User, bool) {
+	targetID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return models.User{}, false
+	}
+
+	user, err := h.loadManagedUser(r.Context(), targetID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return models.User{}, false
+	}
+
+	if strconv.Itoa(user.ID) == session.UserID {
+		http.Redirect(w, r, "/admin/users?error=self_action", http.StatusSeeOther)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// lockoutFailed reports an error from suspending, forcing a reset on or
+// deleting user, sending the admin back with a message if it was the last
+// admin
+func lockoutFailed(w http.ResponseWriter, r *http.Request, user models.User, action string, err error) {
+	if errors.Is(err, repository.ErrLastAdmin) {
+		http.Redirect(w, r, "/admin/users?error=last_admin", http.StatusSeeOther)
+		return
+	}
+	utils.LogError(fmt.Sprintf("Failed to %s user %d: %v", action, user.ID, err))
+	http.Error(w, "Database error", http.StatusInternalServerError)
+}
+
+// SuspendUserHandler suspends or reactivates an account. Suspending also
+// logs the user out everywhere.
+func (h *Handlers) SuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	user, ok := h.managedUserFromForm(w, r, session)
+	if !ok {
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "suspend":
+		if err := h.Users.SetSuspended(r.Context(), user.ID, true); err != nil {
+			lockoutFailed(w, r, user, "suspend", err)
+			return
+		}
+		revoked, err := h.Sessions.Store.RevokeAllForUser(strconv.Itoa(user.ID))
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %d: %v", user.ID, err))
+		}
+		h.audit(r, database.AuditUserSuspend, "user", user.ID, map[string]interface{}{
+			"username":         user.Username,
+			"sessions_revoked": revoked,
+		})
+		http.Redirect(w, r, "/admin/users?success=suspended", http.StatusSeeOther)
+	case "reactivate":
+		if err := h.Users.SetSuspended(r.Context(), user.ID, false); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to reactivate user %d: %v", user.ID, err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		h.audit(r, database.AuditUserReactivate, "user", user.ID, map[string]interface{}{"username": user.Username})
+		http.Redirect(w, r, "/admin/users?success=reactivated", http.StatusSeeOther)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+	}
+}
+
+// ForcePasswordResetHandler blocks logins until the user picks a new
+// password through an emailed reset link
+func (h *Handlers) ForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	user, ok := h.managedUserFromForm(w, r, session)
+	if !ok {
+		return
+	}
+
+	if err := h.Users.RequirePasswordReset(r.Context(), user.ID); err != nil {
+		lockoutFailed(w, r, user, "force a password reset for", err)
+		return
+	}
+	if _, err := h.Sessions.Store.RevokeAllForUser(strconv.Itoa(user.ID)); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %d: %v", user.ID, err))
+	}
+
+	h.audit(r, database.AuditUserForceReset, "user", user.ID, map[string]interface{}{"username": user.Username})
+
+	if err := h.sendPasswordResetEmail(r, user); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to send forced password reset for user %s: %v", user.Username, err))
+		http.Redirect(w, r, "/admin/users?error=reset_mail_failed", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/admin/users?success=reset_forced", http.StatusSeeOther)
+}
+
+// DeleteUserHandler shows a confirmation page on GET and moves the user to
+// the trash on POST once the admin has typed the username to confirm
+func (h *Handlers) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := h.Sessions.Get(r)
+
+	if r.Method == "GET" {
+		targetID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+		user, err := h.loadManagedUser(r.Context(), targetID)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		postCount, _ := h.Posts.CountByAuthor(r.Context(), user.ID)
+
+		h.renderTemplate(w, r, "admin_user_delete.html", map[string]interface{}{
+			"User":          user,
+			"PostCount":     postCount,
+			"RetentionDays": int(h.Config.TrashRetention.Hours() / 24),
+			"Error":         adminUserMessages[r.URL.Query().Get("error")],
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		user, ok := h.managedUserFromForm(w, r, session)
+		if !ok {
+			return
+		}
+
+		if r.FormValue("confirm_username") != user.Username {
+			http.Redirect(w, r, fmt.Sprintf("/admin/users/delete?id=%d&error=confirm_mismatch", user.ID), http.StatusSeeOther)
+			return
+		}
+
+		if err := h.Users.SoftDelete(r.Context(), user.ID); err != nil {
+			lockoutFailed(w, r, user, "delete", err)
+			return
+		}
+		if _, err := h.Sessions.Store.RevokeAllForUser(strconv.Itoa(user.ID)); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %d: %v", user.ID, err))
+		}
+
+		h.audit(r, database.AuditUserDelete, "user", user.ID, map[string]interface{}{
+			"username": user.Username,
+			"roles":    user.Roles,
+		})
+		http.Redirect(w, r, "/admin/users?success=deleted", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+const auditPageSize = 50
+
+// audit records an action taken by the logged-in user
+func (h *Handlers) audit(r *http.Request, action, targetType string, targetID interface{}, metadata map[string]interface{}) {
+	var actorID int
+	if session, loggedIn := h.Sessions.Get(r); loggedIn {
+		actorID, _ = strconv.Atoi(session.UserID)
+	}
+	h.auditAs(r, actorID, "", action, targetType, targetID, metadata)
+}
+
+// auditAs records an action for an explicit actor, for steps such as login
+// and signup that happen before there is a session. actorID 0 means the
+// actor has no account; an empty actorName is looked up from actorID.
+func (h *Handlers) auditAs(r *http.Request, actorID int, actorName, action, targetType string, targetID interface{}, metadata map[string]interface{}) {
+	if actorName == "" && actorID != 0 {
+		if actor, err := h.Users.GetByID(r.Context(), actorID); err == nil {
+			actorName = actor.Username
+		}
+	}
+
+	event := models.AuditEvent{
+		ActorName:  actorName,
+		Action:     action,
+		TargetType: targetType,
+		IP:         h.clientIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	if targetID != nil {
+		event.TargetID = fmt.Sprint(targetID)
+	}
+
+	// The file copy keeps a trail even if the database write fails
+	var details string
+	if len(metadata) > 0 {
+		encoded, _ := json.Marshal(metadata)
+		details = string(encoded)
+	}
+	utils.LogAudit(actorName, action, targetType+":"+event.TargetID, event.IP, details)
+
+	if err := h.Audit.Record(r.Context(), event, metadata); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to record audit event %s: %v", action, err))
+	}
+}
+
+// AdminAuditHandler lists audit events with optional filters
+func (h *Handlers) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	filter := repository.AuditFilter{
+		Actor:      query.Get("actor"),
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+		// One extra row tells us whether there is a next page
+		Limit:  auditPageSize + 1,
+		Offset: (page - 1) * auditPageSize,
+	}
+	if since, err := time.Parse("2006-01-02", query.Get("since")); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse("2006-01-02", query.Get("until")); err == nil {
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+
+	events, err := h.Audit.List(r.Context(), filter)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get audit events: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	hasNext := len(events) > auditPageSize
+	if hasNext {
+		events = events[:auditPageSize]
+	}
+
+	// Page links keep the current filters
+	pageURL := func(p int) string {
+		values := url.Values{}
+		for key, value := range query {
+			values[key] = value
+		}
+		values.Set("page", strconv.Itoa(p))
+		return "/admin/audit?" + values.Encode()
+	}
+
+	data := map[string]interface{}{
+		"Events":     events,
+		"Actor":      filter.Actor,
+		"Action":     filter.Action,
+		"TargetType": filter.TargetType,
+		"TargetID":   filter.TargetID,
+		"Since":      query.Get("since"),
+		"Until":      query.Get("until"),
+		"Page":       page,
+	}
+	if page > 1 {
+		data["PrevURL"] = pageURL(page - 1)
+	}
+	if hasNext {
+		data["NextURL"] = pageURL(page + 1)
+	}
+	h.renderTemplate(w, r, "admin_audit.html", data)
+}
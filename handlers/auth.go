@@ -1,21 +1,24 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
+	"net/netip"
+	"strconv"
 	"strings"
 	"time"
 	"webapp/database"
 	"webapp/middleware"
 	"webapp/models"
+	"webapp/repository"
 	"webapp/utils"
 )
 
-func SignupHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) SignupHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		tmpl := template.Must(template.ParseFiles("templates/signup.html"))
-		tmpl.Execute(w, nil)
+		h.renderTemplate(w, r, "signup.html", nil)
 		return
 	}
 
@@ -24,22 +27,12 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		Email := r.PostFormValue("email")
 		Password := r.PostFormValue("password")
 		InvitationCode := r.PostFormValue("invitation_code")
-		clientIP := getClientIP(r)
+		clientIP := h.clientIP(r)
 
 		// Validate invitation code
-		var invitation models.InvitationCode
-		err := database.DB.QueryRow(`
-			SELECT id, code, created_by, used_by, is_used, expires_at 
-			FROM invitation_codes 
-			WHERE code = ? AND is_used = FALSE 
-			AND (expires_at IS NULL OR expires_at > NOW())
-		`, InvitationCode).Scan(
-			&invitation.ID, &invitation.Code, &invitation.CreatedBy,
-			&invitation.UsedBy, &invitation.IsUsed, &invitation.ExpiresAt,
-		)
-
+		invitation, err := h.Invitations.GetUsable(r.Context(), InvitationCode)
 		if err != nil {
-			utils.LogError(fmt.Sprintf("Invalid invitation code %s for user %s: %v", InvitationCode, Username, err))
+			utils.LogError(fmt.Sprintf("Invalid invitation code for user %s: %v", Username, err))
 			http.Error(w, "Invalid or expired invitation code", http.StatusBadRequest)
 			return
 		}
@@ -51,52 +44,22 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Start transaction to ensure atomicity
-		tx, err := database.DB.Begin()
-		if err != nil {
-			utils.LogError(fmt.Sprintf("Failed to start transaction for user %s: %v", Username, err))
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-		defer tx.Rollback()
-
-		// Insert user with invitation code
-		result, err := tx.Exec(`
-			INSERT INTO users (username, email, password, invitation_code, invited_by) 
-			VALUES (?, ?, ?, ?, ?)
-		`, Username, Email, hashPassword, InvitationCode, invitation.CreatedBy)
-
-		if err != nil {
+		// The user is created and the code marked as used together
+		userID, err := h.Users.CreateInvited(r.Context(), models.User{
+			Username:       Username,
+			Email:          Email,
+			Password:       hashPassword,
+			InvitationCode: InvitationCode,
+			InvitedBy:      &invitation.CreatedBy,
+		}, invitation.ID)
+		if errors.Is(err, repository.ErrUserExists) {
 			utils.LogSignup(Username, Email, clientIP, false)
 			utils.LogError(fmt.Sprintf("Signup failed for user %s: %v", Username, err))
 			http.Error(w, "Username or Email already Exist", http.StatusBadRequest)
 			return
 		}
-
-		// Get the new user ID
-		userID, err := result.LastInsertId()
-		if err != nil {
-			utils.LogError(fmt.Sprintf("Failed to get user ID for %s: %v", Username, err))
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-
-		// Mark invitation code as used
-		_, err = tx.Exec(`
-			UPDATE invitation_codes 
-			SET is_used = TRUE, used_by = ?, used_at = NOW() 
-			WHERE id = ?
-		`, userID, invitation.ID)
-
 		if err != nil {
-			utils.LogError(fmt.Sprintf("Failed to mark invitation code as used for user %s: %v", Username, err))
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
-		}
-
-		// Commit transaction
-		if err = tx.Commit(); err != nil {
-			utils.LogError(fmt.Sprintf("Failed to commit transaction for user %s: %v", Username, err))
+			utils.LogError(fmt.Sprintf("Failed to create user %s: %v", Username, err))
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
@@ -104,136 +67,259 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 		// Log successful signup
 		utils.LogSignup(Username, Email, clientIP, true)
 		utils.LogInfo(fmt.Sprintf("New user registered with invitation code: %s (%s)", Username, Email))
+		h.auditAs(r, userID, Username, database.AuditSignup, "user", userID, map[string]interface{}{
+			"invited_by": invitation.CreatedBy,
+		})
 
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	}
 }
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
-		tmpl := template.Must(template.ParseFiles("templates/login.html"))
-		tmpl.Execute(w, nil)
+		h.renderTemplate(w, r, "login.html", map[string]interface{}{
+			"PasswordReset": r.URL.Query().Get("reset") == "1",
+		})
 		return
 	}
 
 	if r.Method == "POST" {
 		Username := r.PostFormValue("username")
 		password := r.PostFormValue("password")
-		clientIP := getClientIP(r)
+		clientIP := h.clientIP(r)
 
-		// Debug: Print login attempt
-		fmt.Printf("Login attempt - Username: '%s', Password: '%s'\n", Username, password)
 		utils.LogInfo(fmt.Sprintf("Login attempt from IP %s for user: %s", clientIP, Username))
 
-		var user models.User
-		err := database.DB.QueryRow("SELECT id, username, password FROM users WHERE username = ?", Username).Scan(&user.ID, &user.Username, &user.Password)
+		// Throttle per IP and per username before touching the password
+		if !loginIPLimiter.Allow(clientIP) || !loginUsernameLimiter.Allow(Username) {
+			utils.LogLogin(Username, clientIP, false)
+			utils.LogError(fmt.Sprintf("Login rate limit hit for user %s from IP %s", Username, clientIP))
+			http.Error(w, "Too many login attempts. Please slow down.", http.StatusTooManyRequests)
+			return
+		}
+
+		if lockedUntil, locked := h.accountLockedUntil(r.Context(), Username); locked {
+			utils.LogLogin(Username, clientIP, false)
+			utils.LogError(fmt.Sprintf("Login attempt on locked account %s from IP %s", Username, clientIP))
+			http.Error(w, "Account temporarily locked. Try again after "+lockedUntil.Format("15:04:05"), http.StatusTooManyRequests)
+			return
+		}
+
+		user, err := h.Users.GetByUsername(r.Context(), Username)
 		if err != nil {
 			// note for myself: Show custom spooky user not found page
 			utils.LogLogin(Username, clientIP, false)
 			utils.LogError(fmt.Sprintf("User not found: %s from IP %s", Username, clientIP))
-			tmpl := template.Must(template.ParseFiles("templates/wrong_password.html"))
-			tmpl.Execute(w, nil)
+			// Only audited: counting failures for made-up names would let
+			// anyone grow failed_logins without limit
+			h.auditAs(r, 0, Username, database.AuditLoginFailure, "user", nil, nil)
+			h.renderTemplate(w, r, "wrong_password.html", nil)
 			return
 		}
 
-		// Debug: Print stored hash and input password
-		fmt.Printf("Login - Stored hash: %s\n", user.Password)
-		fmt.Printf("Login - Input password: '%s'\n", password)
-
 		// note for myself: CheckPassword(password, hash) - password first, then hash
 		// WHY: bcrypt.CompareHashAndPassword expects (hash, password) but our function signature is (password, hash)
 		// if you swap them, bcrypt will fail with "hashedSecret too short" error because it tries to use plaintext as hash
 		passwordMatch := middleware.CheckPassword(password, user.Password)
-		fmt.Printf("Login - Password match result: %t\n", passwordMatch)
 
 		if !passwordMatch {
 			// note for myself: Show custom spooky wrong password page instead of generic error
 			utils.LogLogin(Username, clientIP, false)
 			utils.LogError(fmt.Sprintf("Wrong password for user: %s from IP %s", Username, clientIP))
-			tmpl := template.Must(template.ParseFiles("templates/wrong_password.html"))
-			tmpl.Execute(w, nil)
+			h.recordLoginFailure(r, Username, clientIP)
+			h.renderTemplate(w, r, "wrong_password.html", nil)
 			return
 		}
 
-		// Session creation after successful password verification
-		token := middleware.GenerateToken()
-		middleware.Sessions[token] = &middleware.Session{
-			Token:    token,
-			UserID:   fmt.Sprintf("%d", user.ID),
-			ExpireAt: time.Now().Add(time.Hour * 24),
+		// The plaintext is only available here, so this is when hashes made
+		// with an old cost or scheme get upgraded
+		if middleware.NeedsRehash(user.Password) {
+			h.upgradePasswordHash(r.Context(), user, password)
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    token,
-			Expires:  time.Now().Add(time.Hour * 24),
-			HttpOnly: true,
-		})
+		// Only checked after the password, so guessers can't probe account status
+		if h.rejectBlockedLogin(w, r, user, clientIP) {
+			return
+		}
+
+		// Accounts with 2FA get a second login step before the session starts
+		if user.TOTPEnabled {
+			h.Sessions.SetPendingMFACookie(w, r, user.ID)
+			utils.LogInfo(fmt.Sprintf("User %s passed password check, awaiting 2FA from IP %s", Username, clientIP))
+			http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+			return
+		}
+
+		h.completeLogin(w, r, user, clientIP)
+	}
+}
+
+// rejectBlockedLogin stops suspended accounts and accounts that an admin
+// has forced through a password reset, and reports whether it did
+func (h *Handlers) rejectBlockedLogin(w http.ResponseWriter, r *http.Request, user models.User, clientIP string) bool {
+	var message string
+	switch {
+	case user.IsSuspended():
+		message = "This account has been suspended. Contact an administrator."
+	case user.ResetRequired:
+		message = "You must reset your password before logging in. Use the link we emailed you, or request a new one."
+	default:
+		return false
+	}
+
+	utils.LogLogin(user.Username, clientIP, false)
+	utils.LogInfo(fmt.Sprintf("Blocked login for user %s from IP %s: %s", user.Username, clientIP, message))
+	w.WriteHeader(http.StatusForbidden)
+	h.renderTemplate(w, r, "login.html", map[string]interface{}{
+		"Error": message,
+	})
+	return true
+}
 
-		// Log successful login
-		utils.LogLogin(Username, clientIP, true)
-		utils.LogInfo(fmt.Sprintf("User %s logged in successfully from IP %s", Username, clientIP))
+// upgradePasswordHash rehashes password with the current settings. Failure
+// is logged but doesn't block the login, the old hash still works.
+func (h *Handlers) upgradePasswordHash(ctx context.Context, user models.User, password string) {
+	hash, err := middleware.HashPassword(password)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Password rehash failed for user %s: %v", user.Username, err))
+		return
+	}
+	// Matching on the old hash avoids clobbering a password changed meanwhile
+	if err := h.Users.ReplacePasswordHash(ctx, user.ID, user.Password, hash); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to store rehashed password for user %s: %v", user.Username, err))
+		return
+	}
+	utils.LogInfo(fmt.Sprintf("Upgraded password hash for user %s", user.Username))
+}
 
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+// completeLogin starts a session once every login step has succeeded
+func (h *Handlers) completeLogin(w http.ResponseWriter, r *http.Request, user models.User, clientIP string) {
+	if _, err := h.Logins.Clear(r.Context(), user.Username); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to reset login failures for user %s: %v", user.Username, err))
 	}
+
+	// Session creation after successful password verification
+	if err := h.startSession(w, r, user.ID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to save session for user %s: %v", user.Username, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Log successful login
+	utils.LogLogin(user.Username, clientIP, true)
+	h.auditAs(r, user.ID, user.Username, database.AuditLoginSuccess, "user", user.ID, nil)
+	utils.LogInfo(fmt.Sprintf("User %s logged in successfully from IP %s", user.Username, clientIP))
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
+// startSession creates a new session for userID and sets the cookie
+func (h *Handlers) startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	_, err := h.Sessions.Start(w, r, strconv.Itoa(userID))
+	return err
+}
+
+func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	clientIP := h.clientIP(r)
 
-	cookie, err := r.Cookie("session_token")
-	if err == nil {
+	if token, ok := h.Sessions.Token(r); ok {
 		// Get username from session before deleting
-		if session, exists := middleware.Sessions[cookie.Value]; exists {
+		if session, exists := h.Sessions.Store.Lookup(token); exists {
 			utils.LogLogout(session.UserID, clientIP)
+			h.audit(r, database.AuditLogout, "user", session.UserID, nil)
 			utils.LogInfo(fmt.Sprintf("User %s logged out from IP %s", session.UserID, clientIP))
 		}
-		delete(middleware.Sessions, cookie.Value)
+		if err := h.Sessions.Store.Revoke(token); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to delete session from IP %s: %v", clientIP, err))
+		}
 	}
 
 	// Clear the session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:   "session_token",
-		Value:  "",
-		MaxAge: -1,
-	})
+	middleware.ClearSessionCookie(w)
 
 	// note for myself: Show spooky goodbye page instead of direct redirect
 	// This gives users a nice farewell experience with ghost animations
-	tmpl := template.Must(template.ParseFiles("templates/logout.html"))
-	tmpl.Execute(w, nil)
+	h.renderTemplate(w, r, "logout.html", nil)
+}
+
+// recordLoginFailure counts a failed login and logs when it locks the account
+func (h *Handlers) recordLoginFailure(r *http.Request, username, clientIP string) {
+	// The username is whatever was typed, so there is no actor ID to record
+	h.auditAs(r, 0, username, database.AuditLoginFailure, "user", nil, nil)
+
+	failures, err := h.Logins.RecordFailure(r.Context(), username, clientIP)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to record failed login for user %s: %v", username, err))
+		return
+	}
+	duration := middleware.LockoutDuration(failures)
+	if duration == 0 {
+		return
+	}
+	lockedUntil := time.Now().Add(duration)
+	if err := h.Logins.Lock(r.Context(), username, lockedUntil); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to lock account %s: %v", username, err))
+		return
+	}
+	utils.LogAuth("LOCKOUT", username, clientIP, false)
+	utils.LogInfo(fmt.Sprintf("Account %s locked until %s", username, lockedUntil.Format("2006-01-02 15:04:05")))
 }
 
-// Helper function to get client IP address
-func getClientIP(r *http.Request) string {
-	// Check for X-Forwarded-For header (for proxies/load balancers)
+// clientIP returns the address the request came from. X-Forwarded-For and
+// X-Real-IP are only believed from TRUSTED_PROXIES: anyone else could
+// send a new address with every request and never hit the per-IP limits.
+func (h *Handlers) clientIP(r *http.Request) string {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	addr := remote.Addr().Unmap()
+	if !h.trustedProxy(addr) {
+		return addr.String()
+	}
+
+	// Each proxy appends the address it got the request from, so the
+	// client is the last entry not added by one of our own proxies
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !h.trustedProxy(addr) {
+				break
+			}
 		}
+		return addr.String()
 	}
-
-	// Check for X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
+	if xri, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return xri.Unmap().String()
 	}
+	return addr.String()
+}
 
-	// Fall back to RemoteAddr
-	ip := strings.Split(r.RemoteAddr, ":")[0]
-	return ip
+func (h *Handlers) trustedProxy(addr netip.Addr) bool {
+	for _, proxy := range h.Config.TrustedProxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
-// GenerateInvitationCode creates a new invitation code
-func GenerateInvitationCode(createdBy int, expiresAt *time.Time) (string, error) {
+// generateInvitationCode stores a new invitation code from createdBy and
+// returns it
+func (h *Handlers) generateInvitationCode(ctx context.Context, createdBy int, expiresAt *time.Time) (string, error) {
 	// Generate a random code (you can customize this logic)
 	code := fmt.Sprintf("INV-%d-%s", time.Now().Unix(), generateRandomString(8))
 
-	_, err := database.DB.Exec(`
-		INSERT INTO invitation_codes (code, created_by, expires_at) 
-		VALUES (?, ?, ?)
-	`, code, createdBy, expiresAt)
-
+	err := h.Invitations.Create(ctx, models.InvitationCode{
+		Code:      code,
+		CreatedBy: createdBy,
+		ExpiresAt: expiresAt,
+	})
 	return code, err
 }
 
@@ -247,37 +333,7 @@ func generateRandomString(length int) string {
 	return string(b)
 }
 
-// ListInvitationCodes returns all invitation codes for a user
-func ListInvitationCodes(createdBy int) ([]models.InvitationCode, error) {
-	rows, err := database.DB.Query(`
-		SELECT id, code, created_by, used_by, is_used, expires_at, created_at, used_at
-		FROM invitation_codes 
-		WHERE created_by = ?
-		ORDER BY created_at DESC
-	`, createdBy)
-
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var codes []models.InvitationCode
-	for rows.Next() {
-		var code models.InvitationCode
-		err := rows.Scan(
-			&code.ID, &code.Code, &code.CreatedBy, &code.UsedBy,
-			&code.IsUsed, &code.ExpiresAt, &code.CreatedAt, &code.UsedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		codes = append(codes, code)
-	}
-
-	return codes, nil
-}
-
-func InvitationCodeHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) InvitationCodeHandler(w http.ResponseWriter, r *http.Request) {
 	// This would require authentication middleware to get the current user
 	// For now, assuming you have a way to get the current user ID
 
@@ -286,10 +342,9 @@ func InvitationCodeHandler(w http.ResponseWriter, r *http.Request) {
 		// You'll need to get the current user ID from session
 		userID := 1 // Replace with actual user ID from session
 
-		// Set expiration to 30 days from now
-		expiresAt := time.Now().AddDate(0, 0, 30)
+		expiresAt := time.Now().Add(h.Config.InviteExpiry)
 
-		code, err := GenerateInvitationCode(userID, &expiresAt)
+		code, err := h.generateInvitationCode(r.Context(), userID, &expiresAt)
 		if err != nil {
 			http.Error(w, "Failed to generate invitation code", http.StatusInternalServerError)
 			return
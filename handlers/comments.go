@@ -0,0 +1,350 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"webapp/database"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+const (
+	// maxCommentLength is the longest comment accepted, in characters
+	maxCommentLength = 2000
+	// maxCommentDepth is how far replies are indented; deeper replies are
+	// shown alongside their parent
+	maxCommentDepth = 5
+	// moderationPageSize is how many comments the moderation page lists
+	moderationPageSize = 100
+)
+
+// Limits how many comments one account can post in a burst
+var commentLimiter = middleware.NewRateLimiter(5, time.Minute)
+
+var commentMessages = map[string]string{
+	"empty":    "Write something before posting a comment.",
+	"too-long": fmt.Sprintf("Comments can be at most %d characters.", maxCommentLength),
+	"parent":   "The comment you replied to is no longer available.",
+	"hidden":   "Comment hidden.",
+	"shown":    "Comment visible again.",
+	"deleted":  "Comment deleted.",
+}
+
+// commentNode is a comment on the post page, with its replies and what the
+// viewer may do with it
+type commentNode struct {
+	models.Comment
+	Replies []*commentNode
+	Depth   int
+	// Removed comments are shown as a placeholder holding their replies
+	Removed     bool
+	CanReply    bool
+	CanEdit     bool
+	CanDelete   bool
+	CanModerate bool
+}
+
+// commentThreads arranges comments, oldest first, into reply threads.
+// Deleted comments, and hidden ones unless the viewer moderates, are kept
+// only while they have replies to show.
+func commentThreads(comments []models.Comment, viewerID string, canModerate bool) []*commentNode {
+	var roots []*commentNode
+	nodes := make(map[int]*commentNode, len(comments))
+	// lists holds the list each comment was added to
+	lists := make(map[int]*[]*commentNode, len(comments))
+	for _, comment := range comments {
+		own := viewerID != "" && strconv.Itoa(comment.AuthorID) == viewerID
+		node := &commentNode{
+			Comment:     comment,
+			Removed:     comment.Deleted || (comment.Hidden && !canModerate),
+			CanModerate: canModerate && !comment.Deleted,
+		}
+		node.CanReply = viewerID != "" && !node.Removed && !comment.Hidden
+		node.CanEdit = own && !node.Removed
+		node.CanDelete = (own || canModerate) && !comment.Deleted
+
+		// Replies come after their parent, as comments are oldest first
+		var parent *commentNode
+		if comment.ParentID != nil {
+			parent = nodes[*comment.ParentID]
+		}
+		list := &roots
+		if parent != nil {
+			if parent.Depth < maxCommentDepth {
+				node.Depth = parent.Depth + 1
+				list = &parent.Replies
+			} else {
+				// Too deep to indent further: show it next to its parent
+				node.Depth = parent.Depth
+				list = lists[parent.ID]
+			}
+		}
+		*list = append(*list, node)
+		nodes[comment.ID] = node
+		lists[comment.ID] = list
+	}
+	return pruneRemoved(roots)
+}
+
+// pruneRemoved drops removed comments that have no replies left to show
+func pruneRemoved(nodes []*commentNode) []*commentNode {
+	kept := nodes[:0]
+	for _, node := range nodes {
+		node.Replies = pruneRemoved(node.Replies)
+		if !node.Removed || len(node.Replies) > 0 {
+			kept = append(kept, node)
+		}
+	}
+	return kept
+}
+
+// commentContent validates a submitted comment, returning its trimmed text
+// or the key of an error in commentMessages
+func commentContent(r *http.Request) (content, problem string) {
+	content = strings.TrimSpace(r.FormValue("content"))
+	switch {
+	case content == "":
+		return "", "empty"
+	case utf8.RuneCountInString(content) > maxCommentLength:
+		return "", "too-long"
+	}
+	return content, ""
+}
+
+// commentsURL is the comment section of a post's page, with an optional
+// message from commentMessages
+func commentsURL(slug, message, anchor string) string {
+	url := "/post/" + slug
+	if message != "" {
+		url += "?comments=" + message
+	}
+	return url + "#" + anchor
+}
+
+// CreateCommentHandler adds a comment to a post, or a reply when parent_id
+// is set
+func (h *Handlers) CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if !commentLimiter.Allow(session.UserID) {
+		utils.LogError(fmt.Sprintf("Comment rate limit hit by user %s from IP %s", session.UserID, clientIP))
+		http.Error(w, "You are commenting too quickly. Please wait a minute and try again.", http.StatusTooManyRequests)
+		return
+	}
+
+	postID, _ := strconv.Atoi(r.FormValue("post_id"))
+	post, err := h.Posts.GetActiveByID(r.Context(), postID)
+	if err != nil {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return
+	}
+
+	comment := models.Comment{PostID: post.ID}
+	comment.AuthorID, _ = strconv.Atoi(session.UserID)
+	if raw := r.FormValue("parent_id"); raw != "" {
+		parentID, _ := strconv.Atoi(raw)
+		parent, err := h.Comments.GetByID(r.Context(), parentID)
+		// Deleted comments only stay to hold their replies in place
+		if err != nil || parent.PostID != post.ID || parent.Hidden || parent.Deleted {
+			http.Redirect(w, r, commentsURL(post.Slug, "parent", "comments"), http.StatusSeeOther)
+			return
+		}
+		comment.ParentID = &parent.ID
+	}
+
+	content, problem := commentContent(r)
+	if problem != "" {
+		http.Redirect(w, r, commentsURL(post.Slug, problem, "comments"), http.StatusSeeOther)
+		return
+	}
+	comment.Content = content
+
+	id, err := h.Comments.Create(r.Context(), comment)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Comment creation failed for user %s on post %d: %v", session.UserID, post.ID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %s commented on post %d (comment %d) from IP %s", session.UserID, post.ID, id, clientIP))
+	http.Redirect(w, r, commentsURL(post.Slug, "", fmt.Sprintf("comment-%d", id)), http.StatusSeeOther)
+}
+
+// EditCommentHandler lets the author change their comment
+func (h *Handlers) EditCommentHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	comment, err := h.Comments.GetByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	// Moderators hide comments rather than rewriting them
+	if strconv.Itoa(comment.AuthorID) != session.UserID || comment.Hidden {
+		utils.LogError(fmt.Sprintf("Unauthorized comment edit attempt: User %s tried to edit comment %d (owned by %d) from IP %s", session.UserID, id, comment.AuthorID, clientIP))
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	data := map[string]interface{}{"Comment": comment, "MaxLength": maxCommentLength}
+	if r.Method == "GET" {
+		h.renderTemplate(w, r, "edit_comment.html", data)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	content, problem := commentContent(r)
+	if problem != "" {
+		comment.Content = r.FormValue("content")
+		data["Comment"] = comment
+		data["Error"] = commentMessages[problem]
+		w.WriteHeader(http.StatusBadRequest)
+		h.renderTemplate(w, r, "edit_comment.html", data)
+		return
+	}
+	comment.Content = content
+	if err := h.Comments.Update(r.Context(), comment); err != nil {
+		utils.LogError(fmt.Sprintf("Comment update failed for user %s, comment %d: %v", session.UserID, id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %s edited comment %d from IP %s", session.UserID, id, clientIP))
+	http.Redirect(w, r, commentsURL(comment.PostSlug, "", fmt.Sprintf("comment-%d", id)), http.StatusSeeOther)
+}
+
+// DeleteCommentHandler deletes a comment for its author or a moderator.
+// Replies to it stay, under a placeholder.
+func (h *Handlers) DeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	comment, err := h.Comments.GetByID(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if !h.canModify(r, session, comment.AuthorID, database.PermModerateComments) {
+		utils.LogError(fmt.Sprintf("Unauthorized comment delete attempt: User %s tried to delete comment %d (owned by %d) from IP %s", session.UserID, id, comment.AuthorID, clientIP))
+		http.Error(w, "Unauthorized", http.StatusForbidden)
+		return
+	}
+
+	if err := h.Comments.SoftDelete(r.Context(), id); err != nil {
+		utils.LogError(fmt.Sprintf("Comment deletion failed for user %s, comment %d: %v", session.UserID, id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %s deleted comment %d from IP %s", session.UserID, id, clientIP))
+	h.audit(r, database.AuditCommentDelete, "comment", id, map[string]interface{}{
+		"author_id": comment.AuthorID,
+		"post_id":   comment.PostID,
+	})
+	h.afterModeration(w, r, comment, "deleted")
+}
+
+// AdminCommentsHandler lists the newest comments for moderators, or only
+// the hidden ones with ?filter=hidden
+func (h *Handlers) AdminCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	hiddenOnly := r.URL.Query().Get("filter") == "hidden"
+	comments, err := h.Comments.ListRecent(r.Context(), moderationPageSize, hiddenOnly)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get comments for moderation: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderTemplate(w, r, "admin_comments.html", map[string]interface{}{
+		"Comments":   comments,
+		"HiddenOnly": hiddenOnly,
+		"Success":    commentMessages[r.URL.Query().Get("success")],
+	})
+}
+
+// HideCommentHandler hides a comment from readers, or shows it again when
+// the form sends hidden=false. Replies to a hidden comment stay visible.
+func (h *Handlers) HideCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	hidden := r.FormValue("hidden") != "false"
+
+	comment, err := h.Comments.GetByID(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load comment %d: %v", id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	moderatorID, _ := strconv.Atoi(session.UserID)
+	if err := h.Comments.SetHidden(r.Context(), id, hidden, moderatorID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to moderate comment %d: %v", id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	action, message := database.AuditCommentHide, "hidden"
+	if !hidden {
+		action, message = database.AuditCommentShow, "shown"
+	}
+	h.audit(r, action, "comment", id, map[string]interface{}{
+		"author_id": comment.AuthorID,
+		"post_id":   comment.PostID,
+	})
+	h.afterModeration(w, r, comment, message)
+}
+
+// afterModeration returns to the moderation page when the action came from
+// there, and to the comment on its post otherwise
+func (h *Handlers) afterModeration(w http.ResponseWriter, r *http.Request, comment models.Comment, message string) {
+	if r.FormValue("from") == "admin" {
+		http.Redirect(w, r, "/admin/comments?success="+message, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, commentsURL(comment.PostSlug, message, fmt.Sprintf("comment-%d", comment.ID)), http.StatusSeeOther)
+}
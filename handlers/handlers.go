@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"database/sql"
+	"webapp/config"
+	"webapp/mailer"
+	"webapp/markdown"
+	"webapp/middleware"
+	"webapp/repository"
+)
+
+// Handlers serves the site's pages. Users, posts, comments, tags, invitation
+// codes, profile images, roles, failed logins and the audit trail are read
+// and written through the repositories, so tests can build a Handlers with
+// fakes in place of the database. Sessions logs users in and out; the app
+// shares it with the session middleware.
+type Handlers struct {
+	Users         repository.UserRepository
+	Posts         repository.PostRepository
+	Comments      repository.CommentRepository
+	Tags          repository.TagRepository
+	Invitations   repository.InvitationRepository
+	ProfileImages repository.ProfileImageRepository
+	Permissions   repository.PermissionRepository
+	Logins        repository.LoginRepository
+	Audit         repository.AuditRepository
+
+	Sessions  *middleware.Sessions
+	Config    *config.Config
+	Templates *Templates
+	Mailer    mailer.Mailer
+	// Rendered caches each post's Markdown as HTML, per revision
+	Rendered *markdown.Cache
+}
+
+// renderCacheSize is how many posts keep their rendered HTML in memory
+const renderCacheSize = 1000
+
+// New returns Handlers whose repositories use db and whose logins are kept
+// in sessions.
+func New(db *sql.DB, cfg *config.Config, templates *Templates, mail mailer.Mailer, sessions *middleware.Sessions) *Handlers {
+	return &Handlers{
+		Users:         repository.NewSQLUserRepository(db),
+		Posts:         repository.NewSQLPostRepository(db),
+		Comments:      repository.NewSQLCommentRepository(db),
+		Tags:          repository.NewSQLTagRepository(db),
+		Invitations:   repository.NewSQLInvitationRepository(db),
+		ProfileImages: repository.NewSQLProfileImageRepository(db),
+		Permissions:   repository.NewSQLPermissionRepository(db),
+		Logins:        repository.NewSQLLoginRepository(db),
+		Audit:         repository.NewSQLAuditRepository(db),
+		Sessions:      sessions,
+		Config:        cfg,
+		Templates:     templates,
+		Mailer:        mail,
+		Rendered:      markdown.NewCache(renderCacheSize),
+	}
+}
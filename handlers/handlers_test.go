@@ -0,0 +1,1111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"webapp/config"
+	"webapp/database"
+	"webapp/mailer"
+	"webapp/markdown"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+func TestMain(m *testing.M) {
+	discard := log.New(io.Discard, "", 0)
+	utils.InfoLogger, utils.ErrorLogger, utils.AuthLogger, utils.AuditLogger = discard, discard, discard, discard
+
+	var err error
+	if testTemplates, err = LoadTemplates("../templates"); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+var testTemplates *Templates
+
+// The fakes embed the interface they stand in for, so calling a method a
+// test didn't expect panics instead of passing silently.
+type fakeUsers struct {
+	repository.UserRepository
+	users   map[int]models.User
+	trashed []repository.TrashedUser
+	// lastAdmin is refused suspension, forced resets and deletion
+	lastAdmin int
+	// emailChanges are the pending new addresses by token hash
+	emailChanges map[string]emailChange
+}
+
+type emailChange struct {
+	userID   int
+	newEmail string
+}
+
+func (f *fakeUsers) GetByID(ctx context.Context, id int) (models.User, error) {
+	user, ok := f.users[id]
+	if !ok {
+		return models.User{}, repository.ErrNotFound
+	}
+	return user, nil
+}
+
+func (f *fakeUsers) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	for _, user := range f.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return models.User{}, repository.ErrNotFound
+}
+
+// GetByEmail ignores case, like the database's default collation
+func (f *fakeUsers) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	for _, user := range f.users {
+		if strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+	return models.User{}, repository.ErrNotFound
+}
+
+func (f *fakeUsers) CreatePasswordResetToken(ctx context.Context, id int, tokenHash string, expiresAt time.Time) error {
+	return nil
+}
+
+func (f *fakeUsers) ListTrashed(ctx context.Context) ([]repository.TrashedUser, error) {
+	return f.trashed, nil
+}
+
+func (f *fakeUsers) SetSuspended(ctx context.Context, id int, suspended bool) error {
+	if suspended && id == f.lastAdmin {
+		return repository.ErrLastAdmin
+	}
+	user := f.users[id]
+	user.SuspendedAt = nil
+	if suspended {
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+	f.users[id] = user
+	return nil
+}
+
+func (f *fakeUsers) RequirePasswordReset(ctx context.Context, id int) error {
+	if id == f.lastAdmin {
+		return repository.ErrLastAdmin
+	}
+	user := f.users[id]
+	user.ResetRequired = true
+	f.users[id] = user
+	return nil
+}
+
+func (f *fakeUsers) SoftDelete(ctx context.Context, id int) error {
+	if id == f.lastAdmin {
+		return repository.ErrLastAdmin
+	}
+	f.trashed = append(f.trashed, repository.TrashedUser{ID: id, Username: f.users[id].Username})
+	delete(f.users, id)
+	return nil
+}
+
+func (f *fakeUsers) EmailTaken(ctx context.Context, email string) (bool, error) {
+	_, err := f.GetByEmail(ctx, email)
+	return err == nil, nil
+}
+
+func (f *fakeUsers) CreateEmailChange(ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time) error {
+	if f.emailChanges == nil {
+		f.emailChanges = map[string]emailChange{}
+	}
+	f.emailChanges[tokenHash] = emailChange{id, newEmail}
+	return nil
+}
+
+// ApplyEmailChange uses the token up, and refuses an address another user
+// took in the meantime
+func (f *fakeUsers) ApplyEmailChange(ctx context.Context, tokenHash string) (int, error) {
+	change, ok := f.emailChanges[tokenHash]
+	if !ok {
+		return 0, repository.ErrNotFound
+	}
+	delete(f.emailChanges, tokenHash)
+	if taken, _ := f.EmailTaken(ctx, change.newEmail); taken {
+		return 0, repository.ErrEmailTaken
+	}
+	user := f.users[change.userID]
+	user.Email = change.newEmail
+	f.users[change.userID] = user
+	return change.userID, nil
+}
+
+// Restore and Purge only report whether the user is in the trash
+func (f *fakeUsers) Restore(ctx context.Context, id int) (bool, error) {
+	return slices.ContainsFunc(f.trashed, func(user repository.TrashedUser) bool { return user.ID == id }), nil
+}
+
+func (f *fakeUsers) Purge(ctx context.Context, id int) (bool, error) {
+	return f.Restore(ctx, id)
+}
+
+type fakePosts struct {
+	repository.PostRepository
+	posts    map[int]models.Post
+	oldSlugs map[string]int
+	trashed  []repository.TrashedPost
+	// createErr fails Create, as a database error would
+	createErr error
+}
+
+func (f *fakePosts) ListTrashed(ctx context.Context) ([]repository.TrashedPost, error) {
+	return f.trashed, nil
+}
+
+func (f *fakePosts) Restore(ctx context.Context, id int) (bool, error) {
+	return slices.ContainsFunc(f.trashed, func(post repository.TrashedPost) bool { return post.ID == id }), nil
+}
+
+func (f *fakePosts) Purge(ctx context.Context, id int) (bool, error) {
+	return f.Restore(ctx, id)
+}
+
+func (f *fakePosts) SoftDelete(ctx context.Context, id int) error {
+	delete(f.posts, id)
+	return nil
+}
+
+func (f *fakePosts) GetByID(ctx context.Context, id int) (models.Post, error) {
+	post, ok := f.posts[id]
+	if !ok {
+		return models.Post{}, repository.ErrNotFound
+	}
+	return post, nil
+}
+
+func (f *fakePosts) GetActiveByID(ctx context.Context, id int) (models.Post, error) {
+	return f.GetByID(ctx, id)
+}
+
+func (f *fakePosts) GetBySlug(ctx context.Context, slug string) (models.Post, error) {
+	for _, post := range f.posts {
+		if post.Slug == slug || f.oldSlugs[slug] == post.ID {
+			return post, nil
+		}
+	}
+	return models.Post{}, repository.ErrNotFound
+}
+
+func (f *fakePosts) Create(ctx context.Context, post models.Post) (int, error) {
+	if f.createErr != nil {
+		return 0, f.createErr
+	}
+	post.ID = len(f.posts) + 1
+	f.posts[post.ID] = post
+	return post.ID, nil
+}
+
+func (f *fakePosts) CountByAuthor(ctx context.Context, authorID int) (int, error) {
+	count := 0
+	for _, post := range f.posts {
+		if post.AuthorID == authorID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// ListByAuthor pages newest first by ID, honouring After only
+func (f *fakePosts) ListByAuthor(ctx context.Context, authorID int, request repository.PageRequest) (repository.Page, error) {
+	var page repository.Page
+	for id := len(f.posts); id > 0; id-- {
+		post, ok := f.posts[id]
+		if !ok || post.AuthorID != authorID || (request.After != nil && id >= request.After.ID) {
+			continue
+		}
+		if len(page.Posts) == request.Limit {
+			last := page.Posts[len(page.Posts)-1]
+			page.Older = &repository.Cursor{CreatedAt: last.CreatedAt, ID: last.ID}
+			break
+		}
+		page.Posts = append(page.Posts, post)
+	}
+	if request.After != nil && len(page.Posts) > 0 {
+		page.Newer = &repository.Cursor{CreatedAt: page.Posts[0].CreatedAt, ID: page.Posts[0].ID}
+	}
+	return page, nil
+}
+
+type fakeComments struct {
+	repository.CommentRepository
+	comments []models.Comment
+}
+
+func (f *fakeComments) ListByPost(ctx context.Context, postID int) ([]models.Comment, error) {
+	var comments []models.Comment
+	for _, comment := range f.comments {
+		if comment.PostID == postID {
+			comments = append(comments, comment)
+		}
+	}
+	return comments, nil
+}
+
+// GetByID returns Deleted comments too, standing in for comments whose
+// author is in the trash
+func (f *fakeComments) GetByID(ctx context.Context, id int) (models.Comment, error) {
+	for _, comment := range f.comments {
+		if comment.ID == id {
+			return comment, nil
+		}
+	}
+	return models.Comment{}, repository.ErrNotFound
+}
+
+func (f *fakeComments) Create(ctx context.Context, comment models.Comment) (int, error) {
+	comment.ID = len(f.comments) + 1
+	f.comments = append(f.comments, comment)
+	return comment.ID, nil
+}
+
+// fakePermissions grants permissions to users directly; roles only hold
+// names
+type fakePermissions struct {
+	repository.PermissionRepository
+	granted           map[int][]string
+	roles             map[int][]string
+	twoFactorRequired bool
+}
+
+func (f *fakePermissions) UserRoles(ctx context.Context, userID int) ([]string, error) {
+	return f.roles[userID], nil
+}
+
+func (f *fakePermissions) GrantRole(ctx context.Context, userID int, role string) error {
+	if !slices.Contains(f.roles[userID], role) {
+		f.roles[userID] = append(f.roles[userID], role)
+	}
+	return nil
+}
+
+// RevokeRole refuses to remove the only admin, like the real one
+func (f *fakePermissions) RevokeRole(ctx context.Context, userID int, role string) error {
+	if role == database.RoleAdmin {
+		if admins, _ := f.CountRoleMembers(ctx, role); admins <= 1 {
+			return repository.ErrLastAdmin
+		}
+	}
+	f.roles[userID] = slices.DeleteFunc(f.roles[userID], func(name string) bool { return name == role })
+	return nil
+}
+
+func (f *fakePermissions) CountRoleMembers(ctx context.Context, role string) (int, error) {
+	count := 0
+	for _, roles := range f.roles {
+		if slices.Contains(roles, role) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (f *fakePermissions) Permissions(ctx context.Context, userID int) (map[string]bool, error) {
+	permissions := make(map[string]bool)
+	for _, permission := range f.granted[userID] {
+		permissions[permission] = true
+	}
+	return permissions, nil
+}
+
+func (f *fakePermissions) HasPermission(ctx context.Context, userID int, permission string) (bool, error) {
+	return slices.Contains(f.granted[userID], permission), nil
+}
+
+func (f *fakePermissions) IsStaff(ctx context.Context, userID int) (bool, error) {
+	return len(f.granted[userID]) > 0, nil
+}
+
+func (f *fakePermissions) StaffTwoFactorRequired(ctx context.Context) (bool, error) {
+	return f.twoFactorRequired, nil
+}
+
+type fakeLogins struct {
+	repository.LoginRepository
+	lockedUntil map[string]time.Time
+	failures    map[string]int
+}
+
+func (f *fakeLogins) LockedUntil(ctx context.Context, username string) (time.Time, error) {
+	return f.lockedUntil[username], nil
+}
+
+func (f *fakeLogins) RecordFailure(ctx context.Context, username, ip string) (int, error) {
+	if f.failures == nil {
+		f.failures = map[string]int{}
+	}
+	f.failures[username]++
+	return f.failures[username], nil
+}
+
+func (f *fakeLogins) Clear(ctx context.Context, username string) (bool, error) {
+	cleared := f.failures[username] > 0
+	delete(f.failures, username)
+	return cleared, nil
+}
+
+type fakeAudit struct {
+	repository.AuditRepository
+	events []models.AuditEvent
+	// filter is the last one List was called with
+	filter repository.AuditFilter
+}
+
+// List ignores the filter apart from Limit, so tests can check how a
+// request was turned into one
+func (f *fakeAudit) List(ctx context.Context, filter repository.AuditFilter) ([]models.AuditEvent, error) {
+	f.filter = filter
+	events := f.events
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (f *fakeAudit) Record(ctx context.Context, event models.AuditEvent, metadata map[string]interface{}) error {
+	f.events = append(f.events, event)
+	return nil
+}
+
+// actions lists the recorded actions in order
+func (f *fakeAudit) actions() []string {
+	var actions []string
+	for _, event := range f.events {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
+
+func newTestHandlers() *Handlers {
+	return &Handlers{
+		Users: &fakeUsers{users: map[int]models.User{
+			7: {ID: 7, Username: "casper", Email: "casper@example.com", Bio: "Friendly", CreatedAt: time.Now()},
+		}},
+		Posts:       &fakePosts{posts: map[int]models.Post{}},
+		Comments:    &fakeComments{},
+		Permissions: &fakePermissions{roles: map[int][]string{}},
+		Logins:      &fakeLogins{},
+		Audit:       &fakeAudit{},
+		Sessions:    middleware.NewSessions(middleware.NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour),
+		Config:      config.Defaults(),
+		Templates:   testTemplates,
+		Mailer:      mailer.NewMemoryMailer(),
+		Rendered:    markdown.NewCache(10),
+	}
+}
+
+// logIn gives req a session for userID in h's session store
+func logIn(t *testing.T, h *Handlers, req *http.Request, userID string) {
+	t.Helper()
+	token := middleware.GenerateToken()
+	if err := h.Sessions.Store.Create(&middleware.Session{Token: token, UserID: userID, ExpireAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: middleware.SessionCookieName, Value: h.Sessions.SignToken(token)})
+}
+
+func postForm(path string, form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestCreatePostHandler(t *testing.T) {
+	h := newTestHandlers()
+	req := postForm("/post/create", url.Values{"title": {"Boo"}, "content": {"A haunting"}})
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.CreatePostHandler(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	post, err := h.Posts.GetByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal("post was not created")
+	}
+	if post.Title != "Boo" || post.Content != "A haunting" || post.AuthorID != 7 {
+		t.Errorf("created %+v", post)
+	}
+}
+
+func TestCreatePostHandlerHidesDatabaseErrors(t *testing.T) {
+	h := newTestHandlers()
+	h.Posts.(*fakePosts).createErr = errors.New("UNIQUE constraint failed: posts.slug")
+	req := postForm("/post/create", url.Values{"title": {"Boo"}, "content": {"A haunting"}})
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.CreatePostHandler(rec, req)
+
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "UNIQUE") {
+		t.Errorf("status %d, body %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreatePostHandlerRequiresLogin(t *testing.T) {
+	h := newTestHandlers()
+
+	rec := httptest.NewRecorder()
+	h.CreatePostHandler(rec, postForm("/post/create", url.Values{"title": {"Boo"}}))
+
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("got %d to %q, want a redirect to /login", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestEditPostHandlerMissingPost(t *testing.T) {
+	h := newTestHandlers()
+	req := httptest.NewRequest("GET", "/post/edit?id=42", nil)
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.EditPostHandler(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestProfileHandler(t *testing.T) {
+	h := newTestHandlers()
+	h.Posts.Create(context.Background(), models.Post{Title: "First", AuthorID: 7})
+	req := httptest.NewRequest("GET", "/profile", nil)
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.ProfileHandler(rec, req)
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "casper") || !strings.Contains(body, "Friendly") {
+		t.Errorf("status %d, profile page missing user details:\n%s", rec.Code, body)
+	}
+}
+
+func TestPublicProfileHandlerUnknownUser(t *testing.T) {
+	h := newTestHandlers()
+
+	rec := httptest.NewRecorder()
+	h.PublicProfileHandler(rec, httptest.NewRequest("GET", "/user?username=nobody", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestPreviewPostHandler(t *testing.T) {
+	h := newTestHandlers()
+	req := postForm("/post/preview", url.Values{"content": {"**boo** <script>alert(1)</script>"}})
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.PreviewPostHandler(rec, req)
+
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "<strong>boo</strong>") || strings.Contains(body, "<script") {
+		t.Errorf("status %d, preview %q", rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.PreviewPostHandler(rec, postForm("/post/preview", url.Values{"content": {"boo"}}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous preview: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestPublicProfileRendersMarkdown(t *testing.T) {
+	h := newTestHandlers()
+	h.Posts.Create(context.Background(), models.Post{Title: "First", Content: "## Haunted\n\n[home](javascript:alert(1))", AuthorID: 7, Revision: 1})
+
+	rec := httptest.NewRecorder()
+	h.PublicProfileHandler(rec, httptest.NewRequest("GET", "/user?username=casper", nil))
+
+	body := rec.Body.String()
+	if !strings.Contains(body, "Haunted</h2>") || strings.Contains(body, "javascript:alert") {
+		t.Errorf("post not rendered as sanitized Markdown:\n%s", body)
+	}
+}
+
+func TestPublicProfilePagination(t *testing.T) {
+	h := newTestHandlers()
+	h.Config.PageSize = 2
+	for _, title := range []string{"One", "Two", "Three"} {
+		h.Posts.Create(context.Background(), models.Post{Title: title, Content: title, AuthorID: 7, CreatedAt: time.Now()})
+	}
+
+	rec := httptest.NewRecorder()
+	h.PublicProfileHandler(rec, httptest.NewRequest("GET", "/user?username=casper", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Three") || strings.Contains(body, "One") || !strings.Contains(body, "&after=") || strings.Contains(body, "&before=") {
+		t.Fatalf("first page wrong:\n%s", body)
+	}
+
+	older := regexp.MustCompile(`after=([0-9-]+)`).FindStringSubmatch(body)[1]
+	rec = httptest.NewRecorder()
+	h.PublicProfileHandler(rec, httptest.NewRequest("GET", "/user?username=casper&after="+older, nil))
+	body = rec.Body.String()
+	if !strings.Contains(body, "One") || strings.Contains(body, "Three") || !strings.Contains(body, "&before=") || strings.Contains(body, "&after=") {
+		t.Errorf("second page wrong:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.PublicProfileHandler(rec, httptest.NewRequest("GET", "/user?username=casper&after=garbage", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("bad cursor: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestViewPostHandler(t *testing.T) {
+	h := newTestHandlers()
+	h.Posts = &fakePosts{
+		posts:    map[int]models.Post{1: {ID: 1, Title: "A Haunting", Slug: "a-haunting", Content: "**Boo** from the attic", AuthorID: 7, Username: "casper", Revision: 1}},
+		oldSlugs: map[string]int{"old-title": 1},
+	}
+	get := func(slug string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/post/"+slug, nil)
+		req.SetPathValue("slug", slug)
+		rec := httptest.NewRecorder()
+		h.ViewPostHandler(rec, req)
+		return rec
+	}
+
+	rec := get("a-haunting")
+	body := rec.Body.String()
+	for _, want := range []string{"<title>A Haunting - Dani's Blog</title>", `content="Boo from the attic"`, "<strong>Boo</strong>", `href="http://example.com/post/a-haunting"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("post page missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "/post/edit") {
+		t.Error("anonymous visitor offered the edit link")
+	}
+
+	if rec := get("old-title"); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/post/a-haunting" {
+		t.Errorf("old slug: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := get("nothing-here"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown slug: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestCommentThreads(t *testing.T) {
+	parent := func(id int) *int { return &id }
+	comments := []models.Comment{
+		{ID: 1, AuthorID: 7, Content: "first"},
+		{ID: 2, AuthorID: 8, Content: "reply", ParentID: parent(1)},
+		{ID: 3, AuthorID: 8, Content: "gone", Deleted: true},
+		{ID: 4, AuthorID: 8, Content: "deleted with a reply", Deleted: true},
+		{ID: 5, AuthorID: 7, Content: "reply to deleted", ParentID: parent(4)},
+		{ID: 6, AuthorID: 8, Content: "rude", Hidden: true},
+	}
+	// A chain deeper than maxCommentDepth
+	for id := 7; id <= 7+maxCommentDepth+1; id++ {
+		comments = append(comments, models.Comment{ID: id, AuthorID: 8, Content: "deep", ParentID: parent(id - 1)})
+	}
+	comments[6].ParentID = parent(2)
+
+	threads := commentThreads(comments, "7", false)
+	if len(threads) != 2 || threads[0].ID != 1 || threads[1].ID != 4 {
+		t.Fatalf("top-level comments = %+v", threads)
+	}
+	first := threads[0]
+	if !first.CanEdit || !first.CanDelete || !first.CanReply || first.CanModerate {
+		t.Errorf("author's own comment: %+v", first)
+	}
+	if reply := first.Replies[0]; reply.ID != 2 || reply.Depth != 1 || reply.CanEdit || reply.CanDelete {
+		t.Errorf("someone else's reply: %+v", reply)
+	}
+	if removed := threads[1]; !removed.Removed || removed.CanReply || len(removed.Replies) != 1 {
+		t.Errorf("deleted comment with a reply: %+v", removed)
+	}
+
+	// The deep chain stops indenting at maxCommentDepth
+	deepest := 0
+	var walk func(nodes []*commentNode)
+	walk = func(nodes []*commentNode) {
+		for _, node := range nodes {
+			if node.Depth > deepest {
+				deepest = node.Depth
+			}
+			walk(node.Replies)
+		}
+	}
+	walk(threads)
+	if deepest != maxCommentDepth {
+		t.Errorf("deepest reply at depth %d, want %d", deepest, maxCommentDepth)
+	}
+
+	// Moderators see hidden comments, with the controls to unhide them
+	moderated := commentThreads(comments, "9", true)
+	if len(moderated) != 3 || moderated[2].ID != 6 || moderated[2].Removed || !moderated[2].CanModerate || moderated[2].CanReply {
+		t.Errorf("moderator's view of a hidden comment: %+v", moderated[len(moderated)-1])
+	}
+}
+
+func TestCreateCommentHandler(t *testing.T) {
+	h := newTestHandlers()
+	h.Posts.Create(context.Background(), models.Post{Title: "A Haunting", Slug: "a-haunting", Content: "Boo", AuthorID: 7})
+	comment := func(form url.Values) *httptest.ResponseRecorder {
+		req := postForm("/comment/create", form)
+		logIn(t, h, req, "8")
+		rec := httptest.NewRecorder()
+		h.CreateCommentHandler(rec, req)
+		return rec
+	}
+
+	if rec := comment(url.Values{"post_id": {"1"}, "content": {"  "}}); rec.Header().Get("Location") != "/post/a-haunting?comments=empty#comments" {
+		t.Errorf("blank comment: Location = %q", rec.Header().Get("Location"))
+	}
+	if rec := comment(url.Values{"post_id": {"1"}, "content": {"Spooky!"}}); rec.Header().Get("Location") != "/post/a-haunting#comment-1" {
+		t.Errorf("comment: Location = %q", rec.Header().Get("Location"))
+	}
+	rec := comment(url.Values{"post_id": {"1"}, "parent_id": {"1"}, "content": {"Agreed"}})
+	if created := h.Comments.(*fakeComments).comments; rec.Code != http.StatusSeeOther || len(created) != 2 || *created[1].ParentID != 1 {
+		t.Errorf("reply: status %d, comments %+v", rec.Code, created)
+	}
+	if rec := comment(url.Values{"post_id": {"1"}, "parent_id": {"99"}, "content": {"Hello?"}}); !strings.Contains(rec.Header().Get("Location"), "comments=parent") {
+		t.Errorf("reply to a missing comment: Location = %q", rec.Header().Get("Location"))
+	}
+	// A comment whose author is in the trash stays, but can't get replies
+	h.Comments.(*fakeComments).comments = append(h.Comments.(*fakeComments).comments, models.Comment{ID: 3, PostID: 1, Deleted: true})
+	if rec := comment(url.Values{"post_id": {"1"}, "parent_id": {"3"}, "content": {"Hello?"}}); !strings.Contains(rec.Header().Get("Location"), "comments=parent") {
+		t.Errorf("reply to a deleted comment: Location = %q", rec.Header().Get("Location"))
+	}
+
+	// The burst allowance is used up by now
+	for i := 0; i < 5; i++ {
+		rec = comment(url.Values{"post_id": {"1"}, "content": {"flood"}})
+	}
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status after a burst = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags(" Ghost Stories, ghost-stories!, , Halloween,ÉTÉ ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tags, ",") != "ghost-stories,halloween,été" {
+		t.Errorf("parseTags = %q", tags)
+	}
+	if tags, err := parseTags(""); err != nil || tags != nil {
+		t.Errorf("no tags: %q, %v", tags, err)
+	}
+	if _, err := parseTags("a,b,c,d,e,f,g,h,i,j,k"); err != errTooManyTags {
+		t.Errorf("11 tags: err = %v, want errTooManyTags", err)
+	}
+}
+
+func TestTagCloud(t *testing.T) {
+	cloud := tagCloud([]models.Tag{{Name: "a", PostCount: 1}, {Name: "b", PostCount: 10}, {Name: "c", PostCount: 100}})
+	if cloud[0].Size != 1 || cloud[1].Size != 3 || cloud[2].Size != cloudSteps {
+		t.Errorf("sizes = %d, %d, %d", cloud[0].Size, cloud[1].Size, cloud[2].Size)
+	}
+	if cloud := tagCloud([]models.Tag{{Name: "a", PostCount: 4}, {Name: "b", PostCount: 4}}); cloud[0].Size != 1 || cloud[1].Size != 1 {
+		t.Errorf("equal counts sized %+v", cloud)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	h := newTestHandlers()
+	h.Config.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name, remote, xff, realIP, want string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"spoofed header from a client", "203.0.113.7:5000", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"through a trusted proxy", "10.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed entry before the proxy's", "10.0.0.1:5000", "1.2.3.4, 198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"real IP from a trusted proxy", "10.0.0.1:5000", "", "198.51.100.3", "198.51.100.3"},
+		{"IPv6", "[2001:db8::1]:5000", "198.51.100.1", "", "2001:db8::1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := h.clientIP(req); got != test.want {
+			t.Errorf("%s: clientIP = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAdminTrashHandler(t *testing.T) {
+	h := newTestHandlers()
+	h.Config.TrashRetention = 30 * 24 * time.Hour
+	deletedAt := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	h.Users.(*fakeUsers).trashed = []repository.TrashedUser{{ID: 8, Username: "spooky", Email: "spooky@example.com", DeletedAt: deletedAt}}
+	h.Posts.(*fakePosts).trashed = []repository.TrashedPost{{ID: 3, Title: "Old haunt", Author: "spooky", AuthorDeleted: true, DeletedAt: deletedAt}}
+
+	rec := httptest.NewRecorder()
+	h.AdminTrashHandler(rec, httptest.NewRequest("GET", "/admin/trash?success=restored", nil))
+	body := rec.Body.String()
+	for _, want := range []string{"spooky@example.com", "Old haunt", "(in trash)", "2024-10-31 12:00", "for 30 days", "Restored from the trash."} {
+		if !strings.Contains(body, want) {
+			t.Errorf("trash page is missing %q", want)
+		}
+	}
+}
+
+func TestTrashActions(t *testing.T) {
+	h := newTestHandlers()
+	h.Users.(*fakeUsers).trashed = []repository.TrashedUser{{ID: 8}}
+
+	for _, action := range []struct {
+		handler http.HandlerFunc
+		done    string
+		audited string
+	}{
+		{h.RestoreTrashHandler, "/admin/trash?success=restored", database.AuditUserRestore},
+		{h.PurgeTrashHandler, "/admin/trash?success=purged", database.AuditUserPurge},
+	} {
+		for _, tc := range []struct {
+			form     url.Values
+			status   int
+			location string
+		}{
+			{url.Values{"type": {"comment"}, "id": {"8"}}, http.StatusBadRequest, ""},
+			{url.Values{"type": {"user"}, "id": {"x"}}, http.StatusBadRequest, ""},
+			// Users outside the trash and posts that aren't there
+			{url.Values{"type": {"user"}, "id": {"7"}}, http.StatusSeeOther, "/admin/trash?error=missing"},
+			{url.Values{"type": {"post"}, "id": {"8"}}, http.StatusSeeOther, "/admin/trash?error=missing"},
+			{url.Values{"type": {"user"}, "id": {"8"}}, http.StatusSeeOther, action.done},
+		} {
+			rec := httptest.NewRecorder()
+			action.handler(rec, postForm("/admin/trash", tc.form))
+			if rec.Code != tc.status || rec.Header().Get("Location") != tc.location {
+				t.Errorf("%v: %d to %q, want %d to %q", tc.form, rec.Code, rec.Header().Get("Location"), tc.status, tc.location)
+			}
+		}
+		audit := h.Audit.(*fakeAudit)
+		if actions := audit.actions(); len(actions) != 1 || actions[0] != action.audited {
+			t.Errorf("audited %v, want only %s", actions, action.audited)
+		}
+		audit.events = nil
+	}
+}
+
+func TestUpdateUserRoleHandler(t *testing.T) {
+	h := newTestHandlers()
+	permissions := h.Permissions.(*fakePermissions)
+	permissions.roles[7] = []string{database.RoleAdmin}
+
+	for _, tc := range []struct {
+		action, role string
+		location     string
+	}{
+		{"grant", database.RoleModerator, "/admin/users?success=role_granted"},
+		{"revoke", database.RoleModerator, "/admin/users?success=role_revoked"},
+		{"revoke", database.RoleAdmin, "/admin/users?error=last_admin"},
+	} {
+		rec := httptest.NewRecorder()
+		h.UpdateUserRoleHandler(rec, postForm("/admin/users/role", url.Values{"user_id": {"7"}, "action": {tc.action}, "role": {tc.role}}))
+		if rec.Header().Get("Location") != tc.location {
+			t.Errorf("%s %s: redirected to %q, want %q", tc.action, tc.role, rec.Header().Get("Location"), tc.location)
+		}
+	}
+	if roles := permissions.roles[7]; fmt.Sprint(roles) != "[admin]" {
+		t.Errorf("roles = %v, want the admin role kept", roles)
+	}
+	want := []string{database.AuditRoleGrant, database.AuditRoleRevoke}
+	if actions := h.Audit.(*fakeAudit).actions(); !slices.Equal(actions, want) {
+		t.Errorf("audited %v, want %v", actions, want)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	h := newTestHandlers()
+	users := h.Users.(*fakeUsers)
+	users.users[8] = models.User{ID: 8, Username: "moderator"}
+	users.users[9] = models.User{ID: 9, Username: "admin", TOTPEnabled: true}
+	permissions := &fakePermissions{granted: map[int][]string{8: {database.PermViewDashboard}, 9: {database.PermViewDashboard}}}
+	h.Permissions = permissions
+	handler := h.RequirePermission(database.PermViewDashboard)(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	get := func(userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		if userID != "" {
+			logIn(t, h, req, userID)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+	if rec := get(""); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login" {
+		t.Errorf("anonymous: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := get("7"); rec.Code != http.StatusForbidden {
+		t.Errorf("member: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := get("8"); rec.Code != http.StatusTeapot {
+		t.Errorf("moderator: status = %d, want the page", rec.Code)
+	}
+
+	// With the 2FA policy on, only staff who enrolled get through
+	permissions.twoFactorRequired = true
+	if rec := get("8"); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/profile/2fa" {
+		t.Errorf("moderator without 2FA: %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := get("9"); rec.Code != http.StatusTeapot {
+		t.Errorf("admin with 2FA: status = %d, want the page", rec.Code)
+	}
+}
+
+func TestViewPostStaffControls(t *testing.T) {
+	h := newTestHandlers()
+	h.Users.(*fakeUsers).users[8] = models.User{ID: 8, Username: "moderator"}
+	h.Posts = &fakePosts{posts: map[int]models.Post{1: {ID: 1, Title: "A Haunting", Slug: "a-haunting", Content: "Boo", AuthorID: 7, Username: "casper", Revision: 1}}}
+	h.Permissions = &fakePermissions{granted: map[int][]string{8: {database.PermEditAnyPost}}}
+
+	get := func(userID string) string {
+		req := httptest.NewRequest("GET", "/post/a-haunting", nil)
+		req.SetPathValue("slug", "a-haunting")
+		logIn(t, h, req, userID)
+		rec := httptest.NewRecorder()
+		h.ViewPostHandler(rec, req)
+		return rec.Body.String()
+	}
+	if body := get("8"); !strings.Contains(body, "/post/edit?id=1") || strings.Contains(body, "/post/delete") {
+		t.Errorf("moderator should be offered edit but not delete:\n%s", body)
+	}
+	if body := get("7"); !strings.Contains(body, "/post/delete") {
+		t.Errorf("author should be offered delete:\n%s", body)
+	}
+}
+
+func TestLoginLockedAccount(t *testing.T) {
+	h := newTestHandlers()
+	h.Logins = &fakeLogins{lockedUntil: map[string]time.Time{"casper": time.Now().Add(time.Hour)}}
+
+	rec := httptest.NewRecorder()
+	h.LoginHandler(rec, postForm("/login", url.Values{"username": {"casper"}, "password": {"secret123"}}))
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "temporarily locked") {
+		t.Errorf("locked account: status %d\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestForgotPasswordMailsTheAccountAddress(t *testing.T) {
+	h := newTestHandlers()
+
+	rec := httptest.NewRecorder()
+	h.ForgotPasswordHandler(rec, postForm("/forgot-password", url.Values{"email": {"CASPER@example.com"}}))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	messages := h.Mailer.(*mailer.MemoryMailer).Messages()
+	if len(messages) != 1 || messages[0].To != "casper@example.com" {
+		t.Errorf("sent %+v, want one message to the address on the account", messages)
+	}
+}
+
+func TestChangeAndVerifyEmail(t *testing.T) {
+	h := newTestHandlers()
+	users := h.Users.(*fakeUsers)
+	hash, err := middleware.HashPassword("secret123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A name of its own, so the attempts don't count against casper's
+	// rate limit in other tests
+	user := users.users[7]
+	user.Username, user.Password = "wisp", hash
+	users.users[7] = user
+	users.users[8] = models.User{ID: 8, Username: "spooky", Email: "spooky@example.com"}
+
+	change := func(password, newEmail string) string {
+		t.Helper()
+		req := postForm("/profile/email", url.Values{"current_password": {password}, "new_email": {newEmail}})
+		logIn(t, h, req, "7")
+		rec := httptest.NewRecorder()
+		h.ChangeEmailHandler(rec, req)
+		return rec.Header().Get("Location")
+	}
+	for _, tc := range []struct{ password, newEmail, location string }{
+		{"wrong", "ghost@example.com", "/edit-profile?error=wrong_password#account"},
+		{"secret123", "not-an-address", "/edit-profile?error=invalid_email#account"},
+		{"secret123", "CASPER@example.com", "/edit-profile?error=same_email#account"},
+		{"secret123", "spooky@example.com", "/edit-profile?error=email_taken#account"},
+	} {
+		if location := change(tc.password, tc.newEmail); location != tc.location {
+			t.Errorf("changing to %q with password %q redirected to %q, want %q", tc.newEmail, tc.password, location, tc.location)
+		}
+	}
+
+	if location := change("secret123", "ghost@example.com"); location != "/edit-profile?success=email_sent#account" {
+		t.Fatalf("redirected to %q", location)
+	}
+	messages := h.Mailer.(*mailer.MemoryMailer).Messages()
+	if len(messages) != 1 || messages[0].To != "ghost@example.com" {
+		t.Fatalf("sent %+v, want one message to the new address", messages)
+	}
+	if users.users[7].Email != "casper@example.com" {
+		t.Fatal("email changed before it was verified")
+	}
+	link := regexp.MustCompile(`/profile/verify-email\?token=\S+`).FindString(messages[0].Body)
+
+	verify := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.VerifyEmailHandler(rec, httptest.NewRequest("GET", link, nil))
+		return rec
+	}
+	if rec := verify(); rec.Code != http.StatusSeeOther || users.users[7].Email != "ghost@example.com" {
+		t.Fatalf("verify: status %d, email %q", rec.Code, users.users[7].Email)
+	}
+	// The wrong password counts as a failed login
+	if actions := h.Audit.(*fakeAudit).actions(); !slices.Equal(actions, []string{database.AuditLoginFailure, database.AuditEmailChange}) {
+		t.Errorf("audited %v", actions)
+	}
+	if rec := verify(); rec.Code != http.StatusBadRequest {
+		t.Errorf("reused link: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	// Someone else took the address between the request and the link
+	change("secret123", "phantom@example.com")
+	link = regexp.MustCompile(`/profile/verify-email\?token=\S+`).FindString(h.Mailer.(*mailer.MemoryMailer).Messages()[1].Body)
+	users.users[9] = models.User{ID: 9, Username: "phantom", Email: "phantom@example.com"}
+	if rec := verify(); rec.Code != http.StatusConflict || users.users[7].Email != "ghost@example.com" {
+		t.Errorf("taken address: status %d, email %q", rec.Code, users.users[7].Email)
+	}
+}
+
+func TestManageUserHandlers(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		handler  func(*Handlers, http.ResponseWriter, *http.Request)
+		form     url.Values
+		location string
+		audited  string
+		// revoked says whether the target's sessions should be gone
+		revoked bool
+	}{
+		{"suspend self", (*Handlers).SuspendUserHandler, url.Values{"user_id": {"7"}, "action": {"suspend"}}, "/admin/users?error=self_action", "", false},
+		{"suspend last admin", (*Handlers).SuspendUserHandler, url.Values{"user_id": {"8"}, "action": {"suspend"}}, "/admin/users?error=last_admin", "", false},
+		{"suspend", (*Handlers).SuspendUserHandler, url.Values{"user_id": {"9"}, "action": {"suspend"}}, "/admin/users?success=suspended", database.AuditUserSuspend, true},
+		{"reactivate", (*Handlers).SuspendUserHandler, url.Values{"user_id": {"9"}, "action": {"reactivate"}}, "/admin/users?success=reactivated", database.AuditUserReactivate, false},
+		{"force reset on last admin", (*Handlers).ForcePasswordResetHandler, url.Values{"user_id": {"8"}}, "/admin/users?error=last_admin", "", false},
+		{"force reset", (*Handlers).ForcePasswordResetHandler, url.Values{"user_id": {"9"}}, "/admin/users?success=reset_forced", database.AuditUserForceReset, true},
+		{"delete self", (*Handlers).DeleteUserHandler, url.Values{"user_id": {"7"}, "confirm_username": {"casper"}}, "/admin/users?error=self_action", "", false},
+		{"delete last admin", (*Handlers).DeleteUserHandler, url.Values{"user_id": {"8"}, "confirm_username": {"admin"}}, "/admin/users?error=last_admin", "", false},
+		{"delete unconfirmed", (*Handlers).DeleteUserHandler, url.Values{"user_id": {"9"}, "confirm_username": {"Spooky"}}, "/admin/users/delete?id=9&error=confirm_mismatch", "", false},
+		{"delete", (*Handlers).DeleteUserHandler, url.Values{"user_id": {"9"}, "confirm_username": {"spooky"}}, "/admin/users?success=deleted", database.AuditUserDelete, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandlers()
+			users := h.Users.(*fakeUsers)
+			users.users[8] = models.User{ID: 8, Username: "admin", Email: "admin@example.com"}
+			users.users[9] = models.User{ID: 9, Username: "spooky", Email: "spooky@example.com"}
+			users.lastAdmin = 8
+
+			req := postForm("/admin/users", tc.form)
+			logIn(t, h, req, "7")
+			target := tc.form.Get("user_id")
+			token := middleware.GenerateToken()
+			h.Sessions.Store.Create(&middleware.Session{Token: token, UserID: target, ExpireAt: time.Now().Add(time.Hour)})
+
+			rec := httptest.NewRecorder()
+			tc.handler(h, rec, req)
+			if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != tc.location {
+				t.Fatalf("%d to %q, want a redirect to %q", rec.Code, rec.Header().Get("Location"), tc.location)
+			}
+
+			var want []string
+			if tc.audited != "" {
+				want = []string{tc.audited}
+			}
+			if actions := h.Audit.(*fakeAudit).actions(); !slices.Equal(actions, want) {
+				t.Errorf("audited %v, want %v", actions, want)
+			}
+			if _, loggedIn := h.Sessions.Store.Lookup(token); loggedIn == tc.revoked {
+				t.Errorf("target still logged in = %t, want %t", loggedIn, !tc.revoked)
+			}
+		})
+	}
+}
+
+func TestDeletePostIsAudited(t *testing.T) {
+	h := newTestHandlers()
+	h.Users.(*fakeUsers).users[8] = models.User{ID: 8, Username: "moderator"}
+	h.Permissions = &fakePermissions{granted: map[int][]string{8: {database.PermDeleteAnyPost}}}
+	h.Posts.Create(context.Background(), models.Post{Title: "Boo", AuthorID: 7})
+
+	req := postForm("/post/delete", url.Values{"id": {"1"}})
+	req.Header.Set("User-Agent", "ouija")
+	logIn(t, h, req, "8")
+	rec := httptest.NewRecorder()
+	h.DeletePostHandler(rec, req)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("status = %d\n%s", rec.Code, rec.Body.String())
+	}
+
+	events := h.Audit.(*fakeAudit).events
+	if len(events) != 1 {
+		t.Fatalf("recorded %+v, want one event", events)
+	}
+	event := events[0]
+	if event.Action != database.AuditPostDelete || event.ActorID == nil || *event.ActorID != 8 || event.ActorName != "moderator" ||
+		event.TargetType != "post" || event.TargetID != "1" || event.UserAgent != "ouija" {
+		t.Errorf("recorded %+v", event)
+	}
+}
+
+func TestAdminAuditHandler(t *testing.T) {
+	h := newTestHandlers()
+	audit := h.Audit.(*fakeAudit)
+	for i := 0; i < auditPageSize+1; i++ {
+		audit.events = append(audit.events, models.AuditEvent{ID: int64(i + 1), ActorName: "casper", Action: database.AuditUserSuspend})
+	}
+	req := httptest.NewRequest("GET", "/admin/audit?actor=casper&action=user&target_type=user&target_id=8&since=2024-10-01&until=2024-10-31&page=2", nil)
+	logIn(t, h, req, "7")
+
+	rec := httptest.NewRecorder()
+	h.AdminAuditHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	want := repository.AuditFilter{
+		Actor: "casper", Action: "user", TargetType: "user", TargetID: "8",
+		Since: time.Date(2024, 10, 1, 0, 0, 0, 0, time.UTC),
+		// Until includes the whole day
+		Until: time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC),
+		Limit: auditPageSize + 1, Offset: auditPageSize,
+	}
+	if audit.filter != want {
+		t.Errorf("filter = %+v, want %+v", audit.filter, want)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "page=3") || !strings.Contains(body, "page=1") {
+		t.Errorf("audit page is missing its page links:\n%s", body)
+	}
+}
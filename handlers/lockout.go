@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"webapp/middleware"
+	"webapp/utils"
+)
+
+var (
+	// Token buckets for /login: per client IP and per submitted username
+	loginIPLimiter       = middleware.NewRateLimiter(20, time.Minute)
+	loginUsernameLimiter = middleware.NewRateLimiter(10, time.Minute)
+)
+
+// accountLockedUntil reports whether username is locked out and until when.
+// Errors are logged and leave the account unlocked.
+func (h *Handlers) accountLockedUntil(ctx context.Context, username string) (time.Time, bool) {
+	lockedUntil, err := h.Logins.LockedUntil(ctx, username)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to check lockout for user %s: %v", username, err))
+		return time.Time{}, false
+	}
+	return lockedUntil, !lockedUntil.IsZero()
+}
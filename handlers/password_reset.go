@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"webapp/database"
+	"webapp/mailer"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/utils"
+)
+
+const passwordResetLifetime = time.Hour
+
+// Limits how many reset emails one IP can trigger
+var passwordResetLimiter = middleware.NewRateLimiter(5, time.Hour)
+
+// baseURL is used to build links in emails. APP_URL is required in
+// production so a forged Host header can't redirect reset links.
+func (h *Handlers) baseURL(r *http.Request) string {
+	if h.Config.BaseURL != "" {
+		return h.Config.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// sendPasswordResetEmail creates a reset token and mails the link to the
+// address on the account. Never use the address the visitor typed: the
+// lookup ignores case and accents, so it may not be the account's.
+func (h *Handlers) sendPasswordResetEmail(r *http.Request, user models.User) error {
+	token := middleware.GenerateToken()
+	err := h.Users.CreatePasswordResetToken(r.Context(), user.ID, middleware.HashToken(token), time.Now().Add(passwordResetLifetime))
+	if err != nil {
+		return err
+	}
+
+	link := h.baseURL(r) + "/reset-password?token=" + url.QueryEscape(token)
+	return h.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account.\n"+
+			"Open this link within the next hour to choose a new one:\n\n%s\n\n"+
+			"If it wasn't you, ignore this email and your password stays the same.\n",
+			user.Username, link),
+	})
+}
+
+func (h *Handlers) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		h.renderTemplate(w, r, "forgot_password.html", nil)
+		return
+	}
+
+	if r.Method == "POST" {
+		email := strings.TrimSpace(r.PostFormValue("email"))
+		clientIP := h.clientIP(r)
+
+		if !passwordResetLimiter.Allow(clientIP) {
+			utils.LogError(fmt.Sprintf("Password reset rate limit hit from IP %s", clientIP))
+			http.Error(w, "Too many reset requests. Please try again later.", http.StatusTooManyRequests)
+			return
+		}
+
+		user, err := h.Users.GetByEmail(r.Context(), email)
+		if err == nil {
+			if err := h.sendPasswordResetEmail(r, user); err != nil {
+				utils.LogError(fmt.Sprintf("Failed to send password reset for user %s: %v", user.Username, err))
+			} else {
+				utils.LogAuth("PASSWORD_RESET_REQUEST", user.Username, clientIP, true)
+			}
+		} else {
+			utils.LogAuth("PASSWORD_RESET_REQUEST", email, clientIP, false)
+		}
+
+		// Same answer either way, so the form can't be used to find accounts
+		h.renderTemplate(w, r, "forgot_password.html", map[string]interface{}{
+			"Sent": true,
+		})
+	}
+}
+
+func (h *Handlers) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	clientIP := h.clientIP(r)
+
+	user, err := h.Users.GetByPasswordResetToken(r.Context(), middleware.HashToken(token))
+	if err != nil {
+		h.renderTemplate(w, r, "reset_password.html", map[string]interface{}{
+			"Invalid": true,
+		})
+		return
+	}
+
+	if r.Method == "GET" {
+		h.renderTemplate(w, r, "reset_password.html", map[string]interface{}{
+			"Token": token,
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		password := r.PostFormValue("password")
+		if len(password) < 6 || password != r.PostFormValue("confirm_password") {
+			h.renderTemplate(w, r, "reset_password.html", map[string]interface{}{
+				"Token": token,
+				"Error": "Passwords must match and be at least 6 characters",
+			})
+			return
+		}
+
+		hashPassword, err := middleware.HashPassword(password)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Password hashing failed for user %s: %v", user.Username, err))
+			http.Error(w, "Error Creating Password", http.StatusInternalServerError)
+			return
+		}
+
+		reset, err := h.Users.ResetPassword(r.Context(), user.ID, middleware.HashToken(token), hashPassword)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to reset password for user %s: %v", user.Username, err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !reset {
+			h.renderTemplate(w, r, "reset_password.html", map[string]interface{}{
+				"Invalid": true,
+			})
+			return
+		}
+
+		// Whoever had the old password shouldn't stay logged in
+		if _, err := h.Sessions.Store.RevokeAllForUser(fmt.Sprintf("%d", user.ID)); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to revoke sessions for user %s: %v", user.Username, err))
+		}
+		h.Logins.Clear(r.Context(), user.Username)
+
+		utils.LogAuth("PASSWORD_RESET", user.Username, clientIP, true)
+		h.auditAs(r, user.ID, user.Username, database.AuditPasswordReset, "user", user.ID, nil)
+		http.Redirect(w, r, "/login?reset=1", http.StatusSeeOther)
+	}
+}
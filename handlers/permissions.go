@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"webapp/middleware"
+	"webapp/utils"
+)
+
+// RequirePermission only lets through logged-in users whose roles grant
+// permission.
+func (h *Handlers) RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			session, exists := h.Sessions.Get(r)
+			if !exists {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+
+			userID, _ := strconv.Atoi(session.UserID)
+			if !h.hasPermission(r.Context(), userID, permission) {
+				http.Error(w, "Access denied. You don't have permission to view this page.", http.StatusForbidden)
+				return
+			}
+
+			// Staff must enroll in 2FA first when the site policy requires it
+			if h.missingStaffTwoFactor(r.Context(), userID) {
+				http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
+
+// hasPermission reports whether the user's roles grant permission. Errors
+// are logged and deny it.
+func (h *Handlers) hasPermission(ctx context.Context, userID int, permission string) bool {
+	allowed, err := h.Permissions.HasPermission(ctx, userID, permission)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to check permission %s for user %d: %v", permission, userID, err))
+	}
+	return allowed && err == nil
+}
+
+// isStaff reports whether the user holds any role. Errors are logged and
+// count as staff, so the 2FA policy isn't skipped by accident.
+func (h *Handlers) isStaff(ctx context.Context, userID int) bool {
+	staff, err := h.Permissions.IsStaff(ctx, userID)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to look up roles for user %d: %v", userID, err))
+		return true
+	}
+	return staff
+}
+
+// missingStaffTwoFactor reports whether the site requires 2FA for staff and
+// the user hasn't enrolled yet. Check it before letting a user act on a
+// permission their role grants.
+func (h *Handlers) missingStaffTwoFactor(ctx context.Context, userID int) bool {
+	if !h.adminTwoFactorRequired(ctx) {
+		return false
+	}
+	user, err := h.Users.GetByID(ctx, userID)
+	return err != nil || !user.TOTPEnabled
+}
+
+// canModify allows the author of a post or comment, or staff whose role
+// grants permission and who have 2FA when the site requires it
+func (h *Handlers) canModify(r *http.Request, session middleware.Session, authorID int, permission string) bool {
+	if strconv.Itoa(authorID) == session.UserID {
+		return true
+	}
+	userID, _ := strconv.Atoi(session.UserID)
+	return h.hasPermission(r.Context(), userID, permission) && !h.missingStaffTwoFactor(r.Context(), userID)
+}
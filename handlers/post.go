@@ -1,19 +1,20 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
-	"time"
+	"strconv"
 	"webapp/database"
-	"webapp/middleware"
+	"webapp/markdown"
 	"webapp/models"
+	"webapp/repository"
 	"webapp/utils"
 )
 
-func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
-	clientIP := getClientIP(r)
+func (h *Handlers) HomeHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
 
 	// Log page view
 	if loggedIn {
@@ -22,36 +23,25 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		utils.LogInfo(fmt.Sprintf("Anonymous user viewed home page from IP %s", clientIP))
 	}
 
-	rows, err := database.DB.Query(`SELECT p.id, p.title, p.content, p.author_id, u.username, p.created_at, p.updated_at
-		FROM posts p JOIN users u ON p.author_id = u.id
-		ORDER BY p.created_at DESC`)
-
+	request, err := h.pageRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Invalid page", http.StatusBadRequest)
 		return
-
 	}
-	defer rows.Close()
-	var posts []models.Post
-	for rows.Next() {
-		var post models.Post
-		var createdAtStr, updatedAtStr string
-
-		// note for myself: MySQL returns timestamps as []uint8, need to scan as string first
-		// then parse using Go's reference time format "2006-01-02 15:04:05"
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID, &post.Username, &createdAtStr, &updatedAtStr)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Parse timestamp strings to time.Time
-		post.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAtStr)
-		post.UpdatedAt, _ = time.Parse("2006-01-02 15:04:05", updatedAtStr)
-
-		posts = append(posts, post)
+	page, err := h.Posts.List(r.Context(), request)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to list posts: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
-	tmpl := template.Must(template.ParseFiles("templates/home.html"))
+	if len(page.Posts) == 0 && request.After != nil {
+		// The posts past the cursor were deleted since the link was made
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	posts := page.Posts
+	h.renderPosts(posts)
+
 	// note for myself: Fixed syntax error - map[string]interface{} needs {} after interface
 	// PROBLEM: "unexpected literal 'Posts', expected ~ term or type"
 	// CAUSE: Missing {} after interface in map declaration
@@ -60,12 +50,142 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 		"LoggedIn": loggedIn,
 		"UserID":   session.UserID,
 	}
-	tmpl.Execute(w, data)
+	pageLinks(data, page)
+	// The page still works without the cloud
+	if tags, err := h.Tags.Cloud(r.Context(), cloudSize); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load the tag cloud: %v", err))
+	} else {
+		data["TagCloud"] = tagCloud(tags)
+	}
+	if loggedIn {
+		userID, _ := strconv.Atoi(session.UserID)
+		permissions, err := h.Permissions.Permissions(r.Context(), userID)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to get permissions for user %d: %v", userID, err))
+		}
+		data["CanEditAny"] = permissions[database.PermEditAnyPost]
+		data["CanDeleteAny"] = permissions[database.PermDeleteAnyPost]
+	}
+	h.renderTemplate(w, r, "home.html", data)
 }
 
-func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
-	clientIP := getClientIP(r)
+// pageRequest reads which page of posts to show from the after or before
+// cursor in the query string
+func (h *Handlers) pageRequest(r *http.Request) (repository.PageRequest, error) {
+	request := repository.PageRequest{Limit: h.Config.PageSize}
+	query := r.URL.Query()
+	if after := query.Get("after"); after != "" {
+		cursor, err := repository.ParseCursor(after)
+		if err != nil {
+			return request, err
+		}
+		request.After = &cursor
+	} else if before := query.Get("before"); before != "" {
+		cursor, err := repository.ParseCursor(before)
+		if err != nil {
+			return request, err
+		}
+		request.Before = &cursor
+	}
+	return request, nil
+}
+
+// pageLinks adds the cursors of the neighbouring pages to template data as
+// Older and Newer
+func pageLinks(data map[string]interface{}, page repository.Page) {
+	if page.Older != nil {
+		data["Older"] = page.Older.String()
+	}
+	if page.Newer != nil {
+		data["Newer"] = page.Newer.String()
+	}
+}
+
+// renderPosts fills in each post's HTML from its Markdown
+func (h *Handlers) renderPosts(posts []models.Post) {
+	for i := range posts {
+		posts[i].HTML = h.Rendered.Render(posts[i].ID, posts[i].Revision, posts[i].Content)
+	}
+}
+
+// PreviewPostHandler renders Markdown from the post forms as it is typed.
+// The HTML is sanitized exactly like a published post.
+func (h *Handlers) PreviewPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, loggedIn := h.Sessions.Get(r); !loggedIn {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write([]byte(markdown.Render(r.FormValue("content"))))
+}
+
+// ViewPostHandler shows one post at /post/{slug}. A slug the post had
+// before its title was edited redirects to the current one.
+func (h *Handlers) ViewPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	slug := r.PathValue("slug")
+	post, err := h.Posts.GetBySlug(r.Context(), slug)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load post %q: %v", slug, err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if post.Slug != slug {
+		http.Redirect(w, r, "/post/"+post.Slug, http.StatusMovedPermanently)
+		return
+	}
+	post.HTML = h.Rendered.Render(post.ID, post.Revision, post.Content)
+
+	session, loggedIn := h.Sessions.Get(r)
+	utils.LogInfo(fmt.Sprintf("Post '%s' (ID: %d) viewed from IP %s", post.Title, post.ID, h.clientIP(r)))
+
+	comments, err := h.Comments.ListByPost(r.Context(), post.ID)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load comments on post %d: %v", post.ID, err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Post":             post,
+		"Description":      markdown.Summary(post.Content, descriptionLength),
+		"URL":              h.baseURL(r) + "/post/" + post.Slug,
+		"LoggedIn":         loggedIn,
+		"CommentMessage":   commentMessages[r.URL.Query().Get("comments")],
+		"MaxCommentLength": maxCommentLength,
+	}
+	viewerID, canModerate := "", false
+	if loggedIn {
+		userID, _ := strconv.Atoi(session.UserID)
+		viewerID, canModerate = session.UserID, h.hasPermission(r.Context(), userID, database.PermModerateComments)
+		data["CanEdit"] = h.canModify(r, session, post.AuthorID, database.PermEditAnyPost)
+		data["CanDelete"] = h.canModify(r, session, post.AuthorID, database.PermDeleteAnyPost)
+	}
+	data["Comments"] = commentThreads(comments, viewerID, canModerate)
+	h.renderTemplate(w, r, "post.html", data)
+}
+
+// descriptionLength is about as much of a meta description as search
+// results show
+const descriptionLength = 160
+
+func (h *Handlers) CreatePostHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
 
 	if !loggedIn {
 		utils.LogError(fmt.Sprintf("Unauthorized post creation attempt from IP %s", clientIP))
@@ -75,19 +195,24 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		utils.LogInfo(fmt.Sprintf("User %s accessed create post page from IP %s", session.UserID, clientIP))
-		tmpl := template.Must(template.ParseFiles("templates/create_post.html"))
-		tmpl.Execute(w, nil)
+		h.renderTemplate(w, r, "create_post.html", nil)
 		return
 	}
 
 	if r.Method == "POST" {
 		title := r.FormValue("title")
 		content := r.FormValue("content")
+		tags, err := parseTags(r.FormValue("tags"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		_, err := database.DB.Exec("INSERT INTO posts (title, content, author_id) VALUES (?, ?, ?)", title, content, session.UserID)
+		authorID, _ := strconv.Atoi(session.UserID)
+		_, err = h.Posts.Create(r.Context(), models.Post{Title: title, Content: content, Tags: tags, AuthorID: authorID})
 		if err != nil {
 			utils.LogError(fmt.Sprintf("Post creation failed for user %s: %v", session.UserID, err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
@@ -97,9 +222,9 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func EditPostHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
-	clientIP := getClientIP(r)
+func (h *Handlers) EditPostHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
 
 	if !loggedIn {
 		utils.LogError(fmt.Sprintf("Unauthorized edit attempt from IP %s", clientIP))
@@ -108,15 +233,15 @@ func EditPostHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	postID := r.URL.Query().Get("id")
-	var post models.Post
+	id, _ := strconv.Atoi(postID)
 
-	err := database.DB.QueryRow("SELECT id, title, content, author_id FROM posts WHERE id = ?", postID).Scan(&post.ID, &post.Title, &post.Content, &post.AuthorID)
+	post, err := h.Posts.GetByID(r.Context(), id)
 	if err != nil {
-		utils.LogError(fmt.Sprintf("Post not found for edit: ID %s by user %s from IP %s", postID, session.UserID, clientIP))
-		http.Error(w, err.Error(), http.StatusNotFound)
+		utils.LogError(fmt.Sprintf("Post not found for edit: ID %s by user %s from IP %s: %v", postID, session.UserID, clientIP, err))
+		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
-	if fmt.Sprintf("%d", post.AuthorID) != session.UserID {
+	if !h.canModify(r, session, post.AuthorID, database.PermEditAnyPost) {
 		utils.LogError(fmt.Sprintf("Unauthorized edit attempt: User %s tried to edit post %s (owned by %d) from IP %s", session.UserID, postID, post.AuthorID, clientIP))
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
@@ -124,31 +249,46 @@ func EditPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		utils.LogInfo(fmt.Sprintf("User %s accessed edit page for post '%s' (ID: %s) from IP %s", session.UserID, post.Title, postID, clientIP))
-		tmpl := template.Must(template.ParseFiles("templates/edit_post.html"))
-		tmpl.Execute(w, post)
+		h.renderTemplate(w, r, "edit_post.html", post)
 		return
 	}
 
 	if r.Method == "POST" {
 		title := r.FormValue("title")
 		content := r.FormValue("content")
-
-		_, err := database.DB.Exec("UPDATE posts SET title = ?, content = ? WHERE id = ?", title, content, postID)
+		tags, err := parseTags(r.FormValue("tags"))
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		oldTitle := post.Title
+		post.Title, post.Content, post.Tags = title, content, tags
+		if err := h.Posts.Update(r.Context(), post); err != nil {
 			utils.LogError(fmt.Sprintf("Post update failed for user %s, post %s: %v", session.UserID, postID, err))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
 		// Log successful post update
 		utils.LogInfo(fmt.Sprintf("User %s updated post '%s' (ID: %s) from IP %s", session.UserID, title, postID, clientIP))
+		h.audit(r, database.AuditPostUpdate, "post", post.ID, map[string]interface{}{
+			"author_id": post.AuthorID,
+			"old_title": oldTitle,
+			"title":     title,
+		})
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 	}
 }
 
-func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
-	clientIP := getClientIP(r)
+func (h *Handlers) DeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	clientIP := h.clientIP(r)
 
 	if !loggedIn {
 		utils.LogError(fmt.Sprintf("Unauthorized delete attempt from IP %s", clientIP))
@@ -156,32 +296,36 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	postID := r.URL.Query().Get("id")
-	var authorID string
-	var postTitle string
+	postID := r.FormValue("id")
+	id, _ := strconv.Atoi(postID)
 
 	// Get post title for logging
-	err := database.DB.QueryRow("SELECT author_id, title FROM posts WHERE id = ?", postID).Scan(&authorID, &postTitle)
+	post, err := h.Posts.GetByID(r.Context(), id)
 	if err != nil {
 		utils.LogError(fmt.Sprintf("Post not found for deletion: ID %s by user %s from IP %s", postID, session.UserID, clientIP))
 		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
-	if authorID != session.UserID {
-		utils.LogError(fmt.Sprintf("Unauthorized delete attempt: User %s tried to delete post %s (owned by %s) from IP %s", session.UserID, postID, authorID, clientIP))
+	if !h.canModify(r, session, post.AuthorID, database.PermDeleteAnyPost) {
+		utils.LogError(fmt.Sprintf("Unauthorized delete attempt: User %s tried to delete post %s (owned by %d) from IP %s", session.UserID, postID, post.AuthorID, clientIP))
 		http.Error(w, "Unauthorized", http.StatusForbidden)
 		return
 	}
 
-	_, err = database.DB.Exec("DELETE FROM posts WHERE id = ?", postID)
-	if err != nil {
+	// Deleted posts go to the trash, where admins can restore them until
+	// the retention window runs out
+	if err := h.Posts.SoftDelete(r.Context(), post.ID); err != nil {
 		utils.LogError(fmt.Sprintf("Post deletion failed for user %s, post %s: %v", session.UserID, postID, err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
 	// Log successful deletion
-	utils.LogInfo(fmt.Sprintf("User %s deleted post '%s' (ID: %s) from IP %s", session.UserID, postTitle, postID, clientIP))
+	utils.LogInfo(fmt.Sprintf("User %s deleted post '%s' (ID: %s) from IP %s", session.UserID, post.Title, postID, clientIP))
+	h.audit(r, database.AuditPostDelete, "post", post.ID, map[string]interface{}{
+		"author_id": post.AuthorID,
+		"title":     post.Title,
+	})
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -2,156 +2,100 @@ package handlers
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"html/template"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"webapp/database"
-	"webapp/middleware"
 	"webapp/models"
 	"webapp/utils"
 )
 
-const (
-	MaxUploadSize = 5 << 20 // 5 MB
-	UploadPath    = "./uploads/profiles"
-)
-
-// Initialize upload directory
-func init() {
-	if err := os.MkdirAll(UploadPath, os.ModePerm); err != nil {
-		log.Fatal("Failed to create upload directory:", err)
-	}
+// ProfileImageDir is where profile images are saved under uploadDir,
+// served as /uploads/profiles/.
+func ProfileImageDir(uploadDir string) string {
+	return filepath.Join(uploadDir, "profiles")
 }
 
 // View user profile
-func ProfileHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
+func (h *Handlers) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
 	if !loggedIn {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	var user models.User
 	var userID int
 	fmt.Sscanf(session.UserID, "%d", &userID)
 
-	var bio, profileImage, location, website sql.NullString
-	err := database.DB.QueryRow(`
-		SELECT id, username, email, bio, profile_image, location, website, created_at, updated_at 
-		FROM users WHERE id = ?`, userID).
-		Scan(&user.ID, &user.Username, &user.Email, &bio, &profileImage,
-			&location, &website, &user.CreatedAt, &user.UpdatedAt)
-
+	user, err := h.Users.GetByID(r.Context(), userID)
 	if err != nil {
 		utils.LogError("User not found: " + err.Error())
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	// Convert sql.NullString to string
-	user.Bio = bio.String
-	user.ProfileImage = profileImage.String
-	user.Location = location.String
-	user.Website = website.String
-
 	// Count user's posts
-	var postCount int
-	database.DB.QueryRow("SELECT COUNT(*) FROM posts WHERE author_id = ?", user.ID).Scan(&postCount)
+	postCount, _ := h.Posts.CountByAuthor(r.Context(), user.ID)
 
 	// Log profile view
-	clientIP := getClientIP(r)
+	clientIP := h.clientIP(r)
 	utils.LogInfo(fmt.Sprintf("Profile viewed - User: %s, IP: %s", user.Username, clientIP))
 
-	// Create template with custom functions
-	funcMap := template.FuncMap{
-		"substr": func(s string, start, length int) string {
-			if start >= len(s) {
-				return ""
-			}
-			end := start + length
-			if end > len(s) {
-				end = len(s)
-			}
-			return s[start:end]
-		},
-		"upper": strings.ToUpper,
-	}
-
-	tmpl := template.Must(template.New("profile.html").Funcs(funcMap).ParseFiles("templates/profile.html"))
 	data := map[string]interface{}{
 		"User":      user,
 		"PostCount": postCount,
 		"LoggedIn":  loggedIn,
 	}
-	tmpl.Execute(w, data)
+	h.renderTemplate(w, r, "profile.html", data)
 }
 
 // Edit profile form
-func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
+func (h *Handlers) EditProfileHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
 	if !loggedIn {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
 	if r.Method == "GET" {
-		var user models.User
 		var userID int
 		fmt.Sscanf(session.UserID, "%d", &userID)
 
-		var bio, profileImage, location, website sql.NullString
-		err := database.DB.QueryRow(`
-			SELECT id, username, email, bio, profile_image, location, website 
-			FROM users WHERE id = ?`, userID).
-			Scan(&user.ID, &user.Username, &user.Email, &bio,
-				&profileImage, &location, &website)
-
+		user, err := h.Users.GetByID(r.Context(), userID)
 		if err != nil {
 			utils.LogError("User not found for edit: " + err.Error())
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
-		// Convert sql.NullString to string
-		user.Bio = bio.String
-		user.ProfileImage = profileImage.String
-		user.Location = location.String
-		user.Website = website.String
-
-		// Create template with custom functions
-		funcMap := template.FuncMap{
-			"substr": func(s string, start, length int) string {
-				if start >= len(s) {
-					return ""
-				}
-				end := start + length
-				if end > len(s) {
-					end = len(s)
-				}
-				return s[start:end]
-			},
-			"upper": strings.ToUpper,
+		// Embedding keeps .Username etc. working in the template
+		data := struct {
+			models.User
+			MaxUploadMB int64
+			Success     string
+			Error       string
+		}{
+			User:        user,
+			MaxUploadMB: h.Config.MaxUploadSize >> 20,
+			Success:     accountMessages[r.URL.Query().Get("success")],
+			Error:       accountMessages[r.URL.Query().Get("error")],
 		}
-
-		tmpl := template.Must(template.New("edit_profile.html").Funcs(funcMap).ParseFiles("templates/edit_profile.html"))
-		tmpl.Execute(w, user)
+		h.renderTemplate(w, r, "edit_profile.html", data)
 		return
 	}
 
 	if r.Method == "POST" {
 		// Limit upload size
-		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+		r.Body = http.MaxBytesReader(w, r.Body, h.Config.MaxUploadSize)
 
-		if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+		if err := r.ParseMultipartForm(h.Config.MaxUploadSize); err != nil {
 			utils.LogError("File too large: " + err.Error())
-			http.Error(w, "File too large (max 5MB)", http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("File too large (max %dMB)", h.Config.MaxUploadSize>>20), http.StatusBadRequest)
 			return
 		}
 
@@ -176,7 +120,7 @@ func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
 
 			// Generate unique filename
 			filename := generateFilename(handler.Filename)
-			filepath := filepath.Join(UploadPath, filename)
+			filepath := filepath.Join(ProfileImageDir(h.Config.UploadDir), filename)
 
 			// Save file
 			dst, err := os.Create(filepath)
@@ -197,11 +141,14 @@ func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
 			// Save to database
 			var userID int
 			fmt.Sscanf(session.UserID, "%d", &userID)
-			_, err = database.DB.Exec(`
-				INSERT INTO profile_images (user_id, filename, original_name, file_path, file_size, mime_type) 
-				VALUES (?, ?, ?, ?, ?, ?)`,
-				userID, filename, handler.Filename, filepath, written, handler.Header.Get("Content-Type"))
-
+			err = h.ProfileImages.Create(r.Context(), models.ProfileImage{
+				UserID:       userID,
+				Filename:     filename,
+				OriginalName: handler.Filename,
+				FilePath:     filepath,
+				FileSize:     int(written),
+				MimeType:     handler.Header.Get("Content-Type"),
+			})
 			if err != nil {
 				utils.LogError("Failed to save image record: " + err.Error())
 			}
@@ -212,18 +159,15 @@ func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
 		// Update user profile
 		var userID int
 		fmt.Sscanf(session.UserID, "%d", &userID)
-		query := `UPDATE users SET username = ?, bio = ?, location = ?, website = ?`
-		args := []interface{}{username, bio, location, website}
-
-		if profileImagePath != "" {
-			query += `, profile_image = ?`
-			args = append(args, profileImagePath)
-		}
-
-		query += ` WHERE id = ?`
-		args = append(args, userID)
-
-		_, err = database.DB.Exec(query, args...)
+		// The image is only replaced when a new one was uploaded
+		err = h.Users.UpdateProfile(r.Context(), models.User{
+			ID:           userID,
+			Username:     username,
+			Bio:          bio,
+			Location:     location,
+			Website:      website,
+			ProfileImage: profileImagePath,
+		})
 		if err != nil {
 			utils.LogError("Failed to update profile: " + err.Error())
 			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
@@ -231,8 +175,12 @@ func EditProfileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Log profile update
-		clientIP := getClientIP(r)
+		clientIP := h.clientIP(r)
 		utils.LogInfo(fmt.Sprintf("Profile updated - User: %s, IP: %s", username, clientIP))
+		h.audit(r, database.AuditProfileUpdate, "user", userID, map[string]interface{}{
+			"username":      username,
+			"image_changed": profileImagePath != "",
+		})
 
 		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 	}
@@ -264,8 +212,13 @@ func generateFilename(originalName string) string {
 }
 
 // Delete profile image
-func DeleteProfileImageHandler(w http.ResponseWriter, r *http.Request) {
-	session, loggedIn := middleware.GetSession(r)
+func (h *Handlers) DeleteProfileImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
 	if !loggedIn {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
@@ -274,110 +227,76 @@ func DeleteProfileImageHandler(w http.ResponseWriter, r *http.Request) {
 	// Get current profile image
 	var userID int
 	fmt.Sscanf(session.UserID, "%d", &userID)
-	var profileImage sql.NullString
-	err := database.DB.QueryRow("SELECT profile_image FROM users WHERE id = ?", userID).
-		Scan(&profileImage)
-
-	if err != nil || !profileImage.Valid || profileImage.String == "" {
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil || user.ProfileImage == "" {
 		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
 
 	// Delete file from filesystem
-	filename := strings.TrimPrefix(profileImage.String, "/uploads/profiles/")
-	filePath := filepath.Join(UploadPath, filename)
+	filename := strings.TrimPrefix(user.ProfileImage, "/uploads/profiles/")
+	filePath := filepath.Join(ProfileImageDir(h.Config.UploadDir), filename)
 	os.Remove(filePath)
 
 	// Update database
-	_, err = database.DB.Exec("UPDATE users SET profile_image = NULL WHERE id = ?", userID)
-	if err != nil {
+	if err := h.Users.ClearProfileImage(r.Context(), userID); err != nil {
 		utils.LogError("Failed to delete image: " + err.Error())
 	}
 
 	// Log image deletion
-	clientIP := getClientIP(r)
+	clientIP := h.clientIP(r)
 	utils.LogInfo(fmt.Sprintf("Profile image deleted - User ID: %s, IP: %s", session.UserID, clientIP))
+	h.audit(r, database.AuditProfileImage, "user", userID, nil)
 
 	http.Redirect(w, r, "/edit-profile", http.StatusSeeOther)
 }
 
 // View another user's profile (public)
-func PublicProfileHandler(w http.ResponseWriter, r *http.Request) {
+func (h *Handlers) PublicProfileHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
 	if username == "" {
 		http.Error(w, "Username required", http.StatusBadRequest)
 		return
 	}
 
-	session, loggedIn := middleware.GetSession(r)
-
-	var user models.User
-	var bio, profileImage, location, website sql.NullString
-	err := database.DB.QueryRow(`
-		SELECT id, username, email, bio, profile_image, location, website, created_at 
-		FROM users WHERE username = ?`, username).
-		Scan(&user.ID, &user.Username, &user.Email, &bio,
-			&profileImage, &location, &website, &user.CreatedAt)
+	session, loggedIn := h.Sessions.Get(r)
 
+	user, err := h.Users.GetByUsername(r.Context(), username)
 	if err != nil {
 		utils.LogError("Public profile not found: " + err.Error())
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	// Convert sql.NullString to string
-	user.Bio = bio.String
-	user.ProfileImage = profileImage.String
-	user.Location = location.String
-	user.Website = website.String
-
 	// Get user's posts
-	rows, err := database.DB.Query(`
-		SELECT id, title, content, created_at 
-		FROM posts 
-		WHERE author_id = ? 
-		ORDER BY created_at DESC 
-		LIMIT 10`, user.ID)
-
+	request, err := h.pageRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	page, err := h.Posts.ListByAuthor(r.Context(), user.ID, request)
 	if err != nil {
 		utils.LogError("Failed to get user posts: " + err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var posts []models.Post
-	for rows.Next() {
-		var post models.Post
-		rows.Scan(&post.ID, &post.Title, &post.Content, &post.CreatedAt)
-		posts = append(posts, post)
+	if len(page.Posts) == 0 && request.After != nil {
+		http.Redirect(w, r, "/user?username="+url.QueryEscape(user.Username), http.StatusSeeOther)
+		return
 	}
+	posts := page.Posts
+	h.renderPosts(posts)
 
 	// Log public profile view
-	clientIP := getClientIP(r)
+	clientIP := h.clientIP(r)
 	utils.LogInfo(fmt.Sprintf("Public profile viewed - User: %s, Viewer IP: %s", username, clientIP))
 
-	// Create template with custom functions
-	funcMap := template.FuncMap{
-		"substr": func(s string, start, length int) string {
-			if start >= len(s) {
-				return ""
-			}
-			end := start + length
-			if end > len(s) {
-				end = len(s)
-			}
-			return s[start:end]
-		},
-		"upper": strings.ToUpper,
-	}
-
-	tmpl := template.Must(template.New("public_profile.html").Funcs(funcMap).ParseFiles("templates/public_profile.html"))
 	data := map[string]interface{}{
 		"User":         user,
 		"Posts":        posts,
 		"LoggedIn":     loggedIn,
 		"IsOwnProfile": loggedIn && session.UserID == fmt.Sprintf("%d", user.ID),
 	}
-	tmpl.Execute(w, data)
+	pageLinks(data, page)
+	h.renderTemplate(w, r, "public_profile.html", data)
 }
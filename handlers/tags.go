@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"webapp/database"
+	"webapp/models"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+const (
+	// maxPostTags keeps tag lists short enough to show under a post
+	maxPostTags = 10
+	// cloudSize is how many of the most used tags the home page shows
+	cloudSize = 40
+	// cloudSteps is the number of font sizes in the tag cloud
+	cloudSteps = 5
+)
+
+var errTooManyTags = fmt.Errorf("a post can have at most %d tags", maxPostTags)
+
+// tagMessages are the outcomes the tag admin page reports, keyed by the
+// success or error query parameter
+var tagMessages = map[string]string{
+	"renamed": "Tag renamed.",
+	"merged":  "Tags merged.",
+	"invalid": "Tag names need at least one letter or digit.",
+	"exists":  "Another tag already has that name. Merge the two instead.",
+	"missing": "There is no tag with that name to merge into.",
+	"same":    "A tag can't be merged into itself.",
+}
+
+// parseTags reads the comma separated tags field of the post forms,
+// normalizing each name and dropping blanks and repeats
+func parseTags(input string) ([]string, error) {
+	var tags []string
+	for _, name := range strings.Split(input, ",") {
+		name = repository.NormalizeTag(name)
+		if name == "" || slices.Contains(tags, name) {
+			continue
+		}
+		tags = append(tags, name)
+	}
+	if len(tags) > maxPostTags {
+		return nil, errTooManyTags
+	}
+	return tags, nil
+}
+
+// tagPath is the address of a tag's page
+func tagPath(name string) string {
+	return "/tag/" + url.PathEscape(name)
+}
+
+// cloudTag is a tag in the home page cloud. Size runs from 1 for the least
+// used tags to cloudSteps for the most used.
+type cloudTag struct {
+	models.Tag
+	Size int
+}
+
+// tagCloud sizes tags on a log scale, so a few very popular tags don't
+// shrink all the others to the same size
+func tagCloud(tags []models.Tag) []cloudTag {
+	least, most := math.MaxInt, 0
+	for _, tag := range tags {
+		least, most = min(least, tag.PostCount), max(most, tag.PostCount)
+	}
+	cloud := make([]cloudTag, len(tags))
+	for i, tag := range tags {
+		size := 1
+		if most > least {
+			scale := math.Log(float64(tag.PostCount)/float64(least)) / math.Log(float64(most)/float64(least))
+			size += int(math.Round(scale * (cloudSteps - 1)))
+		}
+		cloud[i] = cloudTag{Tag: tag, Size: size}
+	}
+	return cloud
+}
+
+// TagHandler lists the posts with a tag at /tag/{name}, newest first and
+// paged like the home page. Names that normalize to an existing tag, such
+// as "Ghost Stories", redirect to its page.
+func (h *Handlers) TagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.PathValue("name")
+	tag, err := h.Tags.GetByName(r.Context(), name)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load tag %q: %v", name, err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if tag.Name != name {
+		target := tagPath(tag.Name)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	request, err := h.pageRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	page, err := h.Posts.ListByTag(r.Context(), tag.ID, request)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to list posts tagged %q: %v", tag.Name, err))
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(page.Posts) == 0 && request.After != nil {
+		http.Redirect(w, r, tagPath(tag.Name), http.StatusSeeOther)
+		return
+	}
+	h.renderPosts(page.Posts)
+
+	_, loggedIn := h.Sessions.Get(r)
+	utils.LogInfo(fmt.Sprintf("Tag '%s' viewed from IP %s", tag.Name, h.clientIP(r)))
+
+	data := map[string]interface{}{
+		"Tag":      tag,
+		"Path":     tagPath(tag.Name),
+		"Posts":    page.Posts,
+		"LoggedIn": loggedIn,
+	}
+	pageLinks(data, page)
+	h.renderTemplate(w, r, "tag.html", data)
+}
+
+func (h *Handlers) AdminTagsHandler(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.Tags.List(r.Context())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get tags: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	h.renderTemplate(w, r, "admin_tags.html", map[string]interface{}{
+		"Tags":    tags,
+		"Success": tagMessages[r.URL.Query().Get("success")],
+		"Error":   tagMessages[r.URL.Query().Get("error")],
+	})
+}
+
+// loadTag finds the tag named by the id form value, answering 404 or 500
+// itself when it can't
+func (h *Handlers) loadTag(w http.ResponseWriter, r *http.Request) (models.Tag, bool) {
+	id, _ := strconv.Atoi(r.FormValue("id"))
+	tag, err := h.Tags.GetByID(r.Context(), id)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return tag, false
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load tag %d: %v", id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return tag, false
+	}
+	return tag, true
+}
+
+// RenameTagHandler renames a tag. Its page moves with it; links to the old
+// name stop working, since another tag may take it later.
+func (h *Handlers) RenameTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tag, ok := h.loadTag(w, r)
+	if !ok {
+		return
+	}
+	name := repository.NormalizeTag(r.FormValue("name"))
+	if name == "" {
+		http.Redirect(w, r, "/admin/tags?error=invalid", http.StatusSeeOther)
+		return
+	}
+
+	err := h.Tags.Rename(r.Context(), tag.ID, name)
+	if errors.Is(err, repository.ErrTagExists) {
+		http.Redirect(w, r, "/admin/tags?error=exists", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to rename tag %d: %v", tag.ID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	utils.LogInfo(fmt.Sprintf("User %s renamed tag '%s' to '%s'", session.UserID, tag.Name, name))
+	h.audit(r, database.AuditTagRename, "tag", tag.ID, map[string]interface{}{
+		"old_name": tag.Name,
+		"name":     name,
+	})
+	http.Redirect(w, r, "/admin/tags?success=renamed", http.StatusSeeOther)
+}
+
+// MergeTagHandler moves every post with one tag to the tag named by the
+// into form value and deletes the first, e.g. to fold "ghost" into
+// "ghosts".
+func (h *Handlers) MergeTagHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	from, ok := h.loadTag(w, r)
+	if !ok {
+		return
+	}
+	into, err := h.Tags.GetByName(r.Context(), r.FormValue("into"))
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Redirect(w, r, "/admin/tags?error=missing", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to load tag %q: %v", r.FormValue("into"), err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if into.ID == from.ID {
+		http.Redirect(w, r, "/admin/tags?error=same", http.StatusSeeOther)
+		return
+	}
+
+	if err := h.Tags.Merge(r.Context(), from.ID, into.ID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to merge tag %d into %d: %v", from.ID, into.ID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	utils.LogInfo(fmt.Sprintf("User %s merged tag '%s' into '%s'", session.UserID, from.Name, into.Name))
+	h.audit(r, database.AuditTagMerge, "tag", into.ID, map[string]interface{}{
+		"merged_id":   from.ID,
+		"merged_name": from.Name,
+		"name":        into.Name,
+	})
+	http.Redirect(w, r, "/admin/tags?success=merged", http.StatusSeeOther)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"webapp/middleware"
+	"webapp/utils"
+)
+
+// templateFuncs returns the helpers available to every template, including
+// csrfField and csrfToken for the current request.
+func templateFuncs(r *http.Request) template.FuncMap {
+	funcMap := template.FuncMap{
+		"substr": func(s string, start, length int) string {
+			if start >= len(s) {
+				return ""
+			}
+			end := start + length
+			if end > len(s) {
+				end = len(s)
+			}
+			return s[start:end]
+		},
+		"upper": strings.ToUpper,
+		"join":  strings.Join,
+	}
+	for name, fn := range middleware.TemplateFuncs(r) {
+		funcMap[name] = fn
+	}
+	return funcMap
+}
+
+// Templates holds the pages of a templates directory, parsed once so that a
+// broken template stops the server at startup rather than on first use.
+type Templates struct {
+	pages map[string]*template.Template
+}
+
+// LoadTemplates parses every .html file in dir as a page of its own.
+func LoadTemplates(dir string) (*Templates, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no templates found in %s", dir)
+	}
+
+	templates := &Templates{pages: make(map[string]*template.Template)}
+	for _, file := range files {
+		name := filepath.Base(file)
+		// The request-bound helpers are swapped in when the page is rendered
+		page, err := template.New(name).Funcs(templateFuncs(nil)).ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		templates.pages[name] = page
+	}
+	return templates, nil
+}
+
+// Execute renders page name for r. The page is cloned first so csrfField
+// and csrfToken can be bound to this request.
+func (t *Templates) Execute(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	page, ok := t.pages[name]
+	if !ok {
+		return fmt.Errorf("no template named %s", name)
+	}
+	page, err := page.Clone()
+	if err != nil {
+		return err
+	}
+	return page.Funcs(templateFuncs(r)).Execute(w, data)
+}
+
+// renderTemplate renders templates/<name>, logging any failure.
+func (h *Handlers) renderTemplate(w http.ResponseWriter, r *http.Request, name string, data interface{}) {
+	if err := h.Templates.Execute(w, r, name, data); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to render %s: %v", name, err))
+	}
+}
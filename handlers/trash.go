@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"webapp/database"
+	"webapp/repository"
+	"webapp/utils"
+)
+
+// trashedUser and trashedPost are rows on the trash page
+type trashedUser struct {
+	repository.TrashedUser
+	PurgeAt time.Time
+}
+
+type trashedPost struct {
+	repository.TrashedPost
+	PurgeAt time.Time
+}
+
+var trashMessages = map[string]string{
+	"restored": "Restored from the trash.",
+	"purged":   "Deleted permanently.",
+	"missing":  "That item is no longer in the trash.",
+}
+
+// AdminTrashHandler lists deleted users and posts
+func (h *Handlers) AdminTrashHandler(w http.ResponseWriter, r *http.Request) {
+	retention := h.Config.TrashRetention
+
+	deletedUsers, err := h.Users.ListTrashed(r.Context())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get deleted users: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var users []trashedUser
+	for _, user := range deletedUsers {
+		users = append(users, trashedUser{user, user.DeletedAt.Add(retention)})
+	}
+
+	deletedPosts, err := h.Posts.ListTrashed(r.Context())
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to get deleted posts: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	var posts []trashedPost
+	for _, post := range deletedPosts {
+		posts = append(posts, trashedPost{post, post.DeletedAt.Add(retention)})
+	}
+
+	h.renderTemplate(w, r, "admin_trash.html", map[string]interface{}{
+		"Users":         users,
+		"Posts":         posts,
+		"RetentionDays": int(retention.Hours() / 24),
+		"Success":       trashMessages[r.URL.Query().Get("success")],
+		"Error":         trashMessages[r.URL.Query().Get("error")],
+	})
+}
+
+// trashTarget reads the kind ("user" or "post") and ID of a trash action
+func trashTarget(r *http.Request) (kind string, id int, ok bool) {
+	kind = r.FormValue("type")
+	id, err := strconv.Atoi(r.FormValue("id"))
+	return kind, id, err == nil && (kind == "user" || kind == "post")
+}
+
+// RestoreTrashHandler takes a user or post back out of the trash
+func (h *Handlers) RestoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind, id, ok := trashTarget(r)
+	if !ok {
+		http.Error(w, "Invalid item", http.StatusBadRequest)
+		return
+	}
+
+	restore := h.Users.Restore
+	if kind == "post" {
+		restore = h.Posts.Restore
+	}
+	restored, err := restore(r.Context(), id)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to restore %s %d: %v", kind, id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !restored {
+		http.Redirect(w, r, "/admin/trash?error=missing", http.StatusSeeOther)
+		return
+	}
+
+	action := database.AuditUserRestore
+	if kind == "post" {
+		action = database.AuditPostRestore
+	}
+	h.audit(r, action, kind, id, nil)
+	http.Redirect(w, r, "/admin/trash?success=restored", http.StatusSeeOther)
+}
+
+// PurgeTrashHandler permanently deletes one user or post from the trash
+func (h *Handlers) PurgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind, id, ok := trashTarget(r)
+	if !ok {
+		http.Error(w, "Invalid item", http.StatusBadRequest)
+		return
+	}
+
+	// Only rows already in the trash can be purged
+	purge := h.Users.Purge
+	if kind == "post" {
+		purge = h.Posts.Purge
+	}
+	purged, err := purge(r.Context(), id)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to purge %s %d: %v", kind, id, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !purged {
+		http.Redirect(w, r, "/admin/trash?error=missing", http.StatusSeeOther)
+		return
+	}
+
+	action := database.AuditUserPurge
+	if kind == "post" {
+		action = database.AuditPostPurge
+	}
+	h.audit(r, action, kind, id, nil)
+	http.Redirect(w, r, "/admin/trash?success=purged", http.StatusSeeOther)
+}
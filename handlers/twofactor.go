@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+	"webapp/database"
+	"webapp/middleware"
+	"webapp/models"
+	"webapp/utils"
+)
+
+// Shown as the account name in authenticator apps
+const twoFactorIssuer = "Haunted Blog"
+
+// TwoFactorLoginHandler is the second login step for accounts with TOTP enabled
+func (h *Handlers) TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	userID, pending := h.Sessions.PendingMFAUser(r)
+	if !pending {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == "GET" {
+		h.renderTemplate(w, r, "login_2fa.html", nil)
+		return
+	}
+
+	if r.Method == "POST" {
+		clientIP := h.clientIP(r)
+		code := r.PostFormValue("code")
+
+		user, err := h.Users.GetByID(r.Context(), userID)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("2FA user %d not found: %v", userID, err))
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if !loginUsernameLimiter.Allow(user.Username) {
+			utils.LogError(fmt.Sprintf("2FA rate limit hit for user %s from IP %s", user.Username, clientIP))
+			http.Error(w, "Too many login attempts. Please slow down.", http.StatusTooManyRequests)
+			return
+		}
+
+		if lockedUntil, locked := h.accountLockedUntil(r.Context(), user.Username); locked {
+			http.Error(w, "Account temporarily locked. Try again after "+lockedUntil.Format("15:04:05"), http.StatusTooManyRequests)
+			return
+		}
+
+		valid, err := h.useTOTPCode(r.Context(), user, code)
+		if err != nil {
+			utils.LogError(fmt.Sprintf("Failed to record TOTP code for user %s: %v", user.Username, err))
+		}
+		if !valid {
+			valid, err = h.Users.UseRecoveryCode(r.Context(), user.ID, middleware.HashRecoveryCode(code))
+			if err != nil {
+				utils.LogError(fmt.Sprintf("Failed to check recovery code for user %s: %v", user.Username, err))
+			}
+			if valid {
+				utils.LogInfo(fmt.Sprintf("User %s used a recovery code from IP %s", user.Username, clientIP))
+			}
+		}
+
+		if !valid {
+			utils.LogAuth("LOGIN_2FA", user.Username, clientIP, false)
+			h.recordLoginFailure(r, user.Username, clientIP)
+			h.renderTemplate(w, r, "login_2fa.html", map[string]interface{}{
+				"Error": "Invalid authentication code",
+			})
+			return
+		}
+
+		middleware.ClearPendingMFACookie(w)
+		utils.LogAuth("LOGIN_2FA", user.Username, clientIP, true)
+
+		// The account may have been suspended since the password step
+		if h.rejectBlockedLogin(w, r, user, clientIP) {
+			return
+		}
+		h.completeLogin(w, r, user, clientIP)
+	}
+}
+
+// useTOTPCode checks a code from the user's app and records its time step,
+// so the same code can't be used a second time
+func (h *Handlers) useTOTPCode(ctx context.Context, user models.User, code string) (bool, error) {
+	step, ok := middleware.VerifyTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	return h.Users.UseTOTPStep(ctx, user.ID, step)
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes for display along
+// with the hashes to store
+func newRecoveryCodes() ([]string, []string) {
+	codes := middleware.GenerateRecoveryCodes(middleware.RecoveryCodeCount)
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = middleware.HashRecoveryCode(code)
+	}
+	return codes, hashes
+}
+
+// adminTwoFactorRequired reports whether the site forces 2FA for staff,
+// meaning any user who holds a role. Errors are logged and leave it off.
+func (h *Handlers) adminTwoFactorRequired(ctx context.Context) bool {
+	required, err := h.Permissions.StaffTwoFactorRequired(ctx)
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to read the admin 2FA policy: %v", err))
+	}
+	return required && err == nil
+}
+
+// TwoFactorSettingsHandler shows 2FA status and the enrollment secret
+func (h *Handlers) TwoFactorSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	session, loggedIn := h.Sessions.Get(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var userID int
+	fmt.Sscanf(session.UserID, "%d", &userID)
+	h.renderTwoFactorSettings(w, r, userID, nil)
+}
+
+func (h *Handlers) renderTwoFactorSettings(w http.ResponseWriter, r *http.Request, userID int, extra map[string]interface{}) {
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		utils.LogError("User not found for 2FA settings: " + err.Error())
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Keep the pending secret until enrollment finishes, so reloading the
+	// page doesn't invalidate what was already scanned
+	if !user.TOTPEnabled && user.TOTPSecret == "" {
+		user.TOTPSecret = middleware.GenerateTOTPSecret()
+		if err := h.Users.SetTOTPSecret(r.Context(), userID, user.TOTPSecret); err != nil {
+			utils.LogError(fmt.Sprintf("Failed to store TOTP secret for user %d: %v", userID, err))
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data := map[string]interface{}{
+		"User":     user,
+		"Required": h.adminTwoFactorRequired(r.Context()) && h.isStaff(r.Context(), userID),
+	}
+	if !user.TOTPEnabled {
+		data["Secret"] = user.TOTPSecret
+		// otpauth:// is not a scheme html/template trusts by default
+		data["ProvisioningURI"] = template.URL(middleware.TOTPProvisioningURI(twoFactorIssuer, user.Username, user.TOTPSecret))
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	h.renderTemplate(w, r, "two_factor.html", data)
+}
+
+// EnableTwoFactorHandler confirms enrollment with a code from the app
+func (h *Handlers) EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var userID int
+	fmt.Sscanf(session.UserID, "%d", &userID)
+	clientIP := h.clientIP(r)
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil || user.TOTPEnabled || user.TOTPSecret == "" {
+		h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"Error": "Invalid authentication code"})
+		return
+	}
+	step, ok := middleware.VerifyTOTP(user.TOTPSecret, r.PostFormValue("code"), time.Now(), user.TOTPLastStep)
+	if !ok {
+		h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"Error": "Invalid authentication code"})
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	if err := h.Users.EnableTOTP(r.Context(), userID, step, hashes); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to enable 2FA for user %d: %v", userID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %d enabled 2FA from IP %s", userID, clientIP))
+	h.audit(r, database.AuditTwoFactorOn, "user", userID, nil)
+	h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"RecoveryCodes": codes})
+}
+
+// DisableTwoFactorHandler turns 2FA off after checking password and code
+func (h *Handlers) DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, loggedIn := h.Sessions.Get(r)
+	if !loggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var userID int
+	fmt.Sscanf(session.UserID, "%d", &userID)
+	clientIP := h.clientIP(r)
+
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil || !user.TOTPEnabled {
+		http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if h.adminTwoFactorRequired(r.Context()) && h.isStaff(r.Context(), userID) {
+		h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"Error": "Two-factor authentication is required for staff accounts"})
+		return
+	}
+
+	if !middleware.CheckPassword(r.PostFormValue("password"), user.Password) {
+		h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"Error": "Invalid password or authentication code"})
+		return
+	}
+	valid, err := h.useTOTPCode(r.Context(), user, r.PostFormValue("code"))
+	if err != nil {
+		utils.LogError(fmt.Sprintf("Failed to record TOTP code for user %d: %v", userID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		h.renderTwoFactorSettings(w, r, userID, map[string]interface{}{"Error": "Invalid password or authentication code"})
+		return
+	}
+
+	if err := h.Users.DisableTOTP(r.Context(), userID); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to disable 2FA for user %d: %v", userID, err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("User %d disabled 2FA from IP %s", userID, clientIP))
+	h.audit(r, database.AuditTwoFactorOff, "user", userID, nil)
+	http.Redirect(w, r, "/profile/2fa", http.StatusSeeOther)
+}
+
+// AdminTwoFactorPolicyHandler turns the "admins must use 2FA" policy on or off
+func (h *Handlers) AdminTwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, _ := h.Sessions.Get(r)
+	required := r.PostFormValue("required") == "true"
+
+	if err := h.Permissions.SetStaffTwoFactorRequired(r.Context(), required); err != nil {
+		utils.LogError(fmt.Sprintf("Failed to update admin 2FA policy: %v", err))
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	utils.LogInfo(fmt.Sprintf("Admin %s set admin 2FA requirement to %t", session.UserID, required))
+	h.audit(r, database.AuditSettingUpdate, "setting", database.SettingRequireAdmin2FA, map[string]interface{}{"value": strconv.FormatBool(required)})
+	http.Redirect(w, r, "/admin?success=policy_updated", http.StatusSeeOther)
+}
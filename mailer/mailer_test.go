@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	m := NewMemoryMailer()
+	m.Send(Message{To: "bob@example.com", Subject: "Hello", Body: "Hi Bob"})
+
+	messages := m.Messages()
+	if len(messages) != 1 || messages[0].To != "bob@example.com" {
+		t.Fatalf("Unexpected messages: %v", messages)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := NewFileMailer(dir)
+
+	if err := m.Send(Message{To: "bob@example.com", Subject: "Reset", Body: "line one\nline two"}); err != nil {
+		t.Fatalf("Error sending mail: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 mail file, got %d", len(files))
+	}
+	content, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(content), "Subject: Reset\r\n") || !strings.Contains(string(content), "line one\r\nline two") {
+		t.Errorf("Unexpected mail content: %q", content)
+	}
+}
+
+func TestHeaderInjectionRejected(t *testing.T) {
+	m := NewFileMailer(t.TempDir())
+	if err := m.Send(Message{To: "bob@example.com\r\nBcc: eve@example.com", Subject: "x"}); err == nil {
+		t.Error("Header injection was accepted")
+	}
+}
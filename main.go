@@ -1,52 +1,56 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"net/http"
-	"webapp/database"
-	"webapp/handlers"
-	"webapp/middleware"
+	"os"
+	"os/signal"
+	"syscall"
+	"webapp/app"
+	"webapp/config"
 	"webapp/utils"
 )
 
 func main() {
-	// Initialize logging system
-	utils.InitLogger()
-	utils.LogInfo("Application starting...")
+	// The standard logger is used by the database package
+	log.SetOutput(utils.NewRedactingWriter(os.Stderr))
+
+	// Settings come from flags, the environment and an optional -config file
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Configuration: %v", err)
+	}
+
+	site, err := app.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	utils.LogInfo(fmt.Sprintf("Application starting in %s mode...", cfg.Env))
 
 	// Test logging system
 	utils.TestLogging()
 
-	database.InitDB()
-	defer database.DB.Close()
-
-	// Static files handler for ghost.gif and uploaded files
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads/"))))
-
-	// Existing routes
-	http.HandleFunc("/", handlers.HomeHandler)
-	http.HandleFunc("/signup", handlers.SignupHandler)
-	http.HandleFunc("/login", handlers.LoginHandler)
-	http.HandleFunc("/logout", handlers.LogoutHandler)
-	http.HandleFunc("/post/create", handlers.CreatePostHandler)
-	http.HandleFunc("/post/edit", handlers.EditPostHandler)
-	http.HandleFunc("/post/delete", handlers.DeletePostHandler)
-
-	// Profile routes
-	http.HandleFunc("/profile", handlers.ProfileHandler)
-	http.HandleFunc("/edit-profile", handlers.EditProfileHandler)
-	http.HandleFunc("/profile/delete-image", handlers.DeleteProfileImageHandler)
-	http.HandleFunc("/user", handlers.PublicProfileHandler)
-
-	// Admin routes (protected by admin middleware)
-	http.HandleFunc("/admin", middleware.RequireAdmin(handlers.AdminDashboardHandler))
-	http.HandleFunc("/admin/generate-code", middleware.RequireAdmin(handlers.GenerateInviteCodeHandler))
-	http.HandleFunc("/admin/users", middleware.RequireAdmin(handlers.AdminUsersHandler))
-	http.HandleFunc("/admin/clean-users", middleware.RequireAdmin(handlers.CleanAllUsersHandler))
-
-	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-
+	// Expired sessions are cleaned up and deleted users and posts purged
+	// after TRASH_RETENTION_DAYS
+	site.Start()
+
+	// SIGTERM (systemctl stop/restart) and Ctrl+C let open requests finish
+	// before the database is closed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	scheme := "http"
+	if cfg.Server.TLS() {
+		scheme = "https"
+	}
+	fmt.Printf("Server starting on %s (%s)\n", cfg.Addr, scheme)
+	serveErr := site.ListenAndServe(ctx)
+	if err := site.Close(); err != nil {
+		utils.LogError(fmt.Sprintf("Closing: %v", err))
+	}
+	if serveErr != nil {
+		log.Fatal(serveErr)
+	}
+	log.Println("Server stopped")
 }
@@ -1,26 +1,68 @@
+//go:build ignore
+
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"strings"
+	"time"
+	"webapp/config"
 	"webapp/database"
 	"webapp/middleware"
+	"webapp/models"
+	"webapp/repository"
 	"webapp/utils"
 )
 
+// cfg is loaded once in main for every command
+var cfg *config.Config
+
 func main() {
 	if len(os.Args) < 2 {
 		printUsage()
 		return
 	}
 
-	// Initialize database
-	database.InitDB()
+	// The standard logger is used by the database package
+	log.SetOutput(utils.NewRedactingWriter(os.Stderr))
+
+	// Same settings as the server; commands parse their own flags
+	var err error
+	if cfg, err = config.Load(nil); err != nil {
+		fmt.Printf("Configuration: %v\n", err)
+		return
+	}
+	if err := middleware.SetPasswordConfig(cfg.Password); err != nil {
+		fmt.Printf("Password hashing config: %v\n", err)
+		return
+	}
+
+	// Initialize database. migrate manages the schema itself, so it only
+	// connects; every other command brings the schema up to date first.
+	if _, err := database.Open(cfg.DB.Driver, cfg.DB.Source()); err != nil {
+		log.Fatal("Error connecting to database: ", err)
+	}
 	defer database.DB.Close()
+	if os.Args[1] != "migrate" {
+		if err := database.Setup(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Initialize logging
-	utils.InitLogger()
+	loggers, err := utils.NewLoggers(cfg.LogDir)
+	if err != nil {
+		log.Fatal("Failed to set up logging: ", err)
+	}
+	defer loggers.Close()
+	utils.SetLoggers(loggers)
+	for _, field := range cfg.RedactFields {
+		utils.AddRedactedField(field)
+	}
 
 	command := os.Args[1]
 
@@ -29,12 +71,26 @@ func main() {
 		createSuperUser()
 	case "cleanusers":
 		cleanUsers()
+	case "purgetrash":
+		purgeTrash()
 	case "listusers":
 		listUsers()
 	case "generatecode":
 		generateInviteCode()
 	case "listcodes":
 		listInviteCodes()
+	case "unlock":
+		unlockAccount()
+	case "grant":
+		changeRole(true)
+	case "revoke":
+		changeRole(false)
+	case "listroles":
+		listRoles()
+	case "auditlog":
+		showAuditLog()
+	case "migrate":
+		migrate()
 	case "help":
 		printUsage()
 	default:
@@ -76,23 +132,30 @@ func createSuperUser() {
 	}
 
 	// Create admin user
-	_, err = database.DB.Exec(`
-		INSERT INTO users (username, email, password, invitation_code, invited_by, is_admin) 
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, username, email, hashPassword, "ADMIN-CREATED", nil, true)
-
+	userID, err := repository.NewSQLUserRepository(database.DB).Create(context.Background(), models.User{
+		Username:       username,
+		Email:          email,
+		Password:       hashPassword,
+		InvitationCode: "ADMIN-CREATED",
+	})
 	if err != nil {
 		fmt.Printf("Error creating admin user: %v\n", err)
 		return
 	}
 
+	if err := repository.NewSQLPermissionRepository(database.DB).GrantRole(context.Background(), userID, database.RoleAdmin); err != nil {
+		fmt.Printf("Error granting admin role: %v\n", err)
+		return
+	}
+
 	fmt.Printf("✅ Superuser '%s' created successfully!\n", username)
 	utils.LogInfo(fmt.Sprintf("Superuser created via CLI: %s", username))
+	cliAudit(database.AuditUserCreate, "user", fmt.Sprint(userID), map[string]interface{}{"username": username, "role": database.RoleAdmin})
 }
 
 func cleanUsers() {
 	// Confirm action
-	fmt.Print("Are you sure you want to delete all non-admin users? (yes/no): ")
+	fmt.Print("Are you sure you want to move all users without a role to the trash? (yes/no): ")
 	var confirm string
 	fmt.Scanln(&confirm)
 
@@ -101,22 +164,62 @@ func cleanUsers() {
 		return
 	}
 
-	result, err := database.DB.Exec("DELETE FROM users WHERE is_admin = FALSE")
+	ids, err := repository.NewSQLUserRepository(database.DB).TrashWithoutRole(context.Background())
 	if err != nil {
 		fmt.Printf("Error cleaning users: %v\n", err)
 		return
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	fmt.Printf("✅ Cleaned %d users from database\n", rowsAffected)
-	utils.LogInfo(fmt.Sprintf("Cleaned %d users via CLI", rowsAffected))
+	// Trashed users must not stay logged in
+	store := middleware.NewMySQLStore(database.DB)
+	for _, id := range ids {
+		if _, err := store.RevokeAllForUser(fmt.Sprint(id)); err != nil {
+			fmt.Printf("Warning: could not revoke sessions for user %d: %v\n", id, err)
+		}
+	}
+
+	fmt.Printf("✅ Moved %d users to the trash\n", len(ids))
+	utils.LogInfo(fmt.Sprintf("Moved %d users to the trash via CLI", len(ids)))
+	cliAudit(database.AuditUsersClean, "user", "", map[string]interface{}{"trashed": ids})
+}
+
+func purgeTrash() {
+	all := flag.Bool("all", false, "Empty the whole trash, not just expired items")
+	flag.CommandLine.Parse(os.Args[2:])
+
+	cutoff := time.Now().Add(-cfg.TrashRetention)
+	if *all {
+		fmt.Print("Are you sure you want to permanently delete everything in the trash? (yes/no): ")
+		var confirm string
+		fmt.Scanln(&confirm)
+
+		if confirm != "yes" {
+			fmt.Println("Operation cancelled")
+			return
+		}
+		cutoff = time.Now()
+	}
+
+	users, posts, err := database.PurgeTrash(cutoff)
+	if err != nil {
+		fmt.Printf("Error purging trash: %v\n", err)
+		return
+	}
+
+	fmt.Printf("✅ Purged %d users and %d posts from the trash\n", users, posts)
+	utils.LogInfo(fmt.Sprintf("Purged %d users and %d posts from the trash via CLI", users, posts))
+	cliAudit(database.AuditTrashPurge, "trash", "", map[string]interface{}{"users": users, "posts": posts, "all": *all})
 }
 
 func listUsers() {
 	rows, err := database.DB.Query(`
-		SELECT id, username, email, is_admin, created_at 
-		FROM users 
-		ORDER BY created_at DESC
+		SELECT u.id, u.username, u.email, COALESCE(GROUP_CONCAT(r.name ORDER BY r.name), ''), u.created_at 
+		FROM users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN roles r ON r.id = ur.role_id
+		WHERE u.deleted_at IS NULL
+		GROUP BY u.id, u.username, u.email, u.created_at
+		ORDER BY u.created_at DESC
 	`)
 	if err != nil {
 		fmt.Printf("Error querying users: %v\n", err)
@@ -125,27 +228,25 @@ func listUsers() {
 	defer rows.Close()
 
 	fmt.Println("\n📋 Users List:")
-	fmt.Println("ID | Username | Email | Role | Created")
-	fmt.Println("---|----------|-------|------|--------")
+	fmt.Println("ID | Username | Email | Roles | Created")
+	fmt.Println("---|----------|-------|-------|--------")
 
 	for rows.Next() {
 		var id int
-		var username, email string
-		var isAdmin bool
+		var username, email, roles string
 		var createdAt string
 
-		err := rows.Scan(&id, &username, &email, &isAdmin, &createdAt)
+		err := rows.Scan(&id, &username, &email, &roles, &createdAt)
 		if err != nil {
 			continue
 		}
 
-		role := "User"
-		if isAdmin {
-			role = "Admin"
+		if roles == "" {
+			roles = "-"
 		}
 
-		fmt.Printf("%-2d | %-8s | %-20s | %-5s | %s\n",
-			id, username, email, role, createdAt)
+		fmt.Printf("%-2d | %-8s | %-20s | %-15s | %s\n",
+			id, username, email, roles, createdAt)
 	}
 	fmt.Println()
 }
@@ -155,16 +256,21 @@ func generateInviteCode() {
 	flag.IntVar(&createdBy, "created-by", 1, "User ID who creates the code")
 	flag.Parse()
 
-	// Check if user exists and is admin
-	var isAdmin bool
-	err := database.DB.QueryRow("SELECT is_admin FROM users WHERE id = ?", createdBy).Scan(&isAdmin)
-	if err != nil {
+	// Check if user exists and may create invites
+	var exists int
+	database.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", createdBy).Scan(&exists)
+	if exists == 0 {
 		fmt.Printf("Error: User with ID %d not found\n", createdBy)
 		return
 	}
 
-	if !isAdmin {
-		fmt.Printf("Error: User with ID %d is not an admin\n", createdBy)
+	allowed, err := repository.NewSQLPermissionRepository(database.DB).HasPermission(context.Background(), createdBy, database.PermCreateInvites)
+	if err != nil {
+		fmt.Printf("Error checking permissions: %v\n", err)
+		return
+	}
+	if !allowed {
+		fmt.Printf("Error: User with ID %d is not allowed to create invitation codes\n", createdBy)
 		return
 	}
 
@@ -173,8 +279,8 @@ func generateInviteCode() {
 
 	_, err = database.DB.Exec(`
 		INSERT INTO invitation_codes (code, created_by, expires_at) 
-		VALUES (?, ?, DATE_ADD(NOW(), INTERVAL 30 DAY))
-	`, code, createdBy)
+		VALUES (?, ?, ?)
+	`, code, createdBy, time.Now().Add(cfg.InviteExpiry))
 
 	if err != nil {
 		fmt.Printf("Error generating invite code: %v\n", err)
@@ -182,8 +288,9 @@ func generateInviteCode() {
 	}
 
 	fmt.Printf("✅ Invitation code generated: %s\n", code)
-	fmt.Printf("   Expires in 30 days\n")
+	fmt.Printf("   Expires in %d days\n", int(cfg.InviteExpiry.Hours()/24))
 	utils.LogInfo(fmt.Sprintf("Invite code generated via CLI: %s", code))
+	cliAudit(database.AuditInviteCreate, "invitation_code", "", map[string]interface{}{"created_by": createdBy})
 }
 
 func listInviteCodes() {
@@ -234,6 +341,221 @@ func listInviteCodes() {
 	fmt.Println()
 }
 
+func unlockAccount() {
+	var username string
+	flag.StringVar(&username, "username", "", "Username to unlock")
+	flag.CommandLine.Parse(os.Args[2:])
+
+	if username == "" {
+		fmt.Println("Error: -username is required")
+		return
+	}
+
+	cleared, err := repository.NewSQLLoginRepository(database.DB).Clear(context.Background(), username)
+	if err != nil {
+		fmt.Printf("Error clearing lockout: %v\n", err)
+		return
+	}
+	if !cleared {
+		fmt.Printf("No failed logins recorded for '%s'\n", username)
+		return
+	}
+
+	fmt.Printf("✅ Lockout cleared for '%s'\n", username)
+	utils.LogInfo(fmt.Sprintf("Lockout cleared via CLI: %s", username))
+	cliAudit(database.AuditAccountUnlock, "username", username, nil)
+}
+
+func changeRole(grant bool) {
+	var username, role string
+	flag.StringVar(&username, "username", "", "Username to change")
+	flag.StringVar(&role, "role", "", "Role name")
+	flag.CommandLine.Parse(os.Args[2:])
+
+	if username == "" || role == "" {
+		fmt.Println("Error: -username and -role are required")
+		return
+	}
+
+	var userID int
+	if err := database.DB.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
+		fmt.Printf("Error: User '%s' not found\n", username)
+		return
+	}
+
+	permissions := repository.NewSQLPermissionRepository(database.DB)
+	if grant {
+		if err := permissions.GrantRole(context.Background(), userID, role); err != nil {
+			fmt.Printf("Error granting role: %v\n", err)
+			return
+		}
+		fmt.Printf("✅ Granted role '%s' to '%s'\n", role, username)
+		utils.LogInfo(fmt.Sprintf("Role %s granted to %s via CLI", role, username))
+		cliAudit(database.AuditRoleGrant, "user", fmt.Sprint(userID), map[string]interface{}{"role": role})
+		return
+	}
+
+	if err := permissions.RevokeRole(context.Background(), userID, role); err != nil {
+		fmt.Printf("Error revoking role: %v\n", err)
+		return
+	}
+	fmt.Printf("✅ Revoked role '%s' from '%s'\n", role, username)
+	utils.LogInfo(fmt.Sprintf("Role %s revoked from %s via CLI", role, username))
+	cliAudit(database.AuditRoleRevoke, "user", fmt.Sprint(userID), map[string]interface{}{"role": role})
+}
+
+func listRoles() {
+	roles, err := repository.NewSQLPermissionRepository(database.DB).Roles(context.Background())
+	if err != nil {
+		fmt.Printf("Error querying roles: %v\n", err)
+		return
+	}
+
+	fmt.Println("\n🔑 Roles:")
+	for _, role := range roles {
+		fmt.Printf("  %-10s %s\n", role.Name, role.Description)
+		fmt.Printf("  %-10s permissions: %s\n", "", strings.Join(role.Permissions, ", "))
+	}
+	fmt.Println()
+}
+
+// cliAudit records an action taken from this tool in the audit log
+func cliAudit(action, targetType, targetID string, metadata map[string]interface{}) {
+	actor := "cli"
+	if user := os.Getenv("USER"); user != "" {
+		actor = "cli:" + user
+	}
+	event := models.AuditEvent{ActorName: actor, Action: action, TargetType: targetType, TargetID: targetID}
+	if err := repository.NewSQLAuditRepository(database.DB).Record(context.Background(), event, metadata); err != nil {
+		fmt.Printf("Warning: could not write audit log: %v\n", err)
+	}
+}
+
+func showAuditLog() {
+	var filter repository.AuditFilter
+	var since string
+	flag.StringVar(&filter.Actor, "actor", "", "Only events by this username")
+	flag.StringVar(&filter.Action, "action", "", "Only this action, or a prefix such as user")
+	flag.StringVar(&filter.TargetType, "target-type", "", "Only events on this kind of target")
+	flag.StringVar(&filter.TargetID, "target-id", "", "Only events on this target")
+	flag.StringVar(&since, "since", "", "Only events on or after this date (YYYY-MM-DD)")
+	flag.IntVar(&filter.Limit, "limit", 50, "Maximum number of events")
+	flag.CommandLine.Parse(os.Args[2:])
+
+	if since != "" {
+		parsed, err := time.Parse("2006-01-02", since)
+		if err != nil {
+			fmt.Println("Error: -since must be YYYY-MM-DD")
+			return
+		}
+		filter.Since = parsed
+	}
+
+	events, err := repository.NewSQLAuditRepository(database.DB).List(context.Background(), filter)
+	if err != nil {
+		fmt.Printf("Error querying audit log: %v\n", err)
+		return
+	}
+
+	fmt.Println("\n📜 Audit Log:")
+	fmt.Println("Time | Actor | Action | Target | IP | Details")
+	fmt.Println("-----|-------|--------|--------|----|--------")
+
+	for _, event := range events {
+		fmt.Printf("%s | %-12s | %-24s | %s %s | %s | %s\n",
+			event.CreatedAt.Format("2006-01-02 15:04:05"), event.ActorName, event.Action,
+			event.TargetType, event.TargetID, event.IP, event.Metadata)
+	}
+	fmt.Println()
+}
+
+func migrate() {
+	if len(os.Args) < 3 {
+		fmt.Println("Usage: go run manage.go migrate up|down|status [-steps n]")
+		return
+	}
+	direction := os.Args[2]
+	steps := flag.Int("steps", 0, "Number of migrations to apply or revert")
+	flag.CommandLine.Parse(os.Args[3:])
+
+	switch direction {
+	case "up":
+		applied, err := database.MigrateUp(*steps)
+		for _, migration := range applied {
+			fmt.Printf("✅ Applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error applying migrations: %v\n", err)
+			return
+		}
+		if len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+		cliAuditMigrations("up", applied)
+	case "down":
+		// Reverting drops tables and columns, so it is one step by default
+		if *steps == 0 {
+			*steps = 1
+		}
+		fmt.Printf("Are you sure you want to revert %d migration(s)? Data in dropped tables and columns is lost. (yes/no): ", *steps)
+		var confirm string
+		fmt.Scanln(&confirm)
+
+		if confirm != "yes" {
+			fmt.Println("Operation cancelled")
+			return
+		}
+
+		reverted, err := database.MigrateDown(*steps)
+		for _, migration := range reverted {
+			fmt.Printf("✅ Reverted %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			fmt.Printf("Error reverting migrations: %v\n", err)
+			return
+		}
+		cliAuditMigrations("down", reverted)
+	case "status":
+		statuses, err := database.MigrationStatuses()
+		if err != nil {
+			fmt.Printf("Error reading migrations: %v\n", err)
+			return
+		}
+
+		fmt.Println("\n📋 Migrations:")
+		fmt.Println("Version | Name | Applied")
+		fmt.Println("--------|------|--------")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = status.AppliedAt.Format("2006-01-02 15:04")
+			}
+			if status.Modified {
+				applied += " (file modified since applied!)"
+			}
+			if status.Missing {
+				applied += " (no migration file)"
+			}
+			fmt.Printf("%04d | %s | %s\n", status.Version, status.Name, applied)
+		}
+	default:
+		fmt.Printf("Unknown migrate command: %s (use up, down or status)\n", direction)
+	}
+}
+
+// cliAuditMigrations records schema changes made from the CLI. The audit
+// table may itself have been reverted, so failures are only warnings.
+func cliAuditMigrations(direction string, migrations []database.Migration) {
+	if len(migrations) == 0 {
+		return
+	}
+	versions := make([]int, len(migrations))
+	for i, migration := range migrations {
+		versions[i] = migration.Version
+	}
+	cliAudit(database.AuditSchemaMigrate, "schema", "", map[string]interface{}{"direction": direction, "versions": versions})
+}
+
 func printUsage() {
 	fmt.Println("🚀 Webapp Management CLI")
 	fmt.Println()
@@ -247,7 +569,12 @@ func printUsage() {
 	fmt.Println("      -password string  Admin password (will prompt if not provided)")
 	fmt.Println()
 	fmt.Println("  cleanusers")
-	fmt.Println("    Removes all non-admin users from database")
+	fmt.Println("    Moves all users without a role to the trash")
+	fmt.Println()
+	fmt.Println("  purgetrash")
+	fmt.Println("    Permanently deletes trashed users and posts older than TRASH_RETENTION_DAYS")
+	fmt.Println("    Options:")
+	fmt.Println("      -all              Empty the whole trash, whatever its age")
 	fmt.Println()
 	fmt.Println("  listusers")
 	fmt.Println("    Lists all users in the database")
@@ -260,6 +587,35 @@ func printUsage() {
 	fmt.Println("  listcodes")
 	fmt.Println("    Lists all invitation codes")
 	fmt.Println()
+	fmt.Println("  unlock")
+	fmt.Println("    Clears the failed login lockout for an account")
+	fmt.Println("    Options:")
+	fmt.Println("      -username string  Username to unlock")
+	fmt.Println()
+	fmt.Println("  grant / revoke")
+	fmt.Println("    Gives a user a role, or takes it away")
+	fmt.Println("    Options:")
+	fmt.Println("      -username string  Username to change")
+	fmt.Println("      -role string      admin, moderator or inviter")
+	fmt.Println()
+	fmt.Println("  listroles")
+	fmt.Println("    Lists roles and their permissions")
+	fmt.Println()
+	fmt.Println("  auditlog")
+	fmt.Println("    Shows recent audit events, newest first")
+	fmt.Println("    Options:")
+	fmt.Println("      -actor string        Only events by this username")
+	fmt.Println("      -action string       Action or prefix, e.g. login.failure or user")
+	fmt.Println("      -target-type string  Only events on this kind of target (user, post, ...)")
+	fmt.Println("      -target-id string    Only events on this target")
+	fmt.Println("      -since string        Only events on or after YYYY-MM-DD")
+	fmt.Println("      -limit int           Maximum number of events (default: 50)")
+	fmt.Println()
+	fmt.Println("  migrate up|down|status")
+	fmt.Println("    Applies pending migrations, reverts the latest ones, or lists them")
+	fmt.Println("    Options:")
+	fmt.Println("      -steps int        How many to apply (default: all) or revert (default: 1)")
+	fmt.Println()
 	fmt.Println("  help")
 	fmt.Println("    Shows this help message")
 	fmt.Println()
@@ -267,7 +623,14 @@ func printUsage() {
 	fmt.Println("  go run manage.go createsuperuser")
 	fmt.Println("  go run manage.go createsuperuser -username myadmin -email admin@mydomain.com")
 	fmt.Println("  go run manage.go cleanusers")
+	fmt.Println("  go run manage.go purgetrash")
 	fmt.Println("  go run manage.go listusers")
 	fmt.Println("  go run manage.go generatecode -created-by 1")
 	fmt.Println("  go run manage.go listcodes")
+	fmt.Println("  go run manage.go unlock -username alice")
+	fmt.Println("  go run manage.go grant -username alice -role moderator")
+	fmt.Println("  go run manage.go revoke -username alice -role moderator")
+	fmt.Println("  go run manage.go auditlog -action user -since 2024-01-01")
+	fmt.Println("  go run manage.go migrate status")
+	fmt.Println("  go run manage.go migrate down -steps 1")
 }
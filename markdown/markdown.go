@@ -0,0 +1,107 @@
+// Package markdown turns post content into HTML that is safe to embed in a
+// page. Markdown is rendered with GitHub-flavoured extensions, then passed
+// through an allow-list sanitizer, so raw HTML, scripts and javascript:
+// links in a post never reach the browser.
+package markdown
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"sync"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+var (
+	converter = goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		// Single line breaks are kept, as posts written before Markdown
+		// support relied on them
+		goldmark.WithRendererOptions(html.WithHardWraps()),
+	)
+	policy = newPolicy()
+)
+
+// newPolicy allows the formatting Markdown produces: headings, lists,
+// quotes, code, tables, images and links, the latter marked nofollow.
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// Fenced code blocks name their language, e.g. class="language-go"
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	// GFM task lists
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}
+
+// Render converts Markdown source to sanitized HTML.
+func Render(source string) template.HTML {
+	var buf bytes.Buffer
+	if err := converter.Convert([]byte(source), &buf); err != nil {
+		// goldmark only fails when writing to buf fails, which it can't;
+		// fall back to the escaped source just in case
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	return template.HTML(policy.SanitizeBytes(buf.Bytes()))
+}
+
+// Cache remembers rendered posts. An edit bumps the post's revision, so a
+// stale entry is never served; it is replaced on the next render.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[int]entry
+}
+
+type entry struct {
+	revision int
+	html     template.HTML
+}
+
+// NewCache returns a cache holding at most size posts.
+func NewCache(size int) *Cache {
+	return &Cache{size: size, entries: make(map[int]entry)}
+}
+
+// Render returns the HTML for revision of post id, rendering source only
+// when that revision isn't cached yet.
+func (c *Cache) Render(id, revision int, source string) template.HTML {
+	c.mu.Lock()
+	cached, ok := c.entries[id]
+	c.mu.Unlock()
+	if ok && cached.revision == revision {
+		return cached.html
+	}
+
+	rendered := Render(source)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current, exists := c.entries[id]
+	if exists && current.revision > revision {
+		// A request that read the post before an edit finished last
+		return rendered
+	}
+	if !exists && len(c.entries) >= c.size {
+		// Evict an arbitrary post; popular ones are rendered again on the
+		// next view
+		for evict := range c.entries {
+			delete(c.entries, evict)
+			break
+		}
+	}
+	c.entries[id] = entry{revision: revision, html: rendered}
+	return rendered
+}
+
+// Len reports how many posts are cached.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,73 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name, source string
+		want         []string
+		notWant      []string
+	}{
+		{"formatting", "# Boo\n\n**loud** and _quiet_\n\n- one\n- two",
+			[]string{"<h1", "Boo</h1>", "<strong>loud</strong>", "<em>quiet</em>", "<li>one</li>"}, nil},
+		{"line breaks kept", "first line\nsecond line", []string{"first line<br"}, nil},
+		{"code language", "```go\nfmt.Println(\"boo\")\n```", []string{`<code class="language-go">`}, nil},
+		{"links are nofollow", "[ghosts](https://example.com)", []string{`href="https://example.com"`, `rel="nofollow`}, nil},
+		{"raw HTML dropped", "<script>alert(1)</script><b onclick=\"x()\">hi</b>", nil, []string{"<script", "onclick", "alert(1)"}},
+		{"javascript links dropped", "[click](javascript:alert(1))", nil, []string{"javascript:"}},
+		{"image handlers dropped", "![x](https://example.com/a.png\" onerror=\"alert(1))", nil, []string{`onerror="`}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			html := string(Render(test.source))
+			for _, want := range test.want {
+				if !strings.Contains(html, want) {
+					t.Errorf("missing %q in %s", want, html)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(html, notWant) {
+					t.Errorf("unsafe %q survived in %s", notWant, html)
+				}
+			}
+		})
+	}
+}
+
+func TestCacheRevisions(t *testing.T) {
+	cache := NewCache(2)
+
+	if html := cache.Render(1, 1, "*first*"); !strings.Contains(string(html), "<em>first</em>") {
+		t.Fatalf("rendered %s", html)
+	}
+	// Same revision: served from the cache even if the source differs
+	if html := cache.Render(1, 1, "*changed*"); !strings.Contains(string(html), "first") {
+		t.Errorf("revision 1 re-rendered: %s", html)
+	}
+	if html := cache.Render(1, 2, "*changed*"); !strings.Contains(string(html), "changed") {
+		t.Errorf("revision 2 served stale HTML: %s", html)
+	}
+	// An older revision rendered late doesn't replace the newer one
+	cache.Render(1, 1, "*first*")
+	if html := cache.Render(1, 2, "*ignored*"); !strings.Contains(string(html), "changed") {
+		t.Errorf("older revision replaced newer: %s", html)
+	}
+
+	cache.Render(2, 1, "two")
+	cache.Render(3, 1, "three")
+	if cache.Len() != 2 {
+		t.Errorf("cache holds %d posts, want at most 2", cache.Len())
+	}
+}
+
+func TestSummary(t *testing.T) {
+	if got := Summary("# Boo\n\nA **ghost** & <b>[friend](https://example.com)", 100); got != "Boo A ghost & friend" {
+		t.Errorf("Summary = %q", got)
+	}
+	if got := Summary("one two three four", 12); got != "one two…" {
+		t.Errorf("shortened Summary = %q", got)
+	}
+}
@@ -0,0 +1,34 @@
+package markdown
+
+import (
+	"bytes"
+	"html"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var plainText = bluemonday.StrictPolicy()
+
+// Summary returns the text of a post without markup, shortened to at most
+// max characters at a word boundary, for meta descriptions and previews.
+func Summary(source string, max int) string {
+	var buf bytes.Buffer
+	if err := converter.Convert([]byte(source), &buf); err != nil {
+		buf.Reset()
+		buf.WriteString(html.EscapeString(source))
+	}
+	// Tags are dropped and entities decoded; the template escapes again
+	text := strings.Join(strings.Fields(html.UnescapeString(plainText.Sanitize(buf.String()))), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := string(runes[:max-1])
+	if i := strings.LastIndexByte(cut, ' '); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ,.;:") + "…"
+}
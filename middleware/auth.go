@@ -1,11 +1,10 @@
 package middleware
 
 import (
-	"fmt"
-	"net/http"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"time"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Session struct {
@@ -14,38 +13,14 @@ type Session struct {
 	ExpireAt time.Time
 }
 
-var Sessions = make(map[string]*Session)
-
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
-
-}
-
-func CheckPassword(password, hash string) bool {
-	fmt.Printf("CheckPassword - Comparing password: '%s' with hash: %s\n", password, hash)
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	fmt.Printf("CheckPassword - bcrypt error: %v\n", err)
-	result := err == nil
-	fmt.Printf("CheckPassword - Final result: %t\n", result)
-	return result
-}
-
+// GenerateToken returns a random session token with 256 bits of entropy.
 func GenerateToken() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	return base64.RawURLEncoding.EncodeToString(randomBytes(tokenBytes))
 }
 
-func GetSession(r *http.Request) (Session, bool) {
-	cookie, err := r.Cookie("session_token")
-	if err != nil {
-		return Session{}, false
-	}
-
-	session, exists := Sessions[cookie.Value]
-	if !exists || time.Now().After(session.ExpireAt) {
-		return Session{}, false
-
-	}
-	return *session, true
-
+// HashToken hashes a random token for storage, so a database leak doesn't
+// hand out usable tokens.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookieName = "session_token"
+	tokenBytes        = 32
+	// MinSecretLength is the shortest SESSION_SECRET accepted
+	MinSecretLength = 32
+)
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	// crypto/rand.Read never returns an error on supported platforms
+	rand.Read(b)
+	return b
+}
+
+func (s *Sessions) sign(value string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignToken returns the cookie value for a session token: token.signature
+func (s *Sessions) SignToken(token string) string {
+	return token + "." + s.sign(token)
+}
+
+// VerifyToken checks the signature of a cookie value and returns the token.
+func (s *Sessions) VerifyToken(value string) (string, bool) {
+	token, signature, found := strings.Cut(value, ".")
+	if !found || token == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(token))) {
+		return "", false
+	}
+	return token, true
+}
+
+// Token returns the verified session token from the request cookie.
+// Tampered or forged cookies are rejected before any store lookup.
+func (s *Sessions) Token(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	return s.VerifyToken(cookie.Value)
+}
+
+// SetCookie writes the signed session cookie.
+func (s *Sessions) SetCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    s.SignToken(token),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie removes the session cookie from the browser.
+func ClearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+const (
+	mfaCookieName = "mfa_pending"
+	// MFAPendingLifetime is how long a user has to enter their 2FA code
+	// after the password was accepted.
+	MFAPendingLifetime = 5 * time.Minute
+)
+
+// SetPendingMFACookie remembers, in a signed cookie, that userID passed the
+// password check and still has to complete two-factor authentication.
+func (s *Sessions) SetPendingMFACookie(w http.ResponseWriter, r *http.Request, userID int) {
+	expires := time.Now().Add(MFAPendingLifetime)
+	value := fmt.Sprintf("mfa:%d:%d", userID, expires.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaCookieName,
+		Value:    s.SignToken(value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// PendingMFAUser returns the user waiting for the second login step.
+func (s *Sessions) PendingMFAUser(r *http.Request) (int, bool) {
+	cookie, err := r.Cookie(mfaCookieName)
+	if err != nil {
+		return 0, false
+	}
+	value, ok := s.VerifyToken(cookie.Value)
+	if !ok {
+		return 0, false
+	}
+	var userID int
+	var expires int64
+	if _, err := fmt.Sscanf(value, "mfa:%d:%d", &userID, &expires); err != nil {
+		return 0, false
+	}
+	if time.Now().Unix() > expires {
+		return 0, false
+	}
+	return userID, true
+}
+
+// ClearPendingMFACookie removes the second-step cookie.
+func ClearPendingMFACookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     mfaCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
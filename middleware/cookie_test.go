@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyToken(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+	token := GenerateToken()
+
+	got, ok := sessions.VerifyToken(sessions.SignToken(token))
+	if !ok || got != token {
+		t.Fatalf("Signed token did not verify: got %q, ok %t", got, ok)
+	}
+
+	if _, ok := sessions.VerifyToken(token); ok {
+		t.Error("Unsigned token was accepted")
+	}
+	if _, ok := sessions.VerifyToken(token + ".forged"); ok {
+		t.Error("Forged signature was accepted")
+	}
+	if _, ok := sessions.VerifyToken(GenerateToken() + "." + sessions.sign(token)); ok {
+		t.Error("Signature from another token was accepted")
+	}
+}
+
+func TestSetSessionCookie(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+	token := GenerateToken()
+
+	rec := httptest.NewRecorder()
+	sessions.SetCookie(rec, httptest.NewRequest("POST", "/login", nil), token, time.Now().Add(time.Hour))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	got, ok := sessions.Token(req)
+	if !ok || got != token {
+		t.Errorf("Expected token %q from cookie, got %q", token, got)
+	}
+}
+
+func TestSessionsRejectOtherSecret(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+	other := NewSessions(NewMemoryStore(), []byte("another-secret-that-is-long-enough"), time.Hour)
+	token := GenerateToken()
+
+	if _, ok := other.VerifyToken(sessions.SignToken(token)); ok {
+		t.Error("Token signed with another secret was accepted")
+	}
+	if _, ok := NewSessions(NewMemoryStore(), nil, time.Hour).VerifyToken(sessions.SignToken(token)); ok {
+		t.Error("Token was accepted by sessions with a random key")
+	}
+}
+
+func TestSessionsStartAndGet(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+
+	rec := httptest.NewRecorder()
+	started, err := sessions.Start(rec, httptest.NewRequest("POST", "/login", nil), "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	session, ok := sessions.Get(req)
+	if !ok || session.UserID != "7" || session.Token != started.Token {
+		t.Fatalf("Expected session of user 7, got %+v (ok %t)", session, ok)
+	}
+
+	if _, ok := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour).Get(req); ok {
+		t.Error("Session was found in a store that never created it")
+	}
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+	handler := sessions.CSRFProtect(1 << 20)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(CSRFToken(r)))
+	}))
+
+	// A GET issues the anonymous cookie and the matching token
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/login", nil))
+	token := rec.Body.String()
+	cookies := rec.Result().Cookies()
+	if token == "" || len(cookies) == 0 {
+		t.Fatal("Expected CSRF token and cookie on GET")
+	}
+
+	post := func(formToken string) int {
+		form := url.Values{CSRFFieldName: {formToken}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post(token); code != http.StatusOK {
+		t.Errorf("Valid token rejected with status %d", code)
+	}
+	if code := post(""); code != http.StatusForbidden {
+		t.Errorf("Missing token accepted with status %d", code)
+	}
+	if code := post("forged"); code != http.StatusForbidden {
+		t.Errorf("Forged token accepted with status %d", code)
+	}
+}
+
+func TestCSRFTokenBoundToSession(t *testing.T) {
+	sessions := NewSessions(NewMemoryStore(), []byte("test-secret-that-is-long-enough-1234"), time.Hour)
+	handler := sessions.CSRFProtect(1 << 20)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("POST", "/post/delete", nil)
+	req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: sessions.SignToken("session-a")})
+	req.Header.Set(CSRFHeaderName, sessions.csrfTokenFor("session-b"))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Token from another session accepted with status %d", rec.Code)
+	}
+}
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing schemes. Stored hashes identify their own scheme, so
+// CheckPassword works for both no matter which one is configured.
+const (
+	SchemeBcrypt   = "bcrypt"
+	SchemeArgon2id = "argon2id"
+
+	DefaultBcryptCost = 12
+	argon2SaltLength  = 16
+	argon2Prefix      = "$argon2id$"
+)
+
+// Argon2Params are the argon2id cost settings. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params follow the RFC 9106 second recommended option.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLen: 32}
+
+// PasswordConfig selects how new password hashes are made.
+type PasswordConfig struct {
+	Scheme     string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+var (
+	passwordConfig = PasswordConfig{Scheme: SchemeBcrypt, BcryptCost: DefaultBcryptCost, Argon2: DefaultArgon2Params}
+	passwordMu     sync.RWMutex
+)
+
+// Validate reports whether config names a known scheme with usable
+// parameters.
+func (config PasswordConfig) Validate() error {
+	switch config.Scheme {
+	case SchemeBcrypt:
+		if config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case SchemeArgon2id:
+		if config.Argon2.Time < 1 || config.Argon2.Memory < 8*uint32(config.Argon2.Threads) ||
+			config.Argon2.Threads < 1 || config.Argon2.KeyLen < 16 {
+			return errors.New("invalid argon2id parameters")
+		}
+	default:
+		return fmt.Errorf("unknown password hash scheme %q", config.Scheme)
+	}
+	return nil
+}
+
+// SetPasswordConfig validates and installs config for new hashes.
+func SetPasswordConfig(config PasswordConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	passwordMu.Lock()
+	passwordConfig = config
+	passwordMu.Unlock()
+	return nil
+}
+
+func currentPasswordConfig() PasswordConfig {
+	passwordMu.RLock()
+	defer passwordMu.RUnlock()
+	return passwordConfig
+}
+
+// HashPassword hashes password with the configured scheme.
+func HashPassword(password string) (string, error) {
+	config := currentPasswordConfig()
+	if config.Scheme == SchemeArgon2id {
+		return hashArgon2id(password, config.Argon2), nil
+	}
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), config.BcryptCost)
+	return string(bytes), err
+}
+
+// CheckPassword reports whether password matches hash, in either scheme.
+func CheckPassword(password, hash string) bool {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+		return subtle.ConstantTimeCompare(computed, key) == 1
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return err == nil
+}
+
+// NeedsRehash reports whether hash was made with a different scheme or cost
+// than the current configuration. Call it only after CheckPassword succeeds,
+// since that is the one time the plaintext is available to rehash.
+func NeedsRehash(hash string) bool {
+	config := currentPasswordConfig()
+
+	if strings.HasPrefix(hash, argon2Prefix) {
+		if config.Scheme != SchemeArgon2id {
+			return true
+		}
+		params, _, _, err := decodeArgon2id(hash)
+		return err != nil || params != config.Argon2
+	}
+
+	if config.Scheme != SchemeBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != config.BcryptCost
+}
+
+// hashArgon2id returns the PHC string form used by the reference
+// implementation: $argon2id$v=19$m=...,t=...,p=...$salt$key
+func hashArgon2id(password string, params Argon2Params) string {
+	salt := randomBytes(argon2SaltLength)
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version,
+		params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, err
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap argon2id settings so the tests stay fast
+var testArgon2Params = Argon2Params{Time: 1, Memory: 64, Threads: 1, KeyLen: 32}
+
+func withPasswordConfig(t *testing.T, config PasswordConfig) {
+	t.Helper()
+	previous := currentPasswordConfig()
+	if err := SetPasswordConfig(config); err != nil {
+		t.Fatalf("SetPasswordConfig: %v", err)
+	}
+	t.Cleanup(func() { SetPasswordConfig(previous) })
+}
+
+func TestHashPasswordUsesConfiguredCost(t *testing.T) {
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeBcrypt, BcryptCost: bcrypt.MinCost})
+
+	hash, err := HashPassword("password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if cost, _ := bcrypt.Cost([]byte(hash)); cost != bcrypt.MinCost {
+		t.Errorf("Hash cost = %d, want %d", cost, bcrypt.MinCost)
+	}
+	if NeedsRehash(hash) {
+		t.Error("Fresh hash should not need rehashing")
+	}
+
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeBcrypt, BcryptCost: bcrypt.MinCost + 1})
+	if !NeedsRehash(hash) {
+		t.Error("Hash with an old cost should need rehashing")
+	}
+	if !CheckPassword("password", hash) {
+		t.Error("Old hash should still verify after a cost change")
+	}
+}
+
+func TestArgon2idPassword(t *testing.T) {
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeArgon2id, Argon2: testArgon2Params})
+
+	hash, err := HashPassword("password")
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Unexpected argon2id encoding: %s", hash)
+	}
+	if !CheckPassword("password", hash) {
+		t.Error("Password check failed")
+	}
+	if CheckPassword("wrong", hash) {
+		t.Error("Wrong password was accepted")
+	}
+	if NeedsRehash(hash) {
+		t.Error("Fresh hash should not need rehashing")
+	}
+
+	stronger := testArgon2Params
+	stronger.Time = 2
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeArgon2id, Argon2: stronger})
+	if !NeedsRehash(hash) {
+		t.Error("Hash with old parameters should need rehashing")
+	}
+}
+
+func TestNeedsRehashOnSchemeChange(t *testing.T) {
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeBcrypt, BcryptCost: bcrypt.MinCost})
+	bcryptHash, _ := HashPassword("password")
+
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeArgon2id, Argon2: testArgon2Params})
+	if !NeedsRehash(bcryptHash) {
+		t.Error("bcrypt hash should need rehashing when argon2id is configured")
+	}
+	if !CheckPassword("password", bcryptHash) {
+		t.Error("bcrypt hash should still verify when argon2id is configured")
+	}
+
+	argonHash, _ := HashPassword("password")
+	withPasswordConfig(t, PasswordConfig{Scheme: SchemeBcrypt, BcryptCost: bcrypt.MinCost})
+	if !NeedsRehash(argonHash) {
+		t.Error("argon2id hash should need rehashing when bcrypt is configured")
+	}
+}
+
+func TestCheckPasswordRejectsMalformedHash(t *testing.T) {
+	for _, hash := range []string{"", "plaintext", "$argon2id$v=19$m=64", "$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		if CheckPassword("password", hash) {
+			t.Errorf("Malformed hash %q was accepted", hash)
+		}
+	}
+}
+
+func TestSetPasswordConfigValidation(t *testing.T) {
+	invalid := []PasswordConfig{
+		{Scheme: SchemeBcrypt, BcryptCost: 2},
+		{Scheme: SchemeBcrypt, BcryptCost: 40},
+		{Scheme: SchemeArgon2id, Argon2: Argon2Params{}},
+		{Scheme: "md5"},
+	}
+	for _, config := range invalid {
+		if err := SetPasswordConfig(config); err == nil {
+			t.Errorf("Config %+v was accepted", config)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per key (client IP, username, ...). Each
+// bucket holds up to limit tokens and refills at limit tokens per period.
+type RateLimiter struct {
+	mu        sync.Mutex
+	limit     float64
+	perSecond float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(limit int, per time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:     float64(limit),
+		perSecond: float64(limit) / per.Seconds(),
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket for key and reports whether one
+// was available.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.limit, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.perSecond
+	if b.tokens > l.limit {
+		b.tokens = l.limit
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune drops buckets that have refilled completely, so the map doesn't grow
+// with every IP that ever visited.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.perSecond >= l.limit {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+const (
+	// MaxLoginFailures is how many wrong passwords an account gets before
+	// it is locked.
+	MaxLoginFailures = 5
+	baseLockout      = time.Minute
+	maxLockout       = 24 * time.Hour
+)
+
+// LockoutDuration returns how long an account stays locked after the given
+// number of consecutive failures. It doubles with every failure past
+// MaxLoginFailures, up to a day.
+func LockoutDuration(failures int) time.Duration {
+	if failures < MaxLoginFailures {
+		return 0
+	}
+	duration := baseLockout
+	for i := MaxLoginFailures; i < failures; i++ {
+		duration *= 2
+		if duration >= maxLockout {
+			return maxLockout
+		}
+	}
+	return duration
+}
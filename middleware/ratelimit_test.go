@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(3, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("1.2.3.4") {
+			t.Fatalf("Request %d was rejected within the limit", i+1)
+		}
+	}
+	if limiter.Allow("1.2.3.4") {
+		t.Error("Request over the limit was allowed")
+	}
+	if !limiter.Allow("5.6.7.8") {
+		t.Error("Different key shared the same bucket")
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{MaxLoginFailures - 1, 0},
+		{MaxLoginFailures, time.Minute},
+		{MaxLoginFailures + 1, 2 * time.Minute},
+		{MaxLoginFailures + 3, 8 * time.Minute},
+		{MaxLoginFailures + 50, 24 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := LockoutDuration(tt.failures); got != tt.want {
+			t.Errorf("LockoutDuration(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package middleware
+
+import (
+	"database/sql"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionStore persists login sessions so they survive restarts and can be
+// shared between several webapp instances. Implementations must be safe for
+// concurrent use by every request goroutine.
+type SessionStore interface {
+	Create(session *Session) error
+	Lookup(token string) (*Session, bool)
+	Touch(token string, expireAt time.Time) error
+	Revoke(token string) error
+	RevokeAllForUser(userID string) (int64, error)
+	DeleteExpired() (int64, error)
+}
+
+// Sessions logs users in: it keeps their sessions in Store, signs the
+// session cookie with a secret key and renews sessions so they last
+// Lifetime from the last activity. The app builds one from the
+// configuration and hands it to the handlers and the session middleware.
+type Sessions struct {
+	Store    SessionStore
+	Lifetime time.Duration
+	secret   []byte
+}
+
+// NewSessions returns Sessions that sign cookies with secret, or with a
+// random key for this process if secret is empty.
+func NewSessions(store SessionStore, secret []byte, lifetime time.Duration) *Sessions {
+	if len(secret) == 0 {
+		secret = randomBytes(tokenBytes)
+	}
+	return &Sessions{Store: store, Lifetime: lifetime, secret: secret}
+}
+
+// Get returns the session of the logged-in user making the request.
+func (s *Sessions) Get(r *http.Request) (Session, bool) {
+	token, ok := s.Token(r)
+	if !ok {
+		return Session{}, false
+	}
+
+	session, exists := s.Store.Lookup(token)
+	if !exists || time.Now().After(session.ExpireAt) {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// Start creates a session for userID and sets its cookie.
+func (s *Sessions) Start(w http.ResponseWriter, r *http.Request, userID string) (Session, error) {
+	session := Session{Token: GenerateToken(), UserID: userID, ExpireAt: time.Now().Add(s.Lifetime)}
+	if err := s.Store.Create(&session); err != nil {
+		return Session{}, err
+	}
+	s.SetCookie(w, r, session.Token, session.ExpireAt)
+	return session, nil
+}
+
+const memoryStoreShards = 16
+
+type memoryShard struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+// MemoryStore keeps sessions in process memory, split across shards so that
+// concurrent requests rarely wait on the same lock. Used by tests and as a
+// fallback before the database is available.
+type MemoryStore struct {
+	shards [memoryStoreShards]*memoryShard
+}
+
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{sessions: make(map[string]*Session)}
+	}
+	return m
+}
+
+func (m *MemoryStore) shard(token string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return m.shards[h.Sum32()%memoryStoreShards]
+}
+
+func (m *MemoryStore) Create(session *Session) error {
+	shard := m.shard(session.Token)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	copied := *session
+	shard.sessions[session.Token] = &copied
+	return nil
+}
+
+func (m *MemoryStore) Lookup(token string) (*Session, bool) {
+	shard := m.shard(token)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	session, exists := shard.sessions[token]
+	if !exists {
+		return nil, false
+	}
+	copied := *session
+	return &copied, true
+}
+
+func (m *MemoryStore) Touch(token string, expireAt time.Time) error {
+	shard := m.shard(token)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if session, exists := shard.sessions[token]; exists {
+		session.ExpireAt = expireAt
+	}
+	return nil
+}
+
+func (m *MemoryStore) Revoke(token string) error {
+	shard := m.shard(token)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.sessions, token)
+	return nil
+}
+
+func (m *MemoryStore) RevokeAllForUser(userID string) (int64, error) {
+	return m.deleteWhere(func(session *Session) bool {
+		return session.UserID == userID
+	}), nil
+}
+
+func (m *MemoryStore) DeleteExpired() (int64, error) {
+	now := time.Now()
+	return m.deleteWhere(func(session *Session) bool {
+		return now.After(session.ExpireAt)
+	}), nil
+}
+
+func (m *MemoryStore) deleteWhere(match func(*Session) bool) int64 {
+	var removed int64
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for token, session := range shard.sessions {
+			if match(session) {
+				delete(shard.sessions, token)
+				removed++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return removed
+}
+
+// MySQLStore keeps sessions in the sessions table created by the migrations.
+// Its queries are plain SQL, so it works on the SQLite backend too.
+// database/sql handles the locking, so it is safe for concurrent use.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) Create(session *Session) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sessions (token, user_id, expires_at)
+		VALUES (?, ?, ?)
+	`, session.Token, session.UserID, session.ExpireAt)
+	return err
+}
+
+func (s *MySQLStore) Lookup(token string) (*Session, bool) {
+	var session Session
+	err := s.db.QueryRow("SELECT token, user_id, expires_at FROM sessions WHERE token = ?", token).
+		Scan(&session.Token, &session.UserID, &session.ExpireAt)
+	if err != nil {
+		return nil, false
+	}
+	return &session, true
+}
+
+func (s *MySQLStore) Touch(token string, expireAt time.Time) error {
+	_, err := s.db.Exec("UPDATE sessions SET expires_at = ? WHERE token = ?", expireAt, token)
+	return err
+}
+
+func (s *MySQLStore) Revoke(token string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE token = ?", token)
+	return err
+}
+
+func (s *MySQLStore) RevokeAllForUser(userID string) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *MySQLStore) DeleteExpired() (int64, error) {
+	result, err := s.db.Exec("DELETE FROM sessions WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartGC removes expired sessions from the store every interval until
+// stop is closed.
+func (s *Sessions) StartGC(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Store.DeleteExpired(); err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Renew extends sessions that are past half their lifetime, so active
+// users are not logged out in the middle of their work.
+func (s *Sessions) Renew(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if session, ok := s.Get(r); ok && time.Until(session.ExpireAt) < s.Lifetime/2 {
+			expireAt := time.Now().Add(s.Lifetime)
+			if err := s.Store.Touch(session.Token, expireAt); err == nil {
+				s.SetCookie(w, r, session.Token, expireAt)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
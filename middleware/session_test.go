@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	session := &Session{Token: "abc", UserID: "1", ExpireAt: time.Now().Add(time.Hour)}
+
+	if err := store.Create(session); err != nil {
+		t.Fatalf("Error creating session: %v", err)
+	}
+
+	got, exists := store.Lookup("abc")
+	if !exists || got.UserID != "1" {
+		t.Fatalf("Expected session for user 1, got %v", got)
+	}
+
+	later := time.Now().Add(2 * time.Hour)
+	store.Touch("abc", later)
+	if got, _ := store.Lookup("abc"); !got.ExpireAt.Equal(later) {
+		t.Errorf("Touch did not extend session, expires %v", got.ExpireAt)
+	}
+
+	if err := store.Revoke("abc"); err != nil {
+		t.Fatalf("Error revoking session: %v", err)
+	}
+	if _, exists := store.Lookup("abc"); exists {
+		t.Error("Revoked session still exists")
+	}
+}
+
+func TestMemoryStoreDeleteExpired(t *testing.T) {
+	store := NewMemoryStore()
+	store.Create(&Session{Token: "old", UserID: "1", ExpireAt: time.Now().Add(-time.Minute)})
+	store.Create(&Session{Token: "new", UserID: "2", ExpireAt: time.Now().Add(time.Hour)})
+
+	removed, err := store.DeleteExpired()
+	if err != nil {
+		t.Fatalf("Error deleting expired sessions: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 expired session removed, got %d", removed)
+	}
+	if _, exists := store.Lookup("new"); !exists {
+		t.Error("Valid session was removed")
+	}
+}
+
+func TestMemoryStoreRevokeAllForUser(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < 5; i++ {
+		store.Create(&Session{Token: fmt.Sprintf("a%d", i), UserID: "1", ExpireAt: time.Now().Add(time.Hour)})
+	}
+	store.Create(&Session{Token: "b", UserID: "2", ExpireAt: time.Now().Add(time.Hour)})
+
+	removed, _ := store.RevokeAllForUser("1")
+	if removed != 5 {
+		t.Errorf("Expected 5 sessions revoked, got %d", removed)
+	}
+	if _, exists := store.Lookup("b"); !exists {
+		t.Error("Other user's session was revoked")
+	}
+}
+
+// Run with -race to catch unsynchronized access
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	store := NewMemoryStore()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token := fmt.Sprintf("token-%d", i)
+			userID := fmt.Sprintf("%d", i%5)
+			store.Create(&Session{Token: token, UserID: userID, ExpireAt: time.Now().Add(time.Hour)})
+			store.Lookup(token)
+			store.Touch(token, time.Now().Add(2*time.Hour))
+			store.DeleteExpired()
+			if i%10 == 0 {
+				store.RevokeAllForUser(userID)
+			} else {
+				store.Revoke(token)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
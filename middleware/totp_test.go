@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret "12345678901234567890" from RFC 6238 appendix B, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := TOTPCode(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("Error computing code: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := GenerateTOTPSecret()
+	now := time.Now()
+
+	code, _ := TOTPCode(secret, now)
+	step, ok := VerifyTOTP(secret, code, now, 0)
+	if !ok || step != now.Unix()/30 {
+		t.Errorf("Current code: step %d, ok %v", step, ok)
+	}
+
+	previous, _ := TOTPCode(secret, now.Add(-30*time.Second))
+	if _, ok := VerifyTOTP(secret, previous, now, 0); !ok {
+		t.Error("Code from previous step was rejected")
+	}
+
+	old, _ := TOTPCode(secret, now.Add(-5*time.Minute))
+	if _, ok := VerifyTOTP(secret, old, now, 0); old != code && ok {
+		t.Error("Expired code was accepted")
+	}
+
+	if _, ok := VerifyTOTP(secret, "abc", now, 0); ok {
+		t.Error("Malformed code was accepted")
+	}
+
+	// Once a step is used, its code and earlier ones are refused
+	if _, ok := VerifyTOTP(secret, code, now.Add(20*time.Second), step); ok {
+		t.Error("Replayed code was accepted")
+	}
+	if _, ok := VerifyTOTP(secret, previous, now, step); previous != code && ok {
+		t.Error("Code older than the last used step was accepted")
+	}
+	next, _ := TOTPCode(secret, now.Add(30*time.Second))
+	if _, ok := VerifyTOTP(secret, next, now, step); !ok {
+		t.Error("Code from the next step was rejected")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("Haunted Blog", "bob", "SECRET")
+	if !strings.HasPrefix(uri, "otpauth://totp/Haunted%20Blog:bob?") || !strings.Contains(uri, "secret=SECRET") {
+		t.Errorf("Unexpected provisioning URI: %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes := GenerateRecoveryCodes(RecoveryCodeCount)
+	if len(codes) != RecoveryCodeCount {
+		t.Fatalf("Expected %d codes, got %d", RecoveryCodeCount, len(codes))
+	}
+	if codes[0] == codes[1] {
+		t.Error("Recovery codes are not unique")
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(" "+strings.ToUpper(codes[0])+" ") {
+		t.Error("Recovery code hash is not normalized")
+	}
+}
@@ -1,26 +0,0 @@
--- Database migration script for profile system
--- Run this manually if the automatic migration fails
-
--- Add profile columns to users table
-ALTER TABLE users ADD COLUMN bio TEXT;
-ALTER TABLE users ADD COLUMN profile_image VARCHAR(255);
-ALTER TABLE users ADD COLUMN location VARCHAR(100);
-ALTER TABLE users ADD COLUMN website VARCHAR(255);
-ALTER TABLE users ADD COLUMN updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP;
-
--- Create profile_images table
-CREATE TABLE IF NOT EXISTS profile_images (
-    id INT AUTO_INCREMENT PRIMARY KEY,
-    user_id INT NOT NULL,
-    filename VARCHAR(255) NOT NULL,
-    original_name VARCHAR(255) NOT NULL,
-    file_path VARCHAR(500) NOT NULL,
-    file_size INT NOT NULL,
-    mime_type VARCHAR(100) NOT NULL,
-    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-);
-
--- Verify the changes
-DESCRIBE users;
-DESCRIBE profile_images;
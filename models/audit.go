@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// AuditEvent is one row of the audit trail. ActorID is nil for anonymous
+// actors such as a failed login or the CLI.
+type AuditEvent struct {
+	ID         int64
+	ActorID    *int
+	ActorName  string
+	Action     string
+	TargetType string
+	TargetID   string
+	IP         string
+	UserAgent  string
+	Metadata   string
+	CreatedAt  time.Time
+}
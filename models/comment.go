@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Comment is a response to a post, or a reply to another comment when
+// ParentID is set.
+type Comment struct {
+	ID       int
+	PostID   int
+	ParentID *int
+	AuthorID int
+	Username string
+	Content  string
+	// PostTitle and PostSlug are filled in for the moderation list
+	PostTitle string
+	PostSlug  string
+	CreatedAt time.Time
+	EditedAt  *time.Time
+	// Deleted comments, and those whose author is in the trash, are kept
+	// only to hold their replies in place
+	Deleted bool
+	// Hidden comments were removed by a moderator
+	Hidden   bool
+	HiddenAt *time.Time
+}
@@ -1,11 +1,25 @@
 package models
 
-import "time"
+import (
+	"html/template"
+	"time"
+)
 
 type Post struct {
-	ID        int
-	Title     string
-	Content   string
+	ID    int
+	Title string
+	// Slug addresses the post at /post/{slug} and is made from the title
+	Slug string
+	// Content is Markdown; HTML is its sanitized rendering, filled in by
+	// the handlers before a post is shown
+	Content string
+	HTML    template.HTML
+	// Revision goes up by one with every edit
+	Revision int
+	// CommentCount counts the comments readers can see
+	CommentCount int
+	// Tags are the names of the post's tags, alphabetically
+	Tags      []string
 	AuthorID  int
 	Author    string
 	Username  string
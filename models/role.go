@@ -0,0 +1,10 @@
+package models
+
+// Role is a named set of permissions. Users are granted roles, never
+// permissions directly.
+type Role struct {
+	ID          int
+	Name        string
+	Description string
+	Permissions []string
+}
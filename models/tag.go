@@ -0,0 +1,9 @@
+package models
+
+// Tag groups posts by topic and has a page at /tag/{name}.
+type Tag struct {
+	ID   int
+	Name string
+	// PostCount counts the tagged posts readers can see
+	PostCount int
+}
@@ -3,19 +3,40 @@ package models
 import "time"
 
 type User struct {
-	ID             int       `json:"id"`
-	Username       string    `json:"username"`
-	Password       string    `json:"password"`
-	Email          string    `json:"email"`
-	Bio            string    `json:"bio"`
-	ProfileImage   string    `json:"profile_image"`
-	Location       string    `json:"location"`
-	Website        string    `json:"website"`
-	InvitationCode string    `json:"invitation_code"`
-	InvitedBy      *int      `json:"invited_by"`
-	IsAdmin        bool      `json:"is_admin"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             int        `json:"id"`
+	Username       string     `json:"username"`
+	Password       string     `json:"password"`
+	Email          string     `json:"email"`
+	Bio            string     `json:"bio"`
+	ProfileImage   string     `json:"profile_image"`
+	Location       string     `json:"location"`
+	Website        string     `json:"website"`
+	InvitationCode string     `json:"invitation_code"`
+	InvitedBy      *int       `json:"invited_by"`
+	IsAdmin        bool       `json:"is_admin"`
+	Roles          []string   `json:"roles"`
+	TOTPEnabled    bool       `json:"totp_enabled"`
+	TOTPSecret     string     `json:"-"`
+	TOTPLastStep   int64      `json:"-"`
+	SuspendedAt    *time.Time `json:"suspended_at"`
+	ResetRequired  bool       `json:"password_reset_required"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// IsSuspended reports whether an admin has suspended the account.
+func (u User) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// HasRole reports whether name is one of the user's loaded roles.
+func (u User) HasRole(name string) bool {
+	for _, role := range u.Roles {
+		if role == name {
+			return true
+		}
+	}
+	return false
 }
 
 type InvitationCode struct {
@@ -39,3 +60,16 @@ type ProfileImage struct {
 	MimeType     string    `json:"mime_type"`
 	CreatedAt    time.Time `json:"created_at"`
 }
+
+type FailedLogin struct {
+	Username     string     `json:"username"`
+	Failures     int        `json:"failures"`
+	LastIP       string     `json:"last_ip"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until"`
+}
+
+// IsLocked reports whether the lockout is still in effect.
+func (f FailedLogin) IsLocked() bool {
+	return f.LockedUntil != nil && f.LockedUntil.After(time.Now())
+}
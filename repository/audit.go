@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+	"webapp/models"
+)
+
+const maxAuditUserAgentSize = 255
+
+// AuditFilter narrows AuditRepository.List. Empty fields match everything.
+type AuditFilter struct {
+	Actor string
+	// Action matches the action itself and, for a prefix such as "user",
+	// every user.* action
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+	Offset     int
+}
+
+// AuditRepository stores the audit trail. The actions are listed in the
+// database package.
+type AuditRepository interface {
+	// Record stores event. metadata is encoded as JSON and may be nil.
+	Record(ctx context.Context, event models.AuditEvent, metadata map[string]interface{}) error
+	// List returns matching events, newest first, 100 at a time unless
+	// filter.Limit says otherwise
+	List(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error)
+}
+
+// SQLAuditRepository is the AuditRepository backed by the database.
+type SQLAuditRepository struct {
+	db *sql.DB
+}
+
+func NewSQLAuditRepository(db *sql.DB) *SQLAuditRepository {
+	return &SQLAuditRepository{db: db}
+}
+
+func (s *SQLAuditRepository) Record(ctx context.Context, event models.AuditEvent, metadata map[string]interface{}) error {
+	var encoded interface{}
+	if len(metadata) > 0 {
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		encoded = string(data)
+	}
+
+	if len(event.UserAgent) > maxAuditUserAgentSize {
+		event.UserAgent = event.UserAgent[:maxAuditUserAgentSize]
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_events (actor_id, actor_name, action, target_type, target_id, ip, user_agent, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, event.ActorID, event.ActorName, event.Action, event.TargetType, event.TargetID, event.IP, event.UserAgent, encoded)
+	return err
+}
+
+func (s *SQLAuditRepository) List(ctx context.Context, filter AuditFilter) ([]models.AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor_name = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "(action = ? OR action LIKE ?)")
+		args = append(args, filter.Action, filter.Action+".%")
+	}
+	if filter.TargetType != "" {
+		conditions = append(conditions, "target_type = ?")
+		args = append(args, filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		conditions = append(conditions, "target_id = ?")
+		args = append(args, filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.Until)
+	}
+
+	query := `SELECT id, actor_id, actor_name, action, target_type, target_id, ip, user_agent,
+		COALESCE(CAST(metadata AS CHAR), ''), created_at FROM audit_events`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	if filter.Limit <= 0 {
+		filter.Limit = 100
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var event models.AuditEvent
+		err := rows.Scan(&event.ID, &event.ActorID, &event.ActorName, &event.Action, &event.TargetType,
+			&event.TargetID, &event.IP, &event.UserAgent, &event.Metadata, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"webapp/models"
+)
+
+// CommentRepository stores comments on posts.
+type CommentRepository interface {
+	// ListByPost returns every comment on a post, oldest first. Deleted and
+	// hidden comments are included and flagged, so replies to them can
+	// still be shown in place.
+	ListByPost(ctx context.Context, postID int) ([]models.Comment, error)
+	// ListRecent returns up to limit of the newest comments on any post for
+	// moderators, only hidden ones if hiddenOnly is set. Deleted comments
+	// are left out.
+	ListRecent(ctx context.Context, limit int, hiddenOnly bool) ([]models.Comment, error)
+	// GetByID finds a comment that hasn't been deleted, on a post that
+	// hasn't been either
+	GetByID(ctx context.Context, id int) (models.Comment, error)
+
+	// Create adds a comment and returns its ID
+	Create(ctx context.Context, comment models.Comment) (int, error)
+	// Update saves new content and marks the comment edited
+	Update(ctx context.Context, comment models.Comment) error
+	SoftDelete(ctx context.Context, id int) error
+	// SetHidden hides a comment on behalf of moderatorID, or shows it again
+	SetHidden(ctx context.Context, id int, hidden bool, moderatorID int) error
+}
+
+// SQLCommentRepository is the CommentRepository backed by the database.
+type SQLCommentRepository struct {
+	db *sql.DB
+}
+
+func NewSQLCommentRepository(db *sql.DB) *SQLCommentRepository {
+	return &SQLCommentRepository{db: db}
+}
+
+const commentColumns = `c.id, c.post_id, c.parent_id, c.author_id, u.username, c.content,
+	p.title, COALESCE(p.slug, ''), c.created_at, c.edited_at,
+	c.deleted_at IS NOT NULL OR u.deleted_at IS NOT NULL, c.hidden_at`
+
+const commentTables = `comments c
+	JOIN users u ON c.author_id = u.id
+	JOIN posts p ON c.post_id = p.id`
+
+func scanComment(row scanner) (models.Comment, error) {
+	var comment models.Comment
+	var parentID sql.NullInt64
+	var editedAt, hiddenAt sql.NullTime
+	err := row.Scan(&comment.ID, &comment.PostID, &parentID, &comment.AuthorID, &comment.Username, &comment.Content,
+		&comment.PostTitle, &comment.PostSlug, &comment.CreatedAt, &editedAt, &comment.Deleted, &hiddenAt)
+	if err != nil {
+		return comment, notFound(err)
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		comment.ParentID = &id
+	}
+	if editedAt.Valid {
+		comment.EditedAt = &editedAt.Time
+	}
+	if hiddenAt.Valid {
+		comment.Hidden = true
+		comment.HiddenAt = &hiddenAt.Time
+	}
+	return comment, nil
+}
+
+func (s *SQLCommentRepository) queryComments(ctx context.Context, query string, args ...interface{}) ([]models.Comment, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []models.Comment
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+func (s *SQLCommentRepository) ListByPost(ctx context.Context, postID int) ([]models.Comment, error) {
+	return s.queryComments(ctx, `SELECT `+commentColumns+` FROM `+commentTables+`
+		WHERE c.post_id = ?
+		ORDER BY c.created_at, c.id`, postID)
+}
+
+func (s *SQLCommentRepository) ListRecent(ctx context.Context, limit int, hiddenOnly bool) ([]models.Comment, error) {
+	filter := ""
+	if hiddenOnly {
+		filter = " AND c.hidden_at IS NOT NULL"
+	}
+	return s.queryComments(ctx, `SELECT `+commentColumns+` FROM `+commentTables+`
+		WHERE c.deleted_at IS NULL AND p.deleted_at IS NULL`+filter+`
+		ORDER BY c.created_at DESC, c.id DESC
+		LIMIT ?`, limit)
+}
+
+func (s *SQLCommentRepository) GetByID(ctx context.Context, id int) (models.Comment, error) {
+	return scanComment(s.db.QueryRowContext(ctx, `SELECT `+commentColumns+` FROM `+commentTables+`
+		WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL`, id))
+}
+
+func (s *SQLCommentRepository) Create(ctx context.Context, comment models.Comment) (int, error) {
+	result, err := s.db.ExecContext(ctx, "INSERT INTO comments (post_id, parent_id, author_id, content) VALUES (?, ?, ?, ?)",
+		comment.PostID, comment.ParentID, comment.AuthorID, comment.Content)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *SQLCommentRepository) Update(ctx context.Context, comment models.Comment) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE comments SET content = ?, edited_at = NOW() WHERE id = ?", comment.Content, comment.ID)
+	return err
+}
+
+func (s *SQLCommentRepository) SoftDelete(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE comments SET deleted_at = NOW() WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLCommentRepository) SetHidden(ctx context.Context, id int, hidden bool, moderatorID int) error {
+	if !hidden {
+		_, err := s.db.ExecContext(ctx, "UPDATE comments SET hidden_at = NULL, hidden_by = NULL WHERE id = ?", id)
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, "UPDATE comments SET hidden_at = NOW(), hidden_by = ? WHERE id = ?", moderatorID, id)
+	return err
+}
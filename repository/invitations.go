@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"webapp/models"
+)
+
+// InvitationRepository stores the invitation codes needed to sign up.
+type InvitationRepository interface {
+	// Create stores code.Code for code.CreatedBy, expiring at code.ExpiresAt
+	Create(ctx context.Context, code models.InvitationCode) error
+	// ListByCreator returns the codes one user made, newest first
+	ListByCreator(ctx context.Context, createdBy int) ([]models.InvitationCode, error)
+	// GetUsable returns a code that is unused and unexpired
+	GetUsable(ctx context.Context, code string) (models.InvitationCode, error)
+}
+
+// SQLInvitationRepository is the InvitationRepository backed by the database.
+type SQLInvitationRepository struct {
+	db *sql.DB
+}
+
+func NewSQLInvitationRepository(db *sql.DB) *SQLInvitationRepository {
+	return &SQLInvitationRepository{db: db}
+}
+
+func (s *SQLInvitationRepository) Create(ctx context.Context, code models.InvitationCode) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO invitation_codes (code, created_by, expires_at)
+		VALUES (?, ?, ?)
+	`, code.Code, code.CreatedBy, code.ExpiresAt)
+	return err
+}
+
+func (s *SQLInvitationRepository) ListByCreator(ctx context.Context, createdBy int) ([]models.InvitationCode, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, code, created_by, used_by, is_used, expires_at, created_at, used_at
+		FROM invitation_codes
+		WHERE created_by = ?
+		ORDER BY created_at DESC
+	`, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []models.InvitationCode
+	for rows.Next() {
+		var code models.InvitationCode
+		err := rows.Scan(
+			&code.ID, &code.Code, &code.CreatedBy, &code.UsedBy,
+			&code.IsUsed, &code.ExpiresAt, &code.CreatedAt, &code.UsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, rows.Err()
+}
+
+func (s *SQLInvitationRepository) GetUsable(ctx context.Context, code string) (models.InvitationCode, error) {
+	var invitation models.InvitationCode
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, code, created_by, used_by, is_used, expires_at
+		FROM invitation_codes
+		WHERE code = ? AND is_used = FALSE
+		AND (expires_at IS NULL OR expires_at > NOW())
+	`, code).Scan(
+		&invitation.ID, &invitation.Code, &invitation.CreatedBy,
+		&invitation.UsedBy, &invitation.IsUsed, &invitation.ExpiresAt,
+	)
+	return invitation, notFound(err)
+}
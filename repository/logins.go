@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+	"webapp/database"
+	"webapp/models"
+)
+
+// LoginRepository counts failed logins per username and the lockouts they
+// lead to. How long a lockout lasts is up to the caller, see
+// middleware.LockoutDuration.
+type LoginRepository interface {
+	// LockedUntil returns when the username's lockout ends, or the zero
+	// time if it isn't locked
+	LockedUntil(ctx context.Context, username string) (time.Time, error)
+	// RecordFailure counts a failed attempt from ip and returns how many
+	// the username has now
+	RecordFailure(ctx context.Context, username, ip string) (int, error)
+	Lock(ctx context.Context, username string, until time.Time) error
+	// Clear resets the count after a successful login or an admin unlock
+	// and reports whether there was one
+	Clear(ctx context.Context, username string) (bool, error)
+	// List returns every account with recorded failures, most recent first
+	List(ctx context.Context) ([]models.FailedLogin, error)
+}
+
+// SQLLoginRepository is the LoginRepository backed by the database.
+type SQLLoginRepository struct {
+	db *sql.DB
+}
+
+func NewSQLLoginRepository(db *sql.DB) *SQLLoginRepository {
+	return &SQLLoginRepository{db: db}
+}
+
+func (s *SQLLoginRepository) LockedUntil(ctx context.Context, username string) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT locked_until FROM failed_logins
+		WHERE username = ? AND locked_until > NOW()
+	`, username).Scan(&lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return lockedUntil.Time, err
+}
+
+func (s *SQLLoginRepository) RecordFailure(ctx context.Context, username, ip string) (int, error) {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO failed_logins (username, failures, last_ip, last_failed_at)
+		VALUES (?, 1, ?, NOW())
+	`+database.DBDialect.OnConflictUpdate("username",
+		"failures = failures + 1, last_ip = "+database.DBDialect.Excluded("last_ip")+", last_failed_at = NOW()"), username, ip)
+	if err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err = s.db.QueryRowContext(ctx, "SELECT failures FROM failed_logins WHERE username = ?", username).Scan(&failures)
+	return failures, err
+}
+
+func (s *SQLLoginRepository) Lock(ctx context.Context, username string, until time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE failed_logins SET locked_until = ? WHERE username = ?", until, username)
+	return err
+}
+
+func (s *SQLLoginRepository) Clear(ctx context.Context, username string) (bool, error) {
+	return affected(s.db.ExecContext(ctx, "DELETE FROM failed_logins WHERE username = ?", username))
+}
+
+func (s *SQLLoginRepository) List(ctx context.Context) ([]models.FailedLogin, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT username, failures, last_ip, last_failed_at, locked_until
+		FROM failed_logins
+		ORDER BY last_failed_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logins []models.FailedLogin
+	for rows.Next() {
+		var login models.FailedLogin
+		var lastIP sql.NullString
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&login.Username, &login.Failures, &lastIP, &login.LastFailedAt, &lockedUntil); err != nil {
+			return nil, err
+		}
+		login.LastIP = lastIP.String
+		if lockedUntil.Valid {
+			login.LockedUntil = &lockedUntil.Time
+		}
+		logins = append(logins, login)
+	}
+	return logins, rows.Err()
+}
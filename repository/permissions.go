@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"webapp/database"
+	"webapp/models"
+)
+
+// ErrLastAdmin is returned when revoking the only remaining admin role.
+var ErrLastAdmin = errors.New("cannot remove the last admin")
+
+// PermissionRepository looks up what a user may do and manages the roles
+// that grant it. The built-in roles are seeded by database.Setup.
+type PermissionRepository interface {
+	// Permissions returns the set of permissions the user's roles grant
+	Permissions(ctx context.Context, userID int) (map[string]bool, error)
+	HasPermission(ctx context.Context, userID int, permission string) (bool, error)
+	// IsStaff reports whether the user holds at least one role
+	IsStaff(ctx context.Context, userID int) (bool, error)
+
+	// StaffTwoFactorRequired reports whether the site makes staff enroll in
+	// 2FA before using their permissions
+	StaffTwoFactorRequired(ctx context.Context) (bool, error)
+	SetStaffTwoFactorRequired(ctx context.Context, required bool) error
+
+	// Roles returns every role with its permissions, sorted by name
+	Roles(ctx context.Context) ([]models.Role, error)
+	// UserRoles returns the names of the user's roles, sorted by name
+	UserRoles(ctx context.Context, userID int) ([]string, error)
+	// GrantRole gives the user a role. Granting a role the user already has
+	// is not an error.
+	GrantRole(ctx context.Context, userID int, role string) error
+	// RevokeRole removes a role from the user. The last admin who can log
+	// in can't lose the admin role, so the admin area can't be locked out by
+	// accident; that returns ErrLastAdmin.
+	RevokeRole(ctx context.Context, userID int, role string) error
+	// CountRoleMembers leaves out trashed users, since they can't log in
+	CountRoleMembers(ctx context.Context, role string) (int, error)
+}
+
+// SQLPermissionRepository is the PermissionRepository backed by the database.
+type SQLPermissionRepository struct {
+	db *sql.DB
+}
+
+func NewSQLPermissionRepository(db *sql.DB) *SQLPermissionRepository {
+	return &SQLPermissionRepository{db: db}
+}
+
+func (s *SQLPermissionRepository) Permissions(ctx context.Context, userID int) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT rp.permission FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = ?
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]bool)
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions[permission] = true
+	}
+	return permissions, rows.Err()
+}
+
+func (s *SQLPermissionRepository) HasPermission(ctx context.Context, userID int, permission string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_roles ur
+		JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = ? AND rp.permission = ?
+	`, userID, permission).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLPermissionRepository) IsStaff(ctx context.Context, userID int) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_roles WHERE user_id = ?", userID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLPermissionRepository) StaffTwoFactorRequired(ctx context.Context) (bool, error) {
+	var value string
+	err := s.db.QueryRowContext(ctx, "SELECT value FROM settings WHERE name = ?", database.SettingRequireAdmin2FA).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return value == "true", err
+}
+
+func (s *SQLPermissionRepository) SetStaffTwoFactorRequired(ctx context.Context, required bool) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO settings (name, value) VALUES (?, ?)
+	`+database.DBDialect.OnConflictUpdate("name", "value = "+database.DBDialect.Excluded("value")),
+		database.SettingRequireAdmin2FA, strconv.FormatBool(required))
+	return err
+}
+
+func (s *SQLPermissionRepository) Roles(ctx context.Context) ([]models.Role, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.id, r.name, r.description, COALESCE(GROUP_CONCAT(rp.permission ORDER BY rp.permission), '')
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_id = r.id
+		GROUP BY r.id, r.name, r.description
+		ORDER BY r.name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []models.Role
+	for rows.Next() {
+		var role models.Role
+		var permissions string
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &permissions); err != nil {
+			return nil, err
+		}
+		if permissions != "" {
+			role.Permissions = strings.Split(permissions, ",")
+		}
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+func (s *SQLPermissionRepository) UserRoles(ctx context.Context, userID int) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.name FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		WHERE ur.user_id = ?
+		ORDER BY r.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (s *SQLPermissionRepository) GrantRole(ctx context.Context, userID int, role string) error {
+	var roleID int
+	err := s.db.QueryRowContext(ctx, "SELECT id FROM roles WHERE name = ?", role).Scan(&roleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, database.DBDialect.InsertIgnore()+" INTO user_roles (user_id, role_id) VALUES (?, ?)", userID, roleID)
+	return err
+}
+
+func (s *SQLPermissionRepository) RevokeRole(ctx context.Context, userID int, role string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role == database.RoleAdmin {
+		if err := otherAdminsRemain(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM user_roles
+		WHERE user_id = ? AND role_id = (SELECT id FROM roles WHERE name = ?)
+	`, userID, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// otherAdminsRemain returns ErrLastAdmin unless an admin other than userID
+// who can still log in, being neither trashed nor suspended, is left. It
+// locks the admin rows, so two admins acting on each other at once can't
+// both pass.
+func otherAdminsRemain(ctx context.Context, tx *sql.Tx, userID int) error {
+	var admins int
+	err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE r.name = ? AND ur.user_id != ? AND u.deleted_at IS NULL AND u.suspended_at IS NULL
+	`+database.DBDialect.ForUpdate(), database.RoleAdmin, userID).Scan(&admins)
+	if err != nil {
+		return err
+	}
+	if admins == 0 {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+func (s *SQLPermissionRepository) CountRoleMembers(ctx context.Context, role string) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		JOIN users u ON u.id = ur.user_id
+		WHERE r.name = ? AND u.deleted_at IS NULL
+	`, role).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,394 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+	"webapp/database"
+	"webapp/models"
+)
+
+// PostRepository stores blog posts. Lookups skip posts in the trash.
+type PostRepository interface {
+	// List returns a page of posts by active authors, newest first
+	List(ctx context.Context, page PageRequest) (Page, error)
+	// ListByAuthor returns a page of one author's posts, newest first
+	ListByAuthor(ctx context.Context, authorID int, page PageRequest) (Page, error)
+	// ListByTag returns a page of posts by active authors with a tag,
+	// newest first
+	ListByTag(ctx context.Context, tagID int, page PageRequest) (Page, error)
+	GetByID(ctx context.Context, id int) (models.Post, error)
+	// GetActiveByID is GetByID for posts readers can see, leaving out
+	// posts whose author is in the trash
+	GetActiveByID(ctx context.Context, id int) (models.Post, error)
+	// GetBySlug finds a post by an active author by its slug or one it had
+	// before its title was edited; the returned post's Slug tells the two
+	// apart
+	GetBySlug(ctx context.Context, slug string) (models.Post, error)
+	Count(ctx context.Context) (int, error)
+	CountByAuthor(ctx context.Context, authorID int) (int, error)
+
+	// Create adds a post with a unique slug made from its title, tagged
+	// with its Tags, and returns its ID
+	Create(ctx context.Context, post models.Post) (int, error)
+	// Update saves the title, content and tags and bumps the revision. A
+	// title edit that changes the slug keeps the old one as a redirect.
+	Update(ctx context.Context, post models.Post) error
+
+	// SoftDelete moves a post to the trash
+	SoftDelete(ctx context.Context, id int) error
+	ListTrashed(ctx context.Context) ([]TrashedPost, error)
+	// Restore and Purge act on trashed posts only and report whether there
+	// was one
+	Restore(ctx context.Context, id int) (bool, error)
+	Purge(ctx context.Context, id int) (bool, error)
+}
+
+// TrashedPost is a deleted post waiting in the trash
+type TrashedPost struct {
+	ID            int
+	Title         string
+	Author        string
+	AuthorDeleted bool
+	DeletedAt     time.Time
+}
+
+// Cursor is a post's place in the newest-first listing. Posts created in
+// the same millisecond are told apart by ID.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func cursorOf(post models.Post) *Cursor {
+	return &Cursor{CreatedAt: post.CreatedAt, ID: post.ID}
+}
+
+// String encodes the cursor for a query string, e.g. "1767225600000-42".
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.CreatedAt.UnixMilli(), c.ID)
+}
+
+// ParseCursor decodes a cursor made by String.
+func ParseCursor(s string) (Cursor, error) {
+	var millis int64
+	var id int
+	if _, err := fmt.Sscanf(s, "%d-%d", &millis, &id); err != nil || id <= 0 {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return Cursor{CreatedAt: time.UnixMilli(millis), ID: id}, nil
+}
+
+// PageRequest asks for up to Limit posts older than After or, with Before
+// set, newer than Before. Without either it asks for the newest posts.
+type PageRequest struct {
+	After  *Cursor
+	Before *Cursor
+	Limit  int
+}
+
+// Page is one page of posts, newest first. Older and Newer lead to the
+// neighbouring pages and are nil at either end of the listing.
+type Page struct {
+	Posts []models.Post
+	Older *Cursor
+	Newer *Cursor
+}
+
+// SQLPostRepository is the PostRepository backed by the database.
+type SQLPostRepository struct {
+	db *sql.DB
+}
+
+func NewSQLPostRepository(db *sql.DB) *SQLPostRepository {
+	return &SQLPostRepository{db: db}
+}
+
+// Posts get their slug right after insert, and older posts when the server
+// starts, so slug is only NULL for a moment
+const postColumns = "p.id, p.title, COALESCE(p.slug, ''), p.content, p.revision, " + commentCount + ", p.author_id, u.username, p.created_at, p.updated_at"
+
+// commentCount counts the comments on a post that readers can see
+const commentCount = `(SELECT COUNT(*) FROM comments c JOIN users cu ON c.author_id = cu.id
+	WHERE c.post_id = p.id AND c.deleted_at IS NULL AND c.hidden_at IS NULL AND cu.deleted_at IS NULL)`
+
+func scanPost(row scanner) (models.Post, error) {
+	var post models.Post
+	err := row.Scan(&post.ID, &post.Title, &post.Slug, &post.Content, &post.Revision, &post.CommentCount, &post.AuthorID, &post.Username, &post.CreatedAt, &post.UpdatedAt)
+	return post, notFound(err)
+}
+
+// queryPosts runs a query for postColumns and fills in the posts' tags
+func (s *SQLPostRepository) queryPosts(ctx context.Context, query string, args ...interface{}) ([]models.Post, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []models.Post
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return posts, attachTags(ctx, s.db, posts)
+}
+
+// getPost runs a query for a single post, tags included
+func (s *SQLPostRepository) getPost(ctx context.Context, query string, args ...interface{}) (models.Post, error) {
+	posts, err := s.queryPosts(ctx, query, args...)
+	if err != nil {
+		return models.Post{}, err
+	}
+	if len(posts) == 0 {
+		return models.Post{}, ErrNotFound
+	}
+	return posts[0], nil
+}
+
+func (s *SQLPostRepository) List(ctx context.Context, page PageRequest) (Page, error) {
+	return s.listPage(ctx, "p.deleted_at IS NULL AND u.deleted_at IS NULL", nil, page)
+}
+
+func (s *SQLPostRepository) ListByAuthor(ctx context.Context, authorID int, page PageRequest) (Page, error) {
+	return s.listPage(ctx, "p.author_id = ? AND p.deleted_at IS NULL", []interface{}{authorID}, page)
+}
+
+func (s *SQLPostRepository) ListByTag(ctx context.Context, tagID int, page PageRequest) (Page, error) {
+	return s.listPage(ctx, `p.deleted_at IS NULL AND u.deleted_at IS NULL
+		AND EXISTS (SELECT 1 FROM post_tags pt WHERE pt.post_id = p.id AND pt.tag_id = ?)`, []interface{}{tagID}, page)
+}
+
+// listPage seeks past the cursor on (created_at, id) rather than using
+// OFFSET, so later pages cost the same as the first. idx_posts_created
+// serves the ordering: both databases keep the primary key in secondary
+// index entries. One extra row is fetched to learn whether another page
+// follows.
+func (s *SQLPostRepository) listPage(ctx context.Context, where string, whereArgs []interface{}, page PageRequest) (Page, error) {
+	query := `SELECT ` + postColumns + `
+		FROM posts p JOIN users u ON p.author_id = u.id
+		WHERE ` + where
+	args := slices.Clone(whereArgs)
+	order := "DESC"
+	switch {
+	case page.Before != nil:
+		query += " AND (p.created_at > ? OR (p.created_at = ? AND p.id > ?))"
+		args = append(args, page.Before.CreatedAt, page.Before.CreatedAt, page.Before.ID)
+		order = "ASC"
+	case page.After != nil:
+		query += " AND (p.created_at < ? OR (p.created_at = ? AND p.id < ?))"
+		args = append(args, page.After.CreatedAt, page.After.CreatedAt, page.After.ID)
+	}
+	query += " ORDER BY p.created_at " + order + ", p.id " + order + " LIMIT ?"
+	args = append(args, page.Limit+1)
+
+	posts, err := s.queryPosts(ctx, query, args...)
+	if err != nil {
+		return Page{}, err
+	}
+	more := len(posts) > page.Limit
+	if more {
+		posts = posts[:page.Limit]
+	}
+
+	if page.Before != nil {
+		if !more {
+			// Paging back reached the newest posts: show the first page,
+			// which is full, rather than whatever was left over
+			return s.listPage(ctx, where, whereArgs, PageRequest{Limit: page.Limit})
+		}
+		slices.Reverse(posts)
+		return Page{Posts: posts, Older: cursorOf(posts[len(posts)-1]), Newer: cursorOf(posts[0])}, nil
+	}
+
+	result := Page{Posts: posts}
+	if len(posts) > 0 {
+		if more {
+			result.Older = cursorOf(posts[len(posts)-1])
+		}
+		if page.After != nil {
+			result.Newer = cursorOf(posts[0])
+		}
+	}
+	return result, nil
+}
+
+func (s *SQLPostRepository) GetByID(ctx context.Context, id int) (models.Post, error) {
+	return s.getPost(ctx, `SELECT `+postColumns+`
+		FROM posts p JOIN users u ON p.author_id = u.id
+		WHERE p.id = ? AND p.deleted_at IS NULL`, id)
+}
+
+func (s *SQLPostRepository) GetActiveByID(ctx context.Context, id int) (models.Post, error) {
+	return s.getPost(ctx, `SELECT `+postColumns+`
+		FROM posts p JOIN users u ON p.author_id = u.id
+		WHERE p.id = ? AND p.deleted_at IS NULL AND u.deleted_at IS NULL`, id)
+}
+
+func (s *SQLPostRepository) GetBySlug(ctx context.Context, slug string) (models.Post, error) {
+	return s.getPost(ctx, `SELECT `+postColumns+`
+		FROM posts p JOIN users u ON p.author_id = u.id
+		WHERE p.deleted_at IS NULL AND u.deleted_at IS NULL AND (p.slug = ?
+			OR p.id = (SELECT post_id FROM post_slug_redirects WHERE slug = ?))`, slug, slug)
+}
+
+func (s *SQLPostRepository) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM posts WHERE deleted_at IS NULL").Scan(&count)
+	return count, err
+}
+
+func (s *SQLPostRepository) CountByAuthor(ctx context.Context, authorID int) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM posts WHERE author_id = ? AND deleted_at IS NULL", authorID).Scan(&count)
+	return count, err
+}
+
+// slugAttempts is how many times Create and Update try again when another
+// post takes the slug they picked before they commit
+const slugAttempts = 3
+
+// retrySlug runs fn until it succeeds, fails with something other than a
+// duplicate key, or has had slugAttempts tries. Each try is a new
+// transaction, which sees the slug the other post took.
+func retrySlug(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < slugAttempts; attempt++ {
+		if err = fn(); err == nil || !database.DBDialect.IsDuplicateKey(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *SQLPostRepository) Create(ctx context.Context, post models.Post) (int, error) {
+	var id int
+	err := retrySlug(func() (err error) {
+		id, err = s.create(ctx, post)
+		return err
+	})
+	return id, err
+}
+
+func (s *SQLPostRepository) create(ctx context.Context, post models.Post) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO posts (title, content, author_id) VALUES (?, ?, ?)", post.Title, post.Content, post.AuthorID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := setSlug(ctx, tx, int(id), sql.NullString{}, post.Title); err != nil {
+		return 0, err
+	}
+	if err := setTags(ctx, tx, int(id), post.Tags); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+func (s *SQLPostRepository) Update(ctx context.Context, post models.Post) error {
+	return retrySlug(func() error { return s.update(ctx, post) })
+}
+
+func (s *SQLPostRepository) update(ctx context.Context, post models.Post) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var slug sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT slug FROM posts WHERE id = ? "+database.DBDialect.ForUpdate(), post.ID).Scan(&slug); err != nil {
+		return notFound(err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE posts SET title = ?, content = ?, revision = revision + 1 WHERE id = ?", post.Title, post.Content, post.ID); err != nil {
+		return err
+	}
+	// Changing only case or punctuation keeps the slug; other title edits
+	// get a new one and the old one redirects
+	keep := false
+	if slug.Valid {
+		if keep, err = fitsTitle(ctx, tx, slug.String, post.Title, post.ID); err != nil {
+			return err
+		}
+	}
+	if !keep {
+		if err := setSlug(ctx, tx, post.ID, slug, post.Title); err != nil {
+			return err
+		}
+	}
+	if err := setTags(ctx, tx, post.ID, post.Tags); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLPostRepository) SoftDelete(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE posts SET deleted_at = NOW() WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLPostRepository) ListTrashed(ctx context.Context) ([]TrashedPost, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT p.id, p.title, u.username, u.deleted_at IS NOT NULL, p.deleted_at
+		FROM posts p JOIN users u ON p.author_id = u.id
+		WHERE p.deleted_at IS NOT NULL
+		ORDER BY p.deleted_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []TrashedPost
+	for rows.Next() {
+		var post TrashedPost
+		if err := rows.Scan(&post.ID, &post.Title, &post.Author, &post.AuthorDeleted, &post.DeletedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+func (s *SQLPostRepository) Restore(ctx context.Context, id int) (bool, error) {
+	return affected(s.db.ExecContext(ctx, "UPDATE posts SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id))
+}
+
+func (s *SQLPostRepository) Purge(ctx context.Context, id int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	tagIDs, err := database.PostTagIDs(ctx, tx, "p.id = ? AND p.deleted_at IS NOT NULL", id)
+	if err != nil {
+		return false, err
+	}
+	purged, err := affected(tx.ExecContext(ctx, "DELETE FROM posts WHERE id = ? AND deleted_at IS NOT NULL", id))
+	if err != nil || !purged {
+		return false, err
+	}
+	if err := database.DeleteUnusedTags(ctx, tx, tagIDs); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
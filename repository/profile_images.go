@@ -0,0 +1,30 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"webapp/models"
+)
+
+// ProfileImageRepository keeps a record of every uploaded profile image.
+type ProfileImageRepository interface {
+	Create(ctx context.Context, image models.ProfileImage) error
+}
+
+// SQLProfileImageRepository is the ProfileImageRepository backed by the
+// database.
+type SQLProfileImageRepository struct {
+	db *sql.DB
+}
+
+func NewSQLProfileImageRepository(db *sql.DB) *SQLProfileImageRepository {
+	return &SQLProfileImageRepository{db: db}
+}
+
+func (s *SQLProfileImageRepository) Create(ctx context.Context, image models.ProfileImage) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO profile_images (user_id, filename, original_name, file_path, file_size, mime_type)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, image.UserID, image.Filename, image.OriginalName, image.FilePath, image.FileSize, image.MimeType)
+	return err
+}
@@ -0,0 +1,37 @@
+// Package repository keeps the SQL for users, posts, comments, tags, invitation
+// codes, profile images, roles and permissions, failed logins and the audit
+// trail behind interfaces.
+// Handlers depend on the interfaces, so tests can hand them fakes instead of
+// a database.
+package repository
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// ErrNotFound is returned when a lookup matches no row.
+var ErrNotFound = errors.New("not found")
+
+// notFound turns sql.ErrNoRows into ErrNotFound so callers don't need to
+// know about database/sql.
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// affected reports whether an UPDATE or DELETE changed any row.
+func affected(result sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// scanner is satisfied by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
@@ -0,0 +1,979 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"webapp/database"
+	"webapp/models"
+)
+
+// openTestDB returns a migrated SQLite database in a temporary file
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := database.Open("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := database.MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestUserRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	invitations := NewSQLInvitationRepository(db)
+
+	adminID, err := users.Create(ctx, models.User{Username: "admin", Email: "admin@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	if err := invitations.Create(ctx, models.InvitationCode{Code: "INV-1", CreatedBy: adminID, ExpiresAt: &expires}); err != nil {
+		t.Fatal(err)
+	}
+	invitation, err := invitations.GetUsable(ctx, "INV-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := users.CreateInvited(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash", InvitedBy: &adminID}, invitation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := invitations.GetUsable(ctx, "INV-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("used invitation still usable, err = %v", err)
+	}
+	if _, err := users.Create(ctx, models.User{Username: "casper", Email: "other@example.com", Password: "hash"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("duplicate username err = %v, want ErrUserExists", err)
+	}
+
+	if err := users.UpdateProfile(ctx, models.User{ID: id, Username: "casper", Bio: "Friendly", ProfileImage: "/uploads/profiles/a.png"}); err != nil {
+		t.Fatal(err)
+	}
+	// A later update without an image keeps the existing one
+	if err := users.UpdateProfile(ctx, models.User{ID: id, Username: "casper", Bio: "Still friendly"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.GetByUsername(ctx, "casper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != id || user.Bio != "Still friendly" || user.ProfileImage != "/uploads/profiles/a.png" || *user.InvitedBy != adminID {
+		t.Errorf("got %+v", user)
+	}
+
+	if err := users.SoftDelete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.GetByID(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("trashed user still found, err = %v", err)
+	}
+	if restored, err := users.Restore(ctx, id); err != nil || !restored {
+		t.Fatalf("Restore = %t, %v", restored, err)
+	}
+	// Only trashed users can be purged
+	if purged, err := users.Purge(ctx, id); err != nil || purged {
+		t.Errorf("Purge of an active user = %t, %v", purged, err)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+
+	casperID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spookyID, err := users.Create(ctx, models.User{Username: "spooky", Email: "spooky@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailOf := func(id int) string {
+		t.Helper()
+		user, err := users.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user.Email
+	}
+	request := func(id int, newEmail, tokenHash string, expiresAt time.Time) {
+		t.Helper()
+		if err := users.CreateEmailChange(ctx, id, newEmail, tokenHash, expiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hour := time.Now().Add(time.Hour)
+
+	request(casperID, "ghost@example.com", "valid", hour)
+	request(casperID, "phantom@example.com", "older", hour)
+	if id, err := users.ApplyEmailChange(ctx, "valid"); err != nil || id != casperID || emailOf(casperID) != "ghost@example.com" {
+		t.Fatalf("ApplyEmailChange = %d, %v; email %q", id, err, emailOf(casperID))
+	}
+	// The token is used up, and so are the user's other pending changes
+	for _, token := range []string{"valid", "older", "unknown"} {
+		if _, err := users.ApplyEmailChange(ctx, token); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ApplyEmailChange(%s) err = %v, want ErrNotFound", token, err)
+		}
+	}
+
+	request(casperID, "late@example.com", "expired", time.Now().Add(-time.Minute))
+	if _, err := users.ApplyEmailChange(ctx, "expired"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired token err = %v, want ErrNotFound", err)
+	}
+
+	// Another account took the address after the change was asked for
+	request(casperID, "spooky@example.com", "taken", hour)
+	if _, err := users.ApplyEmailChange(ctx, "taken"); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("taken address err = %v, want ErrEmailTaken", err)
+	}
+
+	// A user trashed after asking keeps the old address
+	request(spookyID, "wisp@example.com", "trashed", hour)
+	if err := users.SoftDelete(ctx, spookyID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.ApplyEmailChange(ctx, "trashed"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("trashed user err = %v, want ErrNotFound", err)
+	}
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", spookyID).Scan(&email); err != nil || email != "spooky@example.com" {
+		t.Errorf("trashed user's email = %q, %v", email, err)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+
+	id, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SetTOTPSecret(ctx, id, "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.EnableTOTP(ctx, id, 100, []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := users.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.TOTPEnabled || user.TOTPLastStep != 100 {
+		t.Errorf("after enabling got %+v", user)
+	}
+	if used, err := users.UseRecoveryCode(ctx, id, "a"); err != nil || !used {
+		t.Errorf("UseRecoveryCode = %t, %v", used, err)
+	}
+
+	// Steps at or before the last one used are refused
+	for _, step := range []int64{99, 100} {
+		if used, err := users.UseTOTPStep(ctx, id, step); err != nil || used {
+			t.Errorf("UseTOTPStep(%d) = %t, %v", step, used, err)
+		}
+	}
+	if used, err := users.UseTOTPStep(ctx, id, 101); err != nil || !used {
+		t.Errorf("UseTOTPStep(101) = %t, %v", used, err)
+	}
+
+	if err := users.DisableTOTP(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	user, _ = users.GetByID(ctx, id)
+	if user.TOTPEnabled || user.TOTPSecret != "" || user.TOTPLastStep != 0 {
+		t.Errorf("after disabling got %+v", user)
+	}
+	if used, _ := users.UseRecoveryCode(ctx, id, "b"); used {
+		t.Error("recovery code survived disabling 2FA")
+	}
+}
+
+func TestPermissionRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	permissions := NewSQLPermissionRepository(db)
+	// Seeds the built-in roles
+	if err := database.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	memberID, _ := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	moderatorID, _ := users.Create(ctx, models.User{Username: "spooky", Email: "spooky@example.com", Password: "hash"})
+	if err := permissions.GrantRole(ctx, moderatorID, database.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+
+	if staff, err := permissions.IsStaff(ctx, memberID); err != nil || staff {
+		t.Errorf("IsStaff(member) = %t, %v", staff, err)
+	}
+	if staff, err := permissions.IsStaff(ctx, moderatorID); err != nil || !staff {
+		t.Errorf("IsStaff(moderator) = %t, %v", staff, err)
+	}
+	if allowed, err := permissions.HasPermission(ctx, moderatorID, database.PermModerateComments); err != nil || !allowed {
+		t.Errorf("moderator can't moderate comments: %t, %v", allowed, err)
+	}
+	if allowed, _ := permissions.HasPermission(ctx, moderatorID, database.PermManageRoles); allowed {
+		t.Error("moderator can manage roles")
+	}
+	granted, err := permissions.Permissions(ctx, moderatorID)
+	if err != nil || !granted[database.PermModerateComments] || granted[database.PermManageRoles] {
+		t.Errorf("Permissions = %v, %v", granted, err)
+	}
+
+	if required, err := permissions.StaffTwoFactorRequired(ctx); err != nil || required {
+		t.Errorf("2FA policy before it was set = %t, %v", required, err)
+	}
+	for _, want := range []bool{true, false} {
+		if err := permissions.SetStaffTwoFactorRequired(ctx, want); err != nil {
+			t.Fatal(err)
+		}
+		if required, err := permissions.StaffTwoFactorRequired(ctx); err != nil || required != want {
+			t.Errorf("2FA policy = %t, %v, want %t", required, err, want)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	permissions := NewSQLPermissionRepository(db)
+	if err := database.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := users.Create(ctx, models.User{Username: "admin", Email: "admin@example.com", Password: "hash"})
+	second, _ := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	for _, id := range []int{first, second} {
+		if err := permissions.GrantRole(ctx, id, database.RoleAdmin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := permissions.GrantRole(ctx, first, database.RoleAdmin); err != nil {
+		t.Errorf("granting a role twice: %v", err)
+	}
+	if err := permissions.GrantRole(ctx, first, "poltergeist"); err == nil {
+		t.Error("granted a role that doesn't exist")
+	}
+	permissions.GrantRole(ctx, first, database.RoleInviter)
+	if roles, err := permissions.UserRoles(ctx, first); err != nil || fmt.Sprint(roles) != "[admin inviter]" {
+		t.Errorf("UserRoles = %v, %v", roles, err)
+	}
+
+	roles, err := permissions.Roles(ctx)
+	if err != nil || len(roles) != 3 || roles[0].Name != database.RoleAdmin || len(roles[0].Permissions) == 0 {
+		t.Errorf("Roles = %+v, %v", roles, err)
+	}
+
+	// A trashed admin can't log in, so doesn't count or keep the admin
+	// area open
+	if err := users.SoftDelete(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := permissions.CountRoleMembers(ctx, database.RoleAdmin); err != nil || n != 1 {
+		t.Errorf("CountRoleMembers = %d, %v, want 1", n, err)
+	}
+	if err := permissions.RevokeRole(ctx, first, database.RoleAdmin); !errors.Is(err, ErrLastAdmin) {
+		t.Errorf("revoking the last active admin: err = %v, want ErrLastAdmin", err)
+	}
+	if err := permissions.RevokeRole(ctx, second, database.RoleAdmin); err != nil {
+		t.Errorf("revoking a trashed admin: %v", err)
+	}
+	if err := permissions.RevokeRole(ctx, first, database.RoleInviter); err != nil {
+		t.Errorf("revoking another role: %v", err)
+	}
+}
+
+func TestLastAdminKeepsAccess(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	permissions := NewSQLPermissionRepository(db)
+	if err := database.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := users.Create(ctx, models.User{Username: "admin", Email: "admin@example.com", Password: "hash"})
+	second, _ := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	member, _ := users.Create(ctx, models.User{Username: "spooky", Email: "spooky@example.com", Password: "hash"})
+	permissions.GrantRole(ctx, first, database.RoleAdmin)
+	permissions.GrantRole(ctx, second, database.RoleAdmin)
+
+	// Once one admin is suspended the other can't be locked out any way
+	if err := users.SetSuspended(ctx, second, true); err != nil {
+		t.Fatal(err)
+	}
+	for name, lockOut := range map[string]func(int) error{
+		"suspend":      func(id int) error { return users.SetSuspended(ctx, id, true) },
+		"force reset":  func(id int) error { return users.RequirePasswordReset(ctx, id) },
+		"delete":       func(id int) error { return users.SoftDelete(ctx, id) },
+		"revoke admin": func(id int) error { return permissions.RevokeRole(ctx, id, database.RoleAdmin) },
+	} {
+		if err := lockOut(first); !errors.Is(err, ErrLastAdmin) {
+			t.Errorf("%s the last admin: err = %v, want ErrLastAdmin", name, err)
+		}
+		if err := lockOut(member); err != nil {
+			t.Errorf("%s a member: %v", name, err)
+		}
+	}
+	if user, _ := users.GetByID(ctx, first); user.IsSuspended() || user.ResetRequired {
+		t.Errorf("last admin was changed: %+v", user)
+	}
+
+	if err := users.SetSuspended(ctx, second, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.SoftDelete(ctx, first); err != nil {
+		t.Errorf("deleting one of two admins: %v", err)
+	}
+}
+
+func TestTrashWithoutRole(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	permissions := NewSQLPermissionRepository(db)
+	if err := database.Setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	admin, _ := users.Create(ctx, models.User{Username: "admin", Email: "admin@example.com", Password: "hash"})
+	permissions.GrantRole(ctx, admin, database.RoleAdmin)
+	member, _ := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	trashed, _ := users.Create(ctx, models.User{Username: "spooky", Email: "spooky@example.com", Password: "hash"})
+	users.SoftDelete(ctx, trashed)
+
+	ids, err := users.TrashWithoutRole(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != fmt.Sprint([]int{member}) {
+		t.Errorf("trashed %v, want only %d", ids, member)
+	}
+	if n, _ := users.Count(ctx); n != 1 {
+		t.Errorf("%d users left outside the trash, want the admin only", n)
+	}
+}
+
+func TestAuditRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	audit := NewSQLAuditRepository(db)
+
+	actorID := 7
+	day := time.Date(2024, 10, 31, 12, 0, 0, 0, time.UTC)
+	for i, event := range []models.AuditEvent{
+		{ActorID: &actorID, ActorName: "casper", Action: "user.suspend", TargetType: "user", TargetID: "8"},
+		{ActorID: &actorID, ActorName: "casper", Action: "users.clean", TargetType: "user"},
+		{ActorName: "spooky", Action: "post.delete", TargetType: "post", TargetID: "3"},
+		{ActorName: "system", Action: "trash.purge", TargetType: "trash", UserAgent: strings.Repeat("x", 300)},
+	} {
+		if err := audit.Record(ctx, event, map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+		// One event a day, the first on day
+		if _, err := db.ExecContext(ctx, "UPDATE audit_events SET created_at = ? WHERE id = ?", day.AddDate(0, 0, i), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := audit.Record(ctx, models.AuditEvent{ActorName: "cli", Action: "logout"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.ExecContext(ctx, "UPDATE audit_events SET created_at = ? WHERE id = 5", day.AddDate(0, 0, 4))
+
+	all, err := audit.List(ctx, AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || all[0].Action != "logout" || all[0].Metadata != "" {
+		t.Fatalf("List = %+v, want every event newest first", all)
+	}
+	suspend := all[4]
+	if suspend.ActorID == nil || *suspend.ActorID != 7 || suspend.TargetID != "8" || suspend.Metadata != `{"n":0}` {
+		t.Errorf("first event = %+v", suspend)
+	}
+	if len(all[1].UserAgent) != 255 {
+		t.Errorf("user agent stored with %d characters, want 255", len(all[1].UserAgent))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter AuditFilter
+		want   []string
+	}{
+		{"actor", AuditFilter{Actor: "casper"}, []string{"users.clean", "user.suspend"}},
+		{"action", AuditFilter{Action: "post.delete"}, []string{"post.delete"}},
+		// A prefix matches its own actions only, not users.*
+		{"action prefix", AuditFilter{Action: "user"}, []string{"user.suspend"}},
+		{"target type", AuditFilter{TargetType: "user"}, []string{"users.clean", "user.suspend"}},
+		{"target id", AuditFilter{TargetType: "post", TargetID: "3"}, []string{"post.delete"}},
+		{"since", AuditFilter{Since: day.AddDate(0, 0, 3)}, []string{"logout", "trash.purge"}},
+		{"until", AuditFilter{Until: day.AddDate(0, 0, 1)}, []string{"user.suspend"}},
+		{"page", AuditFilter{Limit: 2, Offset: 1}, []string{"trash.purge", "post.delete"}},
+	} {
+		events, err := audit.List(ctx, tc.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var actions []string
+		for _, event := range events {
+			actions = append(actions, event.Action)
+		}
+		if fmt.Sprint(actions) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, actions, tc.want)
+		}
+	}
+}
+
+func TestLoginRepository(t *testing.T) {
+	ctx := context.Background()
+	logins := NewSQLLoginRepository(openTestDB(t))
+
+	for want := 1; want <= 2; want++ {
+		if failures, err := logins.RecordFailure(ctx, "casper", "10.0.0.1"); err != nil || failures != want {
+			t.Errorf("RecordFailure = %d, %v, want %d", failures, err, want)
+		}
+	}
+	if until, err := logins.LockedUntil(ctx, "casper"); err != nil || !until.IsZero() {
+		t.Errorf("LockedUntil before locking = %v, %v", until, err)
+	}
+
+	// Lockouts that already ended don't count
+	if err := logins.Lock(ctx, "casper", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if until, _ := logins.LockedUntil(ctx, "casper"); !until.IsZero() {
+		t.Errorf("expired lockout still in effect until %v", until)
+	}
+	lockedUntil := time.Now().Add(time.Hour)
+	logins.Lock(ctx, "casper", lockedUntil)
+	if until, err := logins.LockedUntil(ctx, "casper"); err != nil || until.Sub(lockedUntil).Abs() > time.Second {
+		t.Errorf("LockedUntil = %v, %v, want %v", until, err, lockedUntil)
+	}
+
+	list, err := logins.List(ctx)
+	if err != nil || len(list) != 1 || list[0].Username != "casper" || list[0].Failures != 2 || list[0].LastIP != "10.0.0.1" || !list[0].IsLocked() {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+	if cleared, err := logins.Clear(ctx, "casper"); err != nil || !cleared {
+		t.Errorf("Clear = %t, %v", cleared, err)
+	}
+	if cleared, _ := logins.Clear(ctx, "casper"); cleared {
+		t.Error("second Clear found failures")
+	}
+}
+
+func TestPostRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	posts := NewSQLPostRepository(db)
+
+	authorID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := posts.Create(ctx, models.Post{Title: "First", Content: "Boo", AuthorID: authorID})
+	second, _ := posts.Create(ctx, models.Post{Title: "Second", Content: "Boo!", AuthorID: authorID})
+
+	post, err := posts.GetByID(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post.Title = "First, edited"
+	if err := posts.Update(ctx, post); err != nil {
+		t.Fatal(err)
+	}
+	if edited, _ := posts.GetByID(ctx, first); edited.Revision != post.Revision+1 {
+		t.Errorf("revision after edit = %d, want %d", edited.Revision, post.Revision+1)
+	}
+
+	if err := posts.SoftDelete(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	page, err := posts.List(ctx, PageRequest{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed := page.Posts; len(listed) != 1 || listed[0].Title != "First, edited" || listed[0].Username != "casper" {
+		t.Errorf("List = %+v", listed)
+	}
+	if count, _ := posts.CountByAuthor(ctx, authorID); count != 1 {
+		t.Errorf("CountByAuthor = %d, want 1", count)
+	}
+
+	trashed, err := posts.ListTrashed(ctx)
+	if err != nil || len(trashed) != 1 || trashed[0].ID != second {
+		t.Fatalf("ListTrashed = %+v, %v", trashed, err)
+	}
+	if purged, err := posts.Purge(ctx, second); err != nil || !purged {
+		t.Errorf("Purge = %t, %v", purged, err)
+	}
+
+	// Posts of a trashed author stay editable but aren't shown to readers
+	if _, err := posts.GetActiveByID(ctx, first); err != nil {
+		t.Errorf("GetActiveByID = %v", err)
+	}
+	if err := users.SoftDelete(ctx, authorID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := posts.GetActiveByID(ctx, first); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetActiveByID for a trashed author: err = %v", err)
+	}
+	if _, err := posts.GetByID(ctx, first); err != nil {
+		t.Errorf("GetByID for a trashed author: %v", err)
+	}
+}
+
+func TestPostPages(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	posts := NewSQLPostRepository(db)
+
+	authorID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Posts 2 and 3 share a timestamp, so only their IDs order them
+	created := time.Now().Add(-time.Hour)
+	for i, offset := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		id, err := posts.Create(ctx, models.Post{Title: fmt.Sprintf("Post %d", i+1), Content: "Boo", AuthorID: authorID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE posts SET created_at = ? WHERE id = ?", created.Add(offset), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	titles := func(page Page) string {
+		var names []string
+		for _, post := range page.Posts {
+			names = append(names, post.Title[len("Post "):])
+		}
+		return strings.Join(names, ",")
+	}
+
+	first, err := posts.List(ctx, PageRequest{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if titles(first) != "5,4" || first.Newer != nil || first.Older == nil {
+		t.Fatalf("first page = %s, newer %v, older %v", titles(first), first.Newer, first.Older)
+	}
+	second, _ := posts.List(ctx, PageRequest{After: first.Older, Limit: 2})
+	if titles(second) != "3,2" || second.Newer == nil || second.Older == nil {
+		t.Fatalf("second page = %s", titles(second))
+	}
+	last, _ := posts.ListByAuthor(ctx, authorID, PageRequest{After: second.Older, Limit: 2})
+	if titles(last) != "1" || last.Older != nil || last.Newer == nil {
+		t.Fatalf("last page = %s, older %v", titles(last), last.Older)
+	}
+
+	// Paging back retraces the same pages
+	back, _ := posts.List(ctx, PageRequest{Before: last.Newer, Limit: 2})
+	if titles(back) != "3,2" || back.Newer == nil {
+		t.Errorf("back from the last page = %s", titles(back))
+	}
+	if back, _ = posts.List(ctx, PageRequest{Before: back.Newer, Limit: 2}); titles(back) != "5,4" || back.Newer != nil {
+		t.Errorf("back to the first page = %s, newer %v", titles(back), back.Newer)
+	}
+
+	// A cursor survives the round trip through a URL
+	parsed, err := ParseCursor(second.Older.String())
+	if err != nil || parsed.ID != second.Older.ID || !parsed.CreatedAt.Equal(second.Older.CreatedAt) {
+		t.Errorf("ParseCursor(%s) = %+v, %v", second.Older, parsed, err)
+	}
+	if _, err := ParseCursor("nope"); err == nil {
+		t.Error("ParseCursor accepted garbage")
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := map[string]string{
+		"Boo! A Ghost's Story":               "boo-a-ghost-s-story",
+		"  --Hello,   World--  ":             "hello-world",
+		"Ünïcödé":                            "n-c-d",
+		"¡¿?!":                               "post",
+		strings.Repeat("haunted house ", 10): "haunted-house-haunted-house-haunted-house-haunted-house-haunted-house-haunted",
+	}
+	for title, want := range tests {
+		if got := slugify(title); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestPostSlugs(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	posts := NewSQLPostRepository(db)
+
+	authorID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slugOf := func(id int) string {
+		t.Helper()
+		post, err := posts.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return post.Slug
+	}
+
+	first, _ := posts.Create(ctx, models.Post{Title: "A Haunting", Content: "Boo", AuthorID: authorID})
+	second, _ := posts.Create(ctx, models.Post{Title: "A haunting!", Content: "Boo", AuthorID: authorID})
+	if slugOf(first) != "a-haunting" || slugOf(second) != "a-haunting-2" {
+		t.Fatalf("slugs = %q, %q", slugOf(first), slugOf(second))
+	}
+
+	// Punctuation and case edits keep the slug
+	if err := posts.Update(ctx, models.Post{ID: second, Title: "A HAUNTING?", Content: "Boo"}); err != nil {
+		t.Fatal(err)
+	}
+	if slugOf(second) != "a-haunting-2" {
+		t.Errorf("slug changed to %q after a punctuation edit", slugOf(second))
+	}
+
+	// A new title gets a new slug and the old one still finds the post
+	if err := posts.Update(ctx, models.Post{ID: first, Title: "Ghost Stories", Content: "Boo"}); err != nil {
+		t.Fatal(err)
+	}
+	if slugOf(first) != "ghost-stories" {
+		t.Errorf("slug after retitling = %q", slugOf(first))
+	}
+	post, err := posts.GetBySlug(ctx, "a-haunting")
+	if err != nil || post.ID != first || post.Slug != "ghost-stories" {
+		t.Errorf("GetBySlug(old slug) = %+v, %v", post, err)
+	}
+
+	// The old slug stays reserved for its post
+	third, _ := posts.Create(ctx, models.Post{Title: "A Haunting", Content: "Boo", AuthorID: authorID})
+	if slugOf(third) != "a-haunting-3" {
+		t.Errorf("new post took slug %q", slugOf(third))
+	}
+	// ...and is reclaimed when the title changes back
+	posts.Update(ctx, models.Post{ID: first, Title: "A Haunting", Content: "Boo"})
+	if post, _ := posts.GetBySlug(ctx, "ghost-stories"); slugOf(first) != "a-haunting" || post.ID != first {
+		t.Errorf("slug after changing the title back = %q, old slug finds %d", slugOf(first), post.ID)
+	}
+
+	// A number in the title isn't a collision suffix once it's edited out
+	top, _ := posts.Create(ctx, models.Post{Title: "Top 10", Content: "Boo", AuthorID: authorID})
+	if err := posts.Update(ctx, models.Post{ID: top, Title: "Top", Content: "Boo"}); err != nil {
+		t.Fatal(err)
+	}
+	if post, _ := posts.GetBySlug(ctx, "top-10"); slugOf(top) != "top" || post.ID != top {
+		t.Errorf("slug after dropping the number = %q, old slug finds %d", slugOf(top), post.ID)
+	}
+
+	if _, err := posts.GetBySlug(ctx, "no-such-post"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetBySlug(unknown) err = %v", err)
+	}
+
+	// Slugs the /post/ routes use are skipped
+	edit, _ := posts.Create(ctx, models.Post{Title: "Edit", Content: "Boo", AuthorID: authorID})
+	preview, _ := posts.Create(ctx, models.Post{Title: "Preview!", Content: "Boo", AuthorID: authorID})
+	if slugOf(edit) != "edit-2" || slugOf(preview) != "preview-2" {
+		t.Errorf("reserved titles got slugs %q and %q", slugOf(edit), slugOf(preview))
+	}
+
+	// Posts from before slugs existed get one, as do posts that were given
+	// a slug before it was reserved
+	if _, err := db.Exec("INSERT INTO posts (title, content, author_id) VALUES ('Old News', 'Boo', ?)", authorID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO posts (title, content, author_id, slug) VALUES ('Create', 'Boo', ?, 'create')", authorID); err != nil {
+		t.Fatal(err)
+	}
+	if assigned, err := posts.AssignMissingSlugs(ctx); err != nil || assigned != 2 {
+		t.Fatalf("AssignMissingSlugs = %d, %v", assigned, err)
+	}
+	if post, err := posts.GetBySlug(ctx, "old-news"); err != nil || post.Title != "Old News" {
+		t.Errorf("backfilled post = %+v, %v", post, err)
+	}
+	if post, err := posts.GetBySlug(ctx, "create-2"); err != nil || post.Title != "Create" {
+		t.Errorf("post with a reserved slug = %+v, %v", post, err)
+	}
+}
+
+func TestRetrySlug(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec("INSERT INTO tags (name) VALUES ('boo')"); err != nil {
+		t.Fatal(err)
+	}
+	_, duplicate := db.Exec("INSERT INTO tags (name) VALUES ('boo')")
+	if !database.DBDialect.IsDuplicateKey(duplicate) {
+		t.Fatalf("IsDuplicateKey(%v) = false", duplicate)
+	}
+	if _, err := db.Exec("INSERT INTO post_slug_redirects (slug, post_id) VALUES ('boo', 404)"); database.DBDialect.IsDuplicateKey(err) {
+		t.Errorf("IsDuplicateKey(%v) = true for a foreign key violation", err)
+	}
+
+	// Another post taking the slug first is retried
+	tries := 0
+	err := retrySlug(func() error {
+		if tries++; tries == 1 {
+			return duplicate
+		}
+		return nil
+	})
+	if err != nil || tries != 2 {
+		t.Errorf("after a duplicate key: err %v after %d tries, want success on the 2nd", err, tries)
+	}
+
+	// ...but not forever, and other errors aren't retried at all
+	tries = 0
+	if err := retrySlug(func() error { tries++; return duplicate }); err != duplicate || tries != slugAttempts {
+		t.Errorf("always duplicate: err %v after %d tries", err, tries)
+	}
+	tries = 0
+	other := errors.New("connection lost")
+	if err := retrySlug(func() error { tries++; return other }); err != other || tries != 1 {
+		t.Errorf("other error: err %v after %d tries", err, tries)
+	}
+}
+
+func TestCommentRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	posts := NewSQLPostRepository(db)
+	comments := NewSQLCommentRepository(db)
+
+	authorID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, err := posts.Create(ctx, models.Post{Title: "A Haunting", Content: "Boo", AuthorID: authorID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentCount := func() int {
+		t.Helper()
+		post, err := posts.GetByID(ctx, postID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return post.CommentCount
+	}
+
+	first, err := comments.Create(ctx, models.Comment{PostID: postID, AuthorID: authorID, Content: "First!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := comments.Create(ctx, models.Comment{PostID: postID, ParentID: &first, AuthorID: authorID, Content: "Second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := comments.ListByPost(ctx, postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].ID != first || listed[1].ParentID == nil || *listed[1].ParentID != first {
+		t.Fatalf("ListByPost = %+v", listed)
+	}
+	if listed[0].Username != "casper" || listed[0].PostSlug != "a-haunting" {
+		t.Errorf("comment = %+v", listed[0])
+	}
+	if commentCount() != 2 {
+		t.Errorf("CommentCount = %d, want 2", commentCount())
+	}
+
+	if err := comments.Update(ctx, models.Comment{ID: reply, Content: "Second, edited"}); err != nil {
+		t.Fatal(err)
+	}
+	if comment, _ := comments.GetByID(ctx, reply); comment.Content != "Second, edited" || comment.EditedAt == nil {
+		t.Errorf("edited comment = %+v", comment)
+	}
+
+	// Hidden comments drop out of the count but stay listed for moderators
+	if err := comments.SetHidden(ctx, first, true, authorID); err != nil {
+		t.Fatal(err)
+	}
+	if commentCount() != 1 {
+		t.Errorf("CommentCount with a hidden comment = %d, want 1", commentCount())
+	}
+	hidden, err := comments.ListRecent(ctx, 10, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hidden) != 1 || hidden[0].ID != first || !hidden[0].Hidden {
+		t.Errorf("hidden comments = %+v", hidden)
+	}
+	if err := comments.SetHidden(ctx, first, false, authorID); err != nil {
+		t.Fatal(err)
+	}
+	if comment, _ := comments.GetByID(ctx, first); comment.Hidden {
+		t.Error("comment still hidden after unhiding")
+	}
+
+	// Deleted comments stay in the thread as placeholders only
+	if err := comments.SoftDelete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := comments.GetByID(ctx, first); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByID deleted comment err = %v, want ErrNotFound", err)
+	}
+	listed, _ = comments.ListByPost(ctx, postID)
+	if len(listed) != 2 || !listed[0].Deleted {
+		t.Errorf("ListByPost after delete = %+v", listed)
+	}
+	if recent, _ := comments.ListRecent(ctx, 10, false); len(recent) != 1 || recent[0].ID != reply {
+		t.Errorf("ListRecent = %+v", recent)
+	}
+	if commentCount() != 1 {
+		t.Errorf("CommentCount after delete = %d, want 1", commentCount())
+	}
+}
+
+func TestNormalizeTag(t *testing.T) {
+	tests := map[string]string{
+		"Ghost Stories":                "ghost-stories",
+		"  --ghost_stories!-- ":        "ghost-stories",
+		"Été":                          "été",
+		"¡¿?!":                         "",
+		strings.Repeat("boo ", 20):     "boo-boo-boo-boo-boo-boo-boo-bo",
+		strings.Repeat("a", 29) + " b": strings.Repeat("a", 29),
+	}
+	for name, want := range tests {
+		if got := NormalizeTag(name); got != want {
+			t.Errorf("NormalizeTag(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTagRepository(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	users := NewSQLUserRepository(db)
+	posts := NewSQLPostRepository(db)
+	tags := NewSQLTagRepository(db)
+
+	authorID, err := users.Create(ctx, models.User{Username: "casper", Email: "casper@example.com", Password: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := posts.Create(ctx, models.Post{Title: "One", Content: "Boo", AuthorID: authorID, Tags: []string{"Ghosts", "halloween"}})
+	second, _ := posts.Create(ctx, models.Post{Title: "Two", Content: "Boo", AuthorID: authorID, Tags: []string{"ghost"}})
+	third, _ := posts.Create(ctx, models.Post{Title: "Three", Content: "Boo", AuthorID: authorID, Tags: []string{"ghost", "ghosts"}})
+	tagged := func(name string) []int {
+		t.Helper()
+		tag, err := tags.GetByName(ctx, name)
+		if err != nil {
+			t.Fatalf("GetByName(%q): %v", name, err)
+		}
+		page, err := posts.ListByTag(ctx, tag.ID, PageRequest{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, post := range page.Posts {
+			ids = append(ids, post.ID)
+		}
+		return ids
+	}
+
+	post, err := posts.GetByID(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(post.Tags) != "[ghosts halloween]" {
+		t.Errorf("Tags = %q", post.Tags)
+	}
+	if ids := tagged("ghosts"); fmt.Sprint(ids) != fmt.Sprint([]int{third, first}) {
+		t.Errorf("posts tagged ghosts = %v", ids)
+	}
+	cloud, err := tags.Cloud(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cloud) != 2 || cloud[0].Name != "ghost" || cloud[1].Name != "ghosts" || cloud[1].PostCount != 2 {
+		t.Errorf("Cloud = %+v", cloud)
+	}
+
+	// A tag no post uses any more is removed, but only if the post had it
+	if _, err := db.ExecContext(ctx, "INSERT INTO tags (name) VALUES ('stray')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := posts.Update(ctx, models.Post{ID: first, Title: "One", Content: "Boo", Tags: []string{"ghosts"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.GetByName(ctx, "halloween"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unused tag still there, err = %v", err)
+	}
+	if _, err := tags.GetByName(ctx, "stray"); err != nil {
+		t.Errorf("tag of another post removed, err = %v", err)
+	}
+
+	ghost, _ := tags.GetByName(ctx, "ghost")
+	ghosts, _ := tags.GetByName(ctx, "ghosts")
+	if err := tags.Rename(ctx, ghost.ID, "Ghosts"); !errors.Is(err, ErrTagExists) {
+		t.Errorf("rename onto another tag: err = %v, want ErrTagExists", err)
+	}
+	if err := tags.Rename(ctx, ghost.ID, "Spirit"); err != nil {
+		t.Fatal(err)
+	}
+	if ids := tagged("spirit"); len(ids) != 2 {
+		t.Errorf("posts tagged spirit after rename = %v", ids)
+	}
+
+	// Merging keeps one row for a post that had both tags
+	spirit, _ := tags.GetByName(ctx, "spirit")
+	if err := tags.Merge(ctx, spirit.ID, ghosts.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.GetByID(ctx, spirit.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merged tag still there, err = %v", err)
+	}
+	if ids := tagged("ghosts"); fmt.Sprint(ids) != fmt.Sprint([]int{third, second, first}) {
+		t.Errorf("posts tagged ghosts after merge = %v", ids)
+	}
+	if err := tags.Merge(ctx, spirit.ID, ghosts.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merging a missing tag: err = %v, want ErrNotFound", err)
+	}
+
+	// Trashed posts keep their tags but drop out of the counts
+	if err := posts.SoftDelete(ctx, third); err != nil {
+		t.Fatal(err)
+	}
+	all, err := tags.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].PostCount != 2 {
+		t.Errorf("List = %+v", all)
+	}
+
+	// Purging a post takes the tags only it used along
+	fourth, _ := posts.Create(ctx, models.Post{Title: "Four", Content: "Boo", AuthorID: authorID, Tags: []string{"ghosts", "poltergeist"}})
+	if err := posts.SoftDelete(ctx, fourth); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := posts.Purge(ctx, fourth); err != nil || !purged {
+		t.Fatalf("Purge = %t, %v", purged, err)
+	}
+	if _, err := tags.GetByName(ctx, "poltergeist"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("tag of the purged post still there, err = %v", err)
+	}
+	if _, err := tags.GetByName(ctx, "ghosts"); err != nil {
+		t.Errorf("tag other posts use removed, err = %v", err)
+	}
+}
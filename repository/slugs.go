@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maxSlugLength leaves room in the 100-character column for a "-N" suffix
+const maxSlugLength = 80
+
+// reservedSlugs are taken by the routes next to /post/{slug}, so a post
+// titled "Edit" gets "edit-2" rather than a page that can't be reached.
+var reservedSlugs = []string{"create", "edit", "delete", "preview"}
+
+// slugify turns a title into lowercase ASCII words joined by hyphens, e.g.
+// "Boo! A Ghost's Story" becomes "boo-a-ghost-s-story".
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = slug[:maxSlugLength]
+		// Cut at a word boundary when there is one
+		if i := strings.LastIndexByte(slug, '-'); i > maxSlugLength/2 {
+			slug = slug[:i]
+		}
+		slug = strings.TrimRight(slug, "-")
+	}
+	if slug == "" {
+		// Titles made only of punctuation or non-Latin script
+		return "post"
+	}
+	return slug
+}
+
+// fitsTitle reports whether post postID can keep slug after its title
+// changes to title, so an edit that only changes case or punctuation keeps
+// the existing link. A numbered slug only fits while the unnumbered one is
+// still taken, or "Top 10" edited to "Top" would keep "top-10".
+func fitsTitle(ctx context.Context, tx *sql.Tx, slug, title string, postID int) (bool, error) {
+	base := slugify(title)
+	if slug == base {
+		return true, nil
+	}
+	suffix, ok := strings.CutPrefix(slug, base+"-")
+	if !ok || suffix == "" || strings.Trim(suffix, "0123456789") != "" {
+		return false, nil
+	}
+	return slugTaken(ctx, tx, base, postID)
+}
+
+// uniqueSlug returns the slug for title, numbered "-2", "-3" and so on when
+// it is reserved or another post has it now or had it before. Slugs of
+// trashed posts stay taken so restoring a post doesn't break its links.
+func uniqueSlug(ctx context.Context, tx *sql.Tx, title string, postID int) (string, error) {
+	base := slugify(title)
+	for n := 1; ; n++ {
+		candidate := base
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, n)
+		}
+		taken, err := slugTaken(ctx, tx, candidate, postID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
+
+// slugTaken reports whether slug is reserved or belongs, now or before, to
+// a post other than postID.
+func slugTaken(ctx context.Context, tx *sql.Tx, slug string, postID int) (bool, error) {
+	if slices.Contains(reservedSlugs, slug) {
+		return true, nil
+	}
+	var taken int
+	err := tx.QueryRowContext(ctx, `SELECT
+		(SELECT COUNT(*) FROM posts WHERE slug = ? AND id <> ?) +
+		(SELECT COUNT(*) FROM post_slug_redirects WHERE slug = ? AND post_id <> ?)`,
+		slug, postID, slug, postID).Scan(&taken)
+	return taken > 0, err
+}
+
+// setSlug gives a post the slug for title. The slug it had before, if any,
+// becomes a redirect; a slug the post had earlier is reclaimed from the
+// redirects when the title is changed back.
+func setSlug(ctx context.Context, tx *sql.Tx, postID int, current sql.NullString, title string) error {
+	slug, err := uniqueSlug(ctx, tx, title, postID)
+	if err != nil {
+		return err
+	}
+	if current.Valid {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO post_slug_redirects (slug, post_id) VALUES (?, ?)", current.String, postID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM post_slug_redirects WHERE slug = ? AND post_id = ?", slug, postID); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE posts SET slug = ? WHERE id = ?", slug, postID)
+	return err
+}
+
+// AssignMissingSlugs gives every post without a slug one made from its
+// title, oldest first so earlier posts get the unnumbered slugs. Posts
+// written before slugs existed need this once, as do posts given a slug
+// before it was reserved; it returns how many were updated.
+func (s *SQLPostRepository) AssignMissingSlugs(ctx context.Context) (int, error) {
+	args := make([]interface{}, len(reservedSlugs))
+	for i, slug := range reservedSlugs {
+		args[i] = slug
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, title FROM posts
+		WHERE slug IS NULL OR slug IN (?`+strings.Repeat(", ?", len(reservedSlugs)-1)+`)
+		ORDER BY created_at, id`, args...)
+	if err != nil {
+		return 0, err
+	}
+	type unslugged struct {
+		id    int
+		title string
+	}
+	var posts []unslugged
+	for rows.Next() {
+		var post unslugged
+		if err := rows.Scan(&post.id, &post.title); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		posts = append(posts, post)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, post := range posts {
+		if err := s.assignSlug(ctx, post.id, post.title); err != nil {
+			return i, fmt.Errorf("post %d: %w", post.id, err)
+		}
+	}
+	return len(posts), nil
+}
+
+func (s *SQLPostRepository) assignSlug(ctx context.Context, postID int, title string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := setSlug(ctx, tx, postID, sql.NullString{}, title); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"unicode"
+	"webapp/database"
+	"webapp/models"
+)
+
+// ErrTagExists is returned when renaming a tag to the name of another one;
+// merge the two instead.
+var ErrTagExists = errors.New("tag name already in use")
+
+// MaxTagLength is the most characters a tag name keeps
+const MaxTagLength = 30
+
+// NormalizeTag turns what an author typed into the stored form of a tag:
+// lowercase letters and digits in any script, with the words joined by
+// hyphens, so "Ghost Stories" and "ghost-stories!" are the same tag. It
+// returns "" when nothing usable is left.
+func NormalizeTag(name string) string {
+	var b strings.Builder
+	length, hyphen := 0, false
+	for _, r := range strings.ToLower(name) {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			hyphen = true
+			continue
+		}
+		if length == MaxTagLength {
+			break
+		}
+		if hyphen && b.Len() > 0 {
+			if length == MaxTagLength-1 {
+				break
+			}
+			b.WriteByte('-')
+			length++
+		}
+		b.WriteRune(r)
+		length++
+		hyphen = false
+	}
+	return b.String()
+}
+
+// TagRepository stores tags. Post counts only include posts readers can
+// see, so trashed posts and authors don't inflate them.
+type TagRepository interface {
+	// List returns every tag alphabetically, including those only trashed
+	// posts use
+	List(ctx context.Context) ([]models.Tag, error)
+	// Cloud returns up to limit of the most used tags, alphabetically
+	Cloud(ctx context.Context, limit int) ([]models.Tag, error)
+	GetByName(ctx context.Context, name string) (models.Tag, error)
+	GetByID(ctx context.Context, id int) (models.Tag, error)
+
+	// Rename gives a tag a new name, normalized like NormalizeTag
+	Rename(ctx context.Context, id int, name string) error
+	// Merge moves every post tagged fromID to intoID and deletes fromID
+	Merge(ctx context.Context, fromID, intoID int) error
+}
+
+// SQLTagRepository is the TagRepository backed by the database.
+type SQLTagRepository struct {
+	db *sql.DB
+}
+
+func NewSQLTagRepository(db *sql.DB) *SQLTagRepository {
+	return &SQLTagRepository{db: db}
+}
+
+// tagColumns reads a tag from tags t along with its count of visible posts
+const tagColumns = `t.id, t.name, (SELECT COUNT(*) FROM post_tags pt
+	JOIN posts p ON pt.post_id = p.id
+	JOIN users u ON p.author_id = u.id
+	WHERE pt.tag_id = t.id AND p.deleted_at IS NULL AND u.deleted_at IS NULL)`
+
+func scanTag(row scanner) (models.Tag, error) {
+	var tag models.Tag
+	err := row.Scan(&tag.ID, &tag.Name, &tag.PostCount)
+	return tag, notFound(err)
+}
+
+func (s *SQLTagRepository) queryTags(ctx context.Context, query string, args ...interface{}) ([]models.Tag, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []models.Tag
+	for rows.Next() {
+		tag, err := scanTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (s *SQLTagRepository) List(ctx context.Context) ([]models.Tag, error) {
+	return s.queryTags(ctx, `SELECT `+tagColumns+` FROM tags t ORDER BY t.name`)
+}
+
+func (s *SQLTagRepository) Cloud(ctx context.Context, limit int) ([]models.Tag, error) {
+	tags, err := s.queryTags(ctx, `SELECT id, name, posts FROM (SELECT `+tagColumns+` AS posts FROM tags t) counted
+		WHERE posts > 0
+		ORDER BY posts DESC, name
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(tags, func(a, b models.Tag) int { return strings.Compare(a.Name, b.Name) })
+	return tags, nil
+}
+
+func (s *SQLTagRepository) GetByName(ctx context.Context, name string) (models.Tag, error) {
+	return scanTag(s.db.QueryRowContext(ctx, `SELECT `+tagColumns+` FROM tags t WHERE t.name = ?`, NormalizeTag(name)))
+}
+
+func (s *SQLTagRepository) GetByID(ctx context.Context, id int) (models.Tag, error) {
+	return scanTag(s.db.QueryRowContext(ctx, `SELECT `+tagColumns+` FROM tags t WHERE t.id = ?`, id))
+}
+
+func (s *SQLTagRepository) Rename(ctx context.Context, id int, name string) error {
+	name = NormalizeTag(name)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var taken int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM tags WHERE name = ? AND id <> ?", name, id).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrTagExists
+	}
+	renamed, err := affected(tx.ExecContext(ctx, "UPDATE tags SET name = ? WHERE id = ?", name, id))
+	if err != nil {
+		return err
+	}
+	if !renamed {
+		// Also when the name is unchanged, which MySQL doesn't count
+		if err := tx.QueryRowContext(ctx, "SELECT id FROM tags WHERE id = ?", id).Scan(&id); err != nil {
+			return notFound(err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLTagRepository) Merge(ctx context.Context, fromID, intoID int) error {
+	if fromID == intoID {
+		return nil
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM tags WHERE id IN (?, ?) "+database.DBDialect.ForUpdate(), fromID, intoID).Scan(&found); err != nil {
+		return err
+	}
+	if found != 2 {
+		return ErrNotFound
+	}
+	// Posts that already have both tags keep their existing row
+	if _, err := tx.ExecContext(ctx, database.DBDialect.InsertIgnore()+` INTO post_tags (post_id, tag_id)
+		SELECT post_id, ? FROM post_tags WHERE tag_id = ?`, intoID, fromID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM post_tags WHERE tag_id = ?", fromID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE id = ?", fromID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// setTags replaces a post's tags with names, creating tags that don't
+// exist yet. Tags the post had that no post uses any more are removed.
+func setTags(ctx context.Context, tx *sql.Tx, postID int, names []string) error {
+	previous, err := database.PostTagIDs(ctx, tx, "p.id = ?", postID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM post_tags WHERE post_id = ?", postID); err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = NormalizeTag(name)
+		if name == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, database.DBDialect.InsertIgnore()+" INTO tags (name) VALUES (?)", name); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, database.DBDialect.InsertIgnore()+` INTO post_tags (post_id, tag_id)
+			SELECT ?, id FROM tags WHERE name = ?`, postID, name); err != nil {
+			return err
+		}
+	}
+	return database.DeleteUnusedTags(ctx, tx, previous)
+}
+
+// attachTags fills in Tags on each of posts with a single query
+func attachTags(ctx context.Context, db *sql.DB, posts []models.Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	index := make(map[int]int, len(posts))
+	args := make([]interface{}, len(posts))
+	for i, post := range posts {
+		index[post.ID] = i
+		args[i] = post.ID
+	}
+	rows, err := db.QueryContext(ctx, `SELECT pt.post_id, t.name FROM post_tags pt
+		JOIN tags t ON pt.tag_id = t.id
+		WHERE pt.post_id IN (?`+strings.Repeat(", ?", len(posts)-1)+`)
+		ORDER BY t.name`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return err
+		}
+		i := index[postID]
+		posts[i].Tags = append(posts[i].Tags, name)
+	}
+	return rows.Err()
+}
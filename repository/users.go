@@ -0,0 +1,546 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"webapp/database"
+	"webapp/models"
+)
+
+var (
+	// ErrUserExists is returned when a new account's username or email is
+	// already taken.
+	ErrUserExists = errors.New("username or email already in use")
+
+	// ErrEmailTaken is returned when an email change clashes with another
+	// account.
+	ErrEmailTaken = errors.New("email address already in use")
+)
+
+// UserRepository stores accounts along with the per-account tokens and
+// recovery codes that belong to them. Lookups skip accounts in the trash.
+type UserRepository interface {
+	GetByID(ctx context.Context, id int) (models.User, error)
+	GetByUsername(ctx context.Context, username string) (models.User, error)
+	GetByEmail(ctx context.Context, email string) (models.User, error)
+	// EmailTaken includes trashed accounts, which keep their address
+	// until they are purged
+	EmailTaken(ctx context.Context, email string) (bool, error)
+	Count(ctx context.Context) (int, error)
+	// ListWithRoles returns every active account with Roles filled in,
+	// newest first
+	ListWithRoles(ctx context.Context) ([]models.User, error)
+
+	// Create adds an account and returns its ID
+	Create(ctx context.Context, user models.User) (int, error)
+	// CreateInvited adds an account and marks the invitation it used in
+	// one transaction
+	CreateInvited(ctx context.Context, user models.User, invitationID int) (int, error)
+	// UpdateProfile saves the username and profile fields, and the
+	// profile image when user.ProfileImage is set
+	UpdateProfile(ctx context.Context, user models.User) error
+	ClearProfileImage(ctx context.Context, id int) error
+
+	SetPassword(ctx context.Context, id int, hash string) error
+	// ReplacePasswordHash swaps oldHash for newHash, and does nothing if
+	// the password was changed in the meantime
+	ReplacePasswordHash(ctx context.Context, id int, oldHash, newHash string) error
+	CreatePasswordResetToken(ctx context.Context, id int, tokenHash string, expiresAt time.Time) error
+	// GetByPasswordResetToken returns the owner of a valid, unused token
+	GetByPasswordResetToken(ctx context.Context, tokenHash string) (models.User, error)
+	// ResetPassword uses the token and sets the new password, voiding the
+	// user's other reset links. It reports false if the token was already used.
+	ResetPassword(ctx context.Context, id int, tokenHash, hash string) (bool, error)
+
+	CreateEmailChange(ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time) error
+	// ApplyEmailChange switches to the address of a valid, unused token and
+	// returns the user's ID. Tokens of users in the trash are not found.
+	ApplyEmailChange(ctx context.Context, tokenHash string) (int, error)
+
+	SetTOTPSecret(ctx context.Context, id int, secret string) error
+	// EnableTOTP turns 2FA on, recording step as the last code used, and
+	// replaces the user's recovery codes with the given hashes
+	EnableTOTP(ctx context.Context, id int, step int64, codeHashes []string) error
+	// UseTOTPStep records step as the last TOTP code used. It reports false
+	// if that step or a later one was already used.
+	UseTOTPStep(ctx context.Context, id int, step int64) (bool, error)
+	// DisableTOTP clears the secret and the recovery codes
+	DisableTOTP(ctx context.Context, id int) error
+	// UseRecoveryCode marks a matching unused code as used and reports
+	// whether there was one
+	UseRecoveryCode(ctx context.Context, id int, codeHash string) (bool, error)
+
+	// SetSuspended, RequirePasswordReset and SoftDelete return
+	// ErrLastAdmin instead of locking out the last admin who can log in
+	SetSuspended(ctx context.Context, id int, suspended bool) error
+	RequirePasswordReset(ctx context.Context, id int) error
+
+	// SoftDelete moves an account to the trash
+	SoftDelete(ctx context.Context, id int) error
+	// TrashWithoutRole moves every account that holds no role to the
+	// trash and returns their IDs, so the caller can end their sessions
+	TrashWithoutRole(ctx context.Context) ([]int, error)
+	ListTrashed(ctx context.Context) ([]TrashedUser, error)
+	// Restore and Purge act on trashed accounts only and report whether
+	// there was one
+	Restore(ctx context.Context, id int) (bool, error)
+	Purge(ctx context.Context, id int) (bool, error)
+}
+
+// TrashedUser is a deleted account waiting in the trash
+type TrashedUser struct {
+	ID        int
+	Username  string
+	Email     string
+	PostCount int
+	DeletedAt time.Time
+}
+
+// SQLUserRepository is the UserRepository backed by the database.
+type SQLUserRepository struct {
+	db *sql.DB
+}
+
+func NewSQLUserRepository(db *sql.DB) *SQLUserRepository {
+	return &SQLUserRepository{db: db}
+}
+
+const userColumns = `id, username, email, password, bio, profile_image, location, website,
+	invitation_code, invited_by, totp_enabled, totp_secret, totp_last_step, suspended_at, password_reset_required,
+	created_at, updated_at`
+
+func scanUser(row scanner) (models.User, error) {
+	var user models.User
+	var bio, profileImage, location, website, invitationCode, totpSecret sql.NullString
+	var totpLastStep sql.NullInt64
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &bio, &profileImage, &location, &website,
+		&invitationCode, &user.InvitedBy, &user.TOTPEnabled, &totpSecret, &totpLastStep, &user.SuspendedAt, &user.ResetRequired,
+		&user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return user, notFound(err)
+	}
+	user.Bio = bio.String
+	user.ProfileImage = profileImage.String
+	user.Location = location.String
+	user.Website = website.String
+	user.InvitationCode = invitationCode.String
+	user.TOTPSecret = totpSecret.String
+	user.TOTPLastStep = totpLastStep.Int64
+	return user, nil
+}
+
+func (s *SQLUserRepository) getBy(ctx context.Context, column string, value interface{}) (models.User, error) {
+	// column is one of the fixed names passed by the methods below
+	return scanUser(s.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE "+column+" = ? AND deleted_at IS NULL", value))
+}
+
+func (s *SQLUserRepository) GetByID(ctx context.Context, id int) (models.User, error) {
+	return s.getBy(ctx, "id", id)
+}
+
+func (s *SQLUserRepository) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	return s.getBy(ctx, "username", username)
+}
+
+func (s *SQLUserRepository) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	return s.getBy(ctx, "email", email)
+}
+
+func (s *SQLUserRepository) EmailTaken(ctx context.Context, email string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE email = ?", email).Scan(&count)
+	return count > 0, err
+}
+
+func (s *SQLUserRepository) Count(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE deleted_at IS NULL").Scan(&count)
+	return count, err
+}
+
+func (s *SQLUserRepository) ListWithRoles(ctx context.Context) ([]models.User, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.email, u.created_at, u.invited_by, u.suspended_at, u.password_reset_required,
+			COALESCE(GROUP_CONCAT(r.name ORDER BY r.name), '')
+		FROM users u
+		LEFT JOIN user_roles ur ON ur.user_id = u.id
+		LEFT JOIN roles r ON r.id = ur.role_id
+		WHERE u.deleted_at IS NULL
+		GROUP BY u.id, u.username, u.email, u.created_at, u.invited_by, u.suspended_at, u.password_reset_required
+		ORDER BY u.created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.User
+	for rows.Next() {
+		var user models.User
+		var roles string
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.InvitedBy, &user.SuspendedAt, &user.ResetRequired, &roles)
+		if err != nil {
+			return nil, err
+		}
+		if roles != "" {
+			user.Roles = strings.Split(roles, ",")
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// insertUser is shared by Create and CreateInvited
+func insertUser(ctx context.Context, exec interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}, user models.User) (int, error) {
+	result, err := exec.ExecContext(ctx, `
+		INSERT INTO users (username, email, password, invitation_code, invited_by)
+		VALUES (?, ?, ?, ?, ?)
+	`, user.Username, user.Email, user.Password, user.InvitationCode, user.InvitedBy)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUserExists, err)
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func (s *SQLUserRepository) Create(ctx context.Context, user models.User) (int, error) {
+	return insertUser(ctx, s.db, user)
+}
+
+func (s *SQLUserRepository) CreateInvited(ctx context.Context, user models.User, invitationID int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := insertUser(ctx, tx, user)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE invitation_codes
+		SET is_used = TRUE, used_by = ?, used_at = NOW()
+		WHERE id = ?
+	`, id, invitationID)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s *SQLUserRepository) UpdateProfile(ctx context.Context, user models.User) error {
+	query := "UPDATE users SET username = ?, bio = ?, location = ?, website = ?"
+	args := []interface{}{user.Username, user.Bio, user.Location, user.Website}
+	if user.ProfileImage != "" {
+		query += ", profile_image = ?"
+		args = append(args, user.ProfileImage)
+	}
+	query += " WHERE id = ?"
+	args = append(args, user.ID)
+
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *SQLUserRepository) ClearProfileImage(ctx context.Context, id int) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET profile_image = NULL WHERE id = ?", id)
+	return err
+}
+
+func (s *SQLUserRepository) SetPassword(ctx context.Context, id int, hash string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hash, id)
+	return err
+}
+
+func (s *SQLUserRepository) ReplacePasswordHash(ctx context.Context, id int, oldHash, newHash string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ? AND password = ?", newHash, id, oldHash)
+	return err
+}
+
+func (s *SQLUserRepository) CreatePasswordResetToken(ctx context.Context, id int, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES (?, ?, ?)
+	`, id, tokenHash, expiresAt)
+	return err
+}
+
+func (s *SQLUserRepository) GetByPasswordResetToken(ctx context.Context, tokenHash string) (models.User, error) {
+	var user models.User
+	err := s.db.QueryRowContext(ctx, `
+		SELECT u.id, u.username FROM password_reset_tokens t
+		JOIN users u ON t.user_id = u.id
+		WHERE u.deleted_at IS NULL AND t.token_hash = ? AND t.used_at IS NULL AND t.expires_at > ?
+	`, tokenHash, time.Now()).Scan(&user.ID, &user.Username)
+	return user, notFound(err)
+}
+
+func (s *SQLUserRepository) ResetPassword(ctx context.Context, id int, tokenHash, hash string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Marking the token used in the same statement that checks it keeps
+	// two concurrent submissions from both succeeding
+	used, err := affected(tx.ExecContext(ctx, `
+		UPDATE password_reset_tokens SET used_at = NOW()
+		WHERE token_hash = ? AND user_id = ? AND used_at IS NULL
+	`, tokenHash, id))
+	if err != nil || !used {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ?, password_reset_required = FALSE WHERE id = ?", hash, id); err != nil {
+		return false, err
+	}
+
+	// Any other outstanding links for this account stop working too
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_reset_tokens WHERE user_id = ? AND used_at IS NULL", id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLUserRepository) CreateEmailChange(ctx context.Context, id int, newEmail, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO email_change_tokens (user_id, new_email, token_hash, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, id, newEmail, tokenHash, expiresAt)
+	return err
+}
+
+func (s *SQLUserRepository) ApplyEmailChange(ctx context.Context, tokenHash string) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var newEmail string
+	err = tx.QueryRowContext(ctx, `
+		SELECT user_id, new_email FROM email_change_tokens
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`+database.DBDialect.ForUpdate(), tokenHash, time.Now()).Scan(&userID, &newEmail)
+	if err != nil {
+		return 0, notFound(err)
+	}
+
+	changed, err := affected(tx.ExecContext(ctx, "UPDATE users SET email = ? WHERE id = ? AND deleted_at IS NULL", newEmail, userID))
+	if database.DBDialect.IsDuplicateKey(err) {
+		return 0, fmt.Errorf("%w: %v", ErrEmailTaken, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !changed {
+		return 0, ErrNotFound
+	}
+
+	// Older pending changes for this account are void once one is applied
+	if _, err := tx.ExecContext(ctx, "UPDATE email_change_tokens SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+func (s *SQLUserRepository) SetTOTPSecret(ctx context.Context, id int, secret string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE users SET totp_secret = ? WHERE id = ?", secret, id)
+	return err
+}
+
+func (s *SQLUserRepository) EnableTOTP(ctx context.Context, id int, step int64, codeHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?", step, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", id, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The condition makes two requests racing with the same code use it once
+func (s *SQLUserRepository) UseTOTPStep(ctx context.Context, id int, step int64) (bool, error) {
+	return affected(s.db.ExecContext(ctx, `
+		UPDATE users SET totp_last_step = ?
+		WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)
+	`, step, id, step))
+}
+
+func (s *SQLUserRepository) DisableTOTP(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET totp_enabled = FALSE, totp_secret = NULL, totp_last_step = NULL WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Codes are random, so a user never holds two with the same hash
+func (s *SQLUserRepository) UseRecoveryCode(ctx context.Context, id int, codeHash string) (bool, error) {
+	return affected(s.db.ExecContext(ctx, `
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, id, codeHash))
+}
+
+func (s *SQLUserRepository) SetSuspended(ctx context.Context, id int, suspended bool) error {
+	if !suspended {
+		_, err := s.db.ExecContext(ctx, "UPDATE users SET suspended_at = NULL WHERE id = ?", id)
+		return err
+	}
+	return s.updateKeepingAdmin(ctx, id, "UPDATE users SET suspended_at = NOW() WHERE id = ?")
+}
+
+func (s *SQLUserRepository) RequirePasswordReset(ctx context.Context, id int) error {
+	return s.updateKeepingAdmin(ctx, id, "UPDATE users SET password_reset_required = TRUE WHERE id = ?")
+}
+
+func (s *SQLUserRepository) SoftDelete(ctx context.Context, id int) error {
+	return s.updateKeepingAdmin(ctx, id, "UPDATE users SET deleted_at = NOW() WHERE id = ?")
+}
+
+// updateKeepingAdmin runs query, which locks user id out, unless id is the
+// last admin who can log in. The check and the update share a transaction,
+// so two admins acting on each other at once can't both succeed.
+func (s *SQLUserRepository) updateKeepingAdmin(ctx context.Context, id int, query string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var isAdmin int
+	err = tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM user_roles ur
+		JOIN roles r ON r.id = ur.role_id
+		WHERE r.name = ? AND ur.user_id = ?
+	`, database.RoleAdmin, id).Scan(&isAdmin)
+	if err != nil {
+		return err
+	}
+	if isAdmin > 0 {
+		if err := otherAdminsRemain(ctx, tx, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, query, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLUserRepository) TrashWithoutRole(ctx context.Context) ([]int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id FROM users
+		WHERE deleted_at IS NULL AND id NOT IN (SELECT user_id FROM user_roles)
+	`+database.DBDialect.ForUpdate())
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET deleted_at = NOW() WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (s *SQLUserRepository) ListTrashed(ctx context.Context) ([]TrashedUser, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.email, u.deleted_at,
+			(SELECT COUNT(*) FROM posts p WHERE p.author_id = u.id)
+		FROM users u
+		WHERE u.deleted_at IS NOT NULL
+		ORDER BY u.deleted_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []TrashedUser
+	for rows.Next() {
+		var user TrashedUser
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.DeletedAt, &user.PostCount); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLUserRepository) Restore(ctx context.Context, id int) (bool, error) {
+	return affected(s.db.ExecContext(ctx, "UPDATE users SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id))
+}
+
+// The user's posts go with them, and so do tags only those posts used
+func (s *SQLUserRepository) Purge(ctx context.Context, id int) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	tagIDs, err := database.PostTagIDs(ctx, tx, "u.id = ? AND u.deleted_at IS NOT NULL", id)
+	if err != nil {
+		return false, err
+	}
+	purged, err := affected(tx.ExecContext(ctx, "DELETE FROM users WHERE id = ? AND deleted_at IS NOT NULL", id))
+	if err != nil || !purged {
+		return false, err
+	}
+	if err := database.DeleteUnusedTags(ctx, tx, tagIDs); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,37 @@
+// Live preview for the post forms. The server renders and sanitizes the
+// Markdown, so the preview matches what will be published.
+(function () {
+    var textarea = document.querySelector('textarea[name="content"]');
+    var preview = document.getElementById('preview');
+    var token = document.querySelector('input[name="csrf_token"]');
+    if (!textarea || !preview || !token) {
+        return;
+    }
+
+    var timer;
+    function update() {
+        var body = new URLSearchParams();
+        body.set('content', textarea.value);
+        fetch('/post/preview', {
+            method: 'POST',
+            headers: { 'X-CSRF-Token': token.value },
+            body: body,
+            credentials: 'same-origin'
+        }).then(function (response) {
+            if (!response.ok) {
+                throw new Error(response.status);
+            }
+            return response.text();
+        }).then(function (html) {
+            preview.innerHTML = html;
+        }).catch(function () {
+            preview.textContent = 'Preview unavailable';
+        });
+    }
+
+    textarea.addEventListener('input', function () {
+        clearTimeout(timer);
+        timer = setTimeout(update, 300);
+    });
+    update();
+})();
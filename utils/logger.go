@@ -6,6 +6,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -13,36 +14,80 @@ var (
 	InfoLogger  *log.Logger
 	ErrorLogger *log.Logger
 	AuthLogger  *log.Logger
+	AuditLogger *log.Logger
 )
 
-func InitLogger() {
-	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		log.Fatal("Failed to create logs directory:", err)
-	}
+// Loggers is one set of log destinations. The Log* functions write to the
+// set installed with SetLoggers.
+type Loggers struct {
+	Info  *log.Logger
+	Error *log.Logger
+	Auth  *log.Logger
+	Audit *log.Logger
+	files []*os.File
+}
 
-	// Open log files
-	infoFile, err := os.OpenFile("logs/info.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open info log file:", err)
+// NewLoggers opens info.log, error.log, auth.log and audit.log in dir,
+// creating it if needed. Each logger also writes to the console, with
+// secrets scrubbed.
+func NewLoggers(dir string) (*Loggers, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating logs directory: %w", err)
 	}
 
-	errorFile, err := os.OpenFile("logs/error.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open error log file:", err)
+	loggers := &Loggers{}
+	open := func(name string, console io.Writer, prefix string, flag int) (*log.Logger, error) {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("opening %s: %w", name, err)
+		}
+		loggers.files = append(loggers.files, file)
+		return log.New(NewRedactingWriter(io.MultiWriter(file, console)), prefix, flag), nil
 	}
 
-	authFile, err := os.OpenFile("logs/auth.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open auth log file:", err)
+	var err error
+	if loggers.Info, err = open("info.log", os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile); err != nil {
+		loggers.Close()
+		return nil, err
+	}
+	if loggers.Error, err = open("error.log", os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile); err != nil {
+		loggers.Close()
+		return nil, err
+	}
+	if loggers.Auth, err = open("auth.log", os.Stdout, "AUTH: ", log.Ldate|log.Ltime|log.Lshortfile); err != nil {
+		loggers.Close()
+		return nil, err
 	}
+	if loggers.Audit, err = open("audit.log", os.Stdout, "AUDIT: ", log.Ldate|log.Ltime); err != nil {
+		loggers.Close()
+		return nil, err
+	}
+	return loggers, nil
+}
 
-	// Create loggers that write to both files and console
-	InfoLogger = log.New(io.MultiWriter(infoFile, os.Stdout), "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLogger = log.New(io.MultiWriter(errorFile, os.Stderr), "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-	AuthLogger = log.New(io.MultiWriter(authFile, os.Stdout), "AUTH: ", log.Ldate|log.Ltime|log.Lshortfile)
+// DiscardLoggers returns loggers that drop everything, for tests.
+func DiscardLoggers() *Loggers {
+	discard := log.New(io.Discard, "", 0)
+	return &Loggers{Info: discard, Error: discard, Auth: discard, Audit: discard}
+}
 
-	InfoLogger.Println("Logger initialized successfully")
+// Close closes the log files.
+func (l *Loggers) Close() error {
+	var firstErr error
+	for _, file := range l.files {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SetLoggers makes l the destination of the Log* functions.
+func SetLoggers(l *Loggers) {
+	InfoLogger = l.Info
+	ErrorLogger = l.Error
+	AuthLogger = l.Auth
+	AuditLogger = l.Audit
 }
 
 func LogInfo(message string) {
@@ -66,6 +111,15 @@ func LogAuth(event, username, ip string, success bool) {
 	AuthLogger.Println(logMessage)
 }
 
+// LogAudit records a privileged action taken by actor against target
+func LogAudit(actor, action, target, ip, details string) {
+	logMessage := fmt.Sprintf("%s - Actor: %s, Target: %s, IP: %s", action, actor, target, ip)
+	if details != "" {
+		logMessage += ", Details: " + details
+	}
+	AuditLogger.Println(logMessage)
+}
+
 func LogSignup(username, email, ip string, success bool) {
 	LogAuth("SIGNUP", username, ip, success)
 }
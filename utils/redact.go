@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// DefaultRedactedFields are scrubbed from every log line. Extra field names
+// can be added with AddRedactedField.
+var DefaultRedactedFields = []string{
+	"password", "passwd", "secret", "token", "session_token", "csrf_token",
+	"invitation_code", "invite_code", "cookie", "authorization",
+}
+
+var (
+	redactMu      sync.RWMutex
+	redactFields  []string
+	fieldPattern  *regexp.Regexp
+	valuePatterns = []*regexp.Regexp{
+		// bcrypt hashes
+		regexp.MustCompile(`\$2[aby]?\$\d{2}\$[./A-Za-z0-9]{53}`),
+		// invitation codes generated by GenerateInvitationCode
+		regexp.MustCompile(`INV-\d+-[A-Z0-9]+`),
+		// session cookies in dumped headers
+		regexp.MustCompile(`session_token=[^;\s]+`),
+	}
+)
+
+func init() {
+	redactFields = append(redactFields, DefaultRedactedFields...)
+	compileFieldPattern()
+}
+
+// AddRedactedField adds a field name whose values are scrubbed from logs.
+func AddRedactedField(field string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	redactFields = append(redactFields, field)
+	compileFieldPattern()
+}
+
+func compileFieldPattern() {
+	names := make([]string, len(redactFields))
+	for i, field := range redactFields {
+		names[i] = regexp.QuoteMeta(field)
+	}
+	// Matches key=value, key: value, "key":"value" and key: 'value' forms
+	fieldPattern = regexp.MustCompile(`(?i)\b(` + strings.Join(names, "|") + `)(["']?\s*[:=]\s*["']?)([^\s"',&;]+)`)
+}
+
+// Redact scrubs sensitive values from a log line.
+func Redact(line string) string {
+	redactMu.RLock()
+	pattern := fieldPattern
+	redactMu.RUnlock()
+
+	line = pattern.ReplaceAllString(line, "${1}${2}"+redacted)
+	for _, p := range valuePatterns {
+		line = p.ReplaceAllStringFunc(line, func(match string) string {
+			if strings.HasPrefix(match, "session_token=") {
+				return "session_token=" + redacted
+			}
+			return redacted
+		})
+	}
+	return line
+}
+
+// redactingWriter passes every write through Redact. log.Logger writes one
+// full line per call, so patterns never straddle two writes.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter wraps w so everything written to it is redacted first.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
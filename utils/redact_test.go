@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		line   string
+		secret string
+	}{
+		{"Login attempt - Username: 'bob', Password: 'hunter2'", "hunter2"},
+		{"password=hunter2&username=bob", "hunter2"},
+		{`{"password":"hunter2"}`, "hunter2"},
+		{"Stored hash: $2a$14$92IXUNpkjO0rOQ5byMi.Ye4oKoEa3Ro9llC/.og/at2.uheWG/igi", "92IXUNpkjO0rOQ5byMi"},
+		{"Admin 1 generated invitation code: INV-1700000000-ABCD1234", "ABCD1234"},
+		{"Cookie: session_token=abc.def; other=1", "abc.def"},
+		{"csrf_token=xyz123", "xyz123"},
+	}
+
+	for _, tt := range tests {
+		got := Redact(tt.line)
+		if strings.Contains(got, tt.secret) {
+			t.Errorf("Redact(%q) = %q, secret still present", tt.line, got)
+		}
+	}
+
+	if got := Redact("User bob logged in from IP 127.0.0.1"); got != "User bob logged in from IP 127.0.0.1" {
+		t.Errorf("Redact changed a harmless line: %q", got)
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(NewRedactingWriter(&buf), "", 0)
+	logger.Printf("reset token=%s for user %s", "s3cr3t", "bob")
+
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Errorf("Secret leaked through logger: %q", buf.String())
+	}
+}
+
+func TestAddRedactedField(t *testing.T) {
+	AddRedactedField("totp_code")
+	if got := Redact("totp_code=123456"); strings.Contains(got, "123456") {
+		t.Errorf("Custom field was not redacted: %q", got)
+	}
+}